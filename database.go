@@ -25,6 +25,9 @@ type Options struct {
 	SSLModeDisable bool
 	LogMode        bool
 	Logger         Logger
+	// Keyring holds the envelope keys used to encrypt secret columns, such
+	// as hosted network keys, at rest. Secrets can't be stored if nil.
+	Keyring *models.Keyring
 }
 
 // New is used to init our connection to a database, and return a manager struct
@@ -32,6 +35,11 @@ func New(cfg *config.TemporalConfig, opts Options) (*Manager, error) {
 	if cfg == nil {
 		return nil, errors.New("invalid configuration provided")
 	}
+	if opts.Keyring != nil {
+		if err := opts.Keyring.Validate(); err != nil {
+			return nil, err
+		}
+	}
 
 	db, err := openDBConnection(dbOptions{
 		User:           cfg.Database.Username,
@@ -48,16 +56,22 @@ func New(cfg *config.TemporalConfig, opts Options) (*Manager, error) {
 		db.SetLogger(opts.Logger)
 	}
 	db.LogMode(opts.LogMode)
+	if opts.Keyring != nil {
+		db = models.WithKeyring(db, opts.Keyring)
+	}
 
 	var dbm = Manager{DB: db}
 	if opts.RunMigrations {
-		dbm.RunMigrations()
+		if err := dbm.RunMigrations(); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 	return &dbm, nil
 }
 
 // RunMigrations runs all migrations
-func (dbm *Manager) RunMigrations() {
+func (dbm *Manager) RunMigrations() error {
 	for _, t := range []interface{}{
 		&models.Upload{},
 		&models.EncryptedUpload{},
@@ -69,9 +83,69 @@ func (dbm *Manager) RunMigrations() {
 		&models.Record{},
 		&models.Usage{},
 		&models.Organization{},
+		&models.Session{},
+		&models.UserToken{},
+		&models.LoginAttempt{},
+		&models.RecoveryCode{},
+		&models.PasswordHistory{},
+		&models.Role{},
+		&models.UserRole{},
+		&models.AuditEvent{},
+		&models.EmailHistory{},
+		&models.AccountSuspension{},
+		&models.IPFSKey{},
+		&models.KeyGrant{},
+		&models.NetworkMember{},
+		&models.NetworkStateTransition{},
+		&models.ResourceQuota{},
+		&models.NetworkNode{},
+		&models.NodeStatusChange{},
+		&models.SwarmKeyRotation{},
+		&models.NetworkCharge{},
+		&models.IPNSRevision{},
 	} {
-		dbm.DB.AutoMigrate(t)
+		if err := dbm.DB.AutoMigrate(t).Error; err != nil {
+			return err
+		}
+	}
+	// move administrators from the legacy admin flag to the admin role
+	if err := models.NewRoleManager(dbm.DB).MigrateAdminAccess(); err != nil {
+		return err
+	}
+	// move keys from the legacy user key arrays to the key table
+	if err := models.NewUserManager(dbm.DB).MigrateIPFSKeyArrays(); err != nil {
+		return err
+	}
+	// move network access from the legacy user and network arrays to the membership table
+	if err := models.NewHostedNetworkManager(dbm.DB).MigrateNetworkMembership(); err != nil {
+		return err
+	}
+	// assign lifecycle states to networks created before they existed
+	if err := models.NewHostedNetworkManager(dbm.DB).MigrateNetworkStates(); err != nil {
+		return err
+	}
+	// identify ipns records by their hash and network
+	if err := models.NewIPNSManager(dbm.DB).MigrateIPNSIdentity(); err != nil {
+		return err
+	}
+	// move ipns history from the legacy hash arrays to the revision table
+	if err := models.NewIPNSManager(dbm.DB).MigrateIPNSRevisions(); err != nil {
+		return err
+	}
+	// store ipns lifetimes and ttls as durations with an expiry
+	if err := models.NewIPNSManager(dbm.DB).MigrateIPNSDurations(); err != nil {
+		return err
+	}
+	// copy the legacy allowed origin of networks into their access policy
+	if err := models.NewHostedNetworkManager(dbm.DB).MigrateNetworkAccessPolicies(); err != nil {
+		return err
+	}
+	// encrypt network keys stored before a keyring was configured
+	if err := models.NewHostedNetworkManager(dbm.DB).MigrateNetworkSecrets(); err != nil {
+		return err
 	}
+	// move two-factor secrets onto the keyring
+	return models.NewUserManager(dbm.DB).MigrateTOTPSecrets()
 }
 
 // Close shuts down database connection
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/RTradeLtd/config/v2"
+	"github.com/RTradeLtd/database/v2/models"
 	"go.uber.org/zap"
 )
 
@@ -13,6 +14,13 @@ func TestNew(t *testing.T) {
 			t.Error("expected error")
 		}
 	})
+	t.Run("invalid keyring", func(t *testing.T) {
+		if _, err := New(&config.TemporalConfig{}, Options{
+			Keyring: &models.Keyring{Keys: map[string][]byte{"1": []byte("short")}, Primary: "1"},
+		}); err == nil {
+			t.Error("expected error")
+		}
+	})
 	t.Run("with migrations and logger", func(t *testing.T) {
 		db, err := New(&config.TemporalConfig{
 			Database: config.Database{
@@ -32,3 +40,53 @@ func TestNew(t *testing.T) {
 		db.Close()
 	})
 }
+
+func TestManager_RunMigrations(t *testing.T) {
+	dbm, err := New(&config.TemporalConfig{
+		Database: config.Database{
+			Name:     "temporal",
+			URL:      "127.0.0.1",
+			Port:     "5433",
+			Username: "postgres",
+			Password: "password123",
+		},
+	}, Options{RunMigrations: true, SSLModeDisable: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.Close()
+	var (
+		um = models.NewUserManager(dbm.DB)
+		rm = models.NewRoleManager(dbm.DB)
+	)
+	user, err := um.NewUserAccount("migrationadmin", "password123", "migrationadmin@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbm.DB.Unscoped().Delete(user)
+	defer dbm.DB.Unscoped().Where("user_name = ?", "migrationadmin").Delete(&models.Usage{})
+	defer dbm.DB.Unscoped().Where("user_name = ?", "migrationadmin").Delete(&models.UserRole{})
+	if err := dbm.DB.Model(user).Update("admin_access", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := dbm.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := rm.HasRole("migrationadmin", models.AdminRole); err != nil {
+		t.Fatal(err)
+	} else if !has {
+		t.Fatal("legacy admin should be assigned the admin role")
+	}
+	if err := rm.RevokeRole("migrationadmin", models.AdminRole, "adminuser"); err != nil {
+		t.Fatal(err)
+	}
+	// restarting must not grant the revoked admin access again
+	if err := dbm.RunMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := rm.HasRole("migrationadmin", models.AdminRole); err != nil {
+		t.Fatal(err)
+	} else if has {
+		t.Fatal("revoked admin should not be assigned the admin role again")
+	}
+}
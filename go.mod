@@ -8,6 +8,7 @@ require (
 	github.com/c2h5oh/datasize v0.0.0-20171227191756-4eba002a5eae
 	github.com/ipfs/go-ipfs-addr v0.0.1
 	github.com/jinzhu/gorm v1.9.8
+	github.com/jinzhu/inflection v0.0.0-20180308033659-04140366298a
 	github.com/lib/pq v1.3.0
 	github.com/mattn/go-isatty v0.0.7 // indirect
 	github.com/mr-tron/base58 v1.1.1 // indirect
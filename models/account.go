@@ -0,0 +1,512 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+// AccountDeletionMode controls how DeleteAccount removes a user's data
+type AccountDeletionMode string
+
+var (
+	// DeleteAnonymise removes personal data, but keeps payment, usage and upload
+	// records for accounting purposes under an anonymous user name
+	DeleteAnonymise AccountDeletionMode = "anonymise"
+	// DeleteErase removes every record associated with the user
+	DeleteErase AccountDeletionMode = "erase"
+)
+
+const (
+	// ErrOutstandingCredits is an error triggered when deleting an account
+	// that still has unused credits, which must be refunded first
+	ErrOutstandingCredits = "account has outstanding credits"
+	// ErrOutstandingOrgBalance is an error triggered when deleting an account
+	// that owns or belongs to an organization with an unpaid balance
+	ErrOutstandingOrgBalance = "account organization has an outstanding balance"
+	// ErrUnsettledNetworkCharges is an error triggered when deleting an
+	// account that still has to pay for hosted network usage
+	ErrUnsettledNetworkCharges = "account has unsettled network charges"
+	// ErrSoleNetworkOwner is an error triggered when deleting an account that
+	// is the only owner of a hosted network, which must be handed over first
+	ErrSoleNetworkOwner = "account is the only owner of a hosted network"
+)
+
+// auditPersonalFields are the fields of audit snapshots holding personal
+// data, which are removed when the account they belong to is deleted
+var auditPersonalFields = map[string]bool{
+	"email_address":        true,
+	"customer_object_hash": true,
+	"reason":               true,
+}
+
+// auditIdentityFields are the fields of audit snapshots naming users, which
+// are anonymised when the user is deleted. Fields that may also name an
+// organization give the field holding their type, and the type naming a user.
+var auditIdentityFields = map[string]struct{ typeField, userType string }{
+	"user_name":     {},
+	"owner":         {},
+	"users":         {},
+	"account_owner": {},
+	"publisher":     {},
+	"granted_by":    {},
+	"revoked_by":    {},
+	"reinstated_by": {},
+	"cascaded_from": {},
+	"grantee":       {"grantee_type", GranteeUser},
+	"payer":         {"payer_type", PayerUser},
+}
+
+// UserDataExport is every record associated with a user, as returned by
+// ExportUserData. Password hashes, secrets and token hashes are omitted,
+// and recovery codes are only counted.
+type UserDataExport struct {
+	ExportedAt       time.Time
+	User             User
+	Usage            []Usage
+	Uploads          []Upload
+	EncryptedUploads []EncryptedUpload
+	IPNS             []IPNS
+	IPNSRevisions    []IPNSRevision
+	Zones            []Zone
+	Records          []Record
+	Payments         []Payments
+	Organizations    []Organization
+	Roles            []UserRole
+	Sessions         []Session
+	Tokens           []UserToken
+	LoginAttempts    []LoginAttempt
+	EmailHistory     []EmailHistory
+	IPFSKeys         []IPFSKey
+	KeyGrants        []KeyGrant
+	NetworkMembers   []NetworkMember
+	NetworkCharges   []NetworkCharge
+	ResourceQuotas   []ResourceQuota
+	Suspensions      []AccountSuspension
+	AuditEvents      []AuditEvent
+	// RecoveryCodesUnused and RecoveryCodesUsed count the user's recovery codes
+	RecoveryCodesUnused int
+	RecoveryCodesUsed   int
+}
+
+// ExportUserData is used to generate a JSON archive of every record
+// associated with a user, for data portability requests
+func (um *UserManager) ExportUserData(username string) ([]byte, error) {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	// never hand out credentials, even hashed
+	user.HashedPassword = ""
+	user.EmailVerificationToken = ""
+	user.TOTPSecret = ""
+	export := &UserDataExport{
+		ExportedAt: time.Now(),
+		User:       *user,
+	}
+	for _, dest := range []interface{}{
+		&export.Usage,
+		&export.Uploads,
+		&export.EncryptedUploads,
+		&export.IPNS,
+		&export.Zones,
+		&export.Records,
+		&export.Payments,
+		&export.Roles,
+		&export.Sessions,
+		&export.Tokens,
+		&export.LoginAttempts,
+		&export.EmailHistory,
+		&export.IPFSKeys,
+		&export.NetworkMembers,
+		&export.Suspensions,
+	} {
+		if err := um.DB.Where("user_name = ?", username).Find(dest).Error; err != nil {
+			return nil, err
+		}
+	}
+	// grants of the user's keys to others, and of other keys to the user
+	if err := um.DB.Where(
+		"(grantee_type = ? AND grantee = ?) OR key_id IN (?)", GranteeUser, username,
+		um.DB.Model(&IPFSKey{}).Select("id").Where("user_name = ?", username).SubQuery(),
+	).Find(&export.KeyGrants).Error; err != nil {
+		return nil, err
+	}
+	for i := range export.Sessions {
+		export.Sessions[i].RefreshTokenHash = ""
+	}
+	for i := range export.Tokens {
+		export.Tokens[i].TokenHash = ""
+	}
+	if err := um.DB.Where("publisher = ?", username).Order(
+		"ip_ns_hash asc, network_name asc, sequence asc",
+	).Find(&export.IPNSRevisions).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Where(
+		"payer_type = ? AND payer = ?", PayerUser, username,
+	).Order("period_start asc").Find(&export.NetworkCharges).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Where(
+		"owner_type = ? AND owner = ?", QuotaUser, username,
+	).Find(&export.ResourceQuotas).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Model(&RecoveryCode{}).Where(
+		"user_name = ? AND used_at IS NULL", username,
+	).Count(&export.RecoveryCodesUnused).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Model(&RecoveryCode{}).Where(
+		"user_name = ? AND used_at IS NOT NULL", username,
+	).Count(&export.RecoveryCodesUsed).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Where(
+		"account_owner = ? OR name = ?", username, user.Organization,
+	).Find(&export.Organizations).Error; err != nil {
+		return nil, err
+	}
+	if err := um.DB.Where(
+		"(subject_type = ? AND subject = ?) OR actor = ?", AuditSubjectUser, username, username,
+	).Order("created_at asc, id asc").Find(&export.AuditEvents).Error; err != nil {
+		return nil, err
+	}
+	// changes the user made to anything else may hold data belonging to
+	// others, so only the fact that they were made is exported
+	for i := range export.AuditEvents {
+		event := &export.AuditEvents[i]
+		if event.SubjectType == AuditSubjectUser && event.Subject == username {
+			continue
+		}
+		if event.SubjectType == AuditSubjectUser {
+			event.Subject = ""
+		}
+		event.Before, event.After = "", ""
+	}
+	return json.Marshal(export)
+}
+
+// DeleteAccount is used to close a user account. Accounts with unused
+// credits, whose organization owes money, with unsettled network charges or
+// that are the only owner of a hosted network can't be deleted.
+//
+// With DeleteAnonymise the user, payment, usage and upload records are
+// kept under a randomly generated user name with personal data scrubbed,
+// and everything else is removed. With DeleteErase every record is removed,
+// and organizations owned by the user are deleted provided they have no
+// other registered users. In both modes the user loses access to hosted
+// networks and organizations they are a member of.
+//
+// In both modes the audit log is kept, with the user's name replaced by the
+// anonymous name and personal fields removed from the recorded values, and a
+// single event recording the deletion is added under the anonymous name.
+// IPFS keys held in the keystore, and content pinned on the user's behalf,
+// must be removed separately.
+func (um *UserManager) DeleteAccount(username string, mode AccountDeletionMode) error {
+	if mode != DeleteAnonymise && mode != DeleteErase {
+		return errors.New("unsupported account deletion mode")
+	}
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	if user.Credits > 0 {
+		return errors.New(ErrOutstandingCredits)
+	}
+	var orgs []Organization
+	if err := um.DB.Where(
+		"account_owner = ? OR name = ?", username, user.Organization,
+	).Find(&orgs).Error; err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		if org.AmountOwed > 0 {
+			return errors.New(ErrOutstandingOrgBalance)
+		}
+	}
+	var unsettled int
+	if err := um.DB.Model(&NetworkCharge{}).Where(
+		"payer_type = ? AND payer = ? AND settled_at IS NULL", PayerUser, username,
+	).Count(&unsettled).Error; err != nil {
+		return err
+	}
+	if unsettled > 0 {
+		return errors.New(ErrUnsettledNetworkCharges)
+	}
+	var soleOwned int
+	if err := um.DB.Model(&NetworkMember{}).Where(
+		"user_name = ? AND role = ? AND network_name NOT IN (?)", username, NetworkRoleOwner,
+		um.DB.Model(&NetworkMember{}).Select("network_name").Where(
+			"user_name <> ? AND role = ?", username, NetworkRoleOwner,
+		).SubQuery(),
+	).Count(&soleOwned).Error; err != nil {
+		return err
+	}
+	if soleOwned > 0 {
+		return errors.New(ErrSoleNetworkOwner)
+	}
+	token, err := utils.GenerateSecureToken(8)
+	if err != nil {
+		return err
+	}
+	anonName := "deleted-" + token
+
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := deleteAccountRecords(tx, user, anonName, mode, orgs); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserDeleted, AuditSubjectUser, anonName,
+			nil, map[string]interface{}{"mode": mode},
+		)
+	})
+}
+
+// deleteAccountRecords removes or anonymises every record of a user within tx
+func deleteAccountRecords(tx *gorm.DB, user *User, anonName string, mode AccountDeletionMode, orgs []Organization) error {
+	username := user.UserName
+	// grants must be removed before the keys they refer to
+	if err := tx.Unscoped().Where(
+		"(grantee_type = ? AND grantee = ?) OR key_id IN (?)", GranteeUser, username,
+		tx.Model(&IPFSKey{}).Select("id").Where("user_name = ?", username).SubQuery(),
+	).Delete(&KeyGrant{}).Error; err != nil {
+		return err
+	}
+	// revisions of the user's records, and the user's part in the history of shared records
+	if err := tx.Unscoped().Where(
+		"(ip_ns_hash, network_name) IN (?)",
+		tx.Unscoped().Model(&IPNS{}).Select("ip_ns_hash, network_name").Where("user_name = ?", username).SubQuery(),
+	).Delete(&IPNSRevision{}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&IPNSRevision{}).Where(
+		"publisher = ?", username,
+	).UpdateColumn("publisher", anonName).Error; err != nil {
+		return err
+	}
+	// records that never need to be retained
+	for _, model := range []interface{}{
+		&EncryptedUpload{},
+		&IPNS{},
+		&Zone{},
+		&Record{},
+		&Session{},
+		&UserToken{},
+		&LoginAttempt{},
+		&RecoveryCode{},
+		&PasswordHistory{},
+		&UserRole{},
+		&EmailHistory{},
+		&AccountSuspension{},
+		&IPFSKey{},
+		&NetworkMember{},
+	} {
+		if err := tx.Unscoped().Where("user_name = ?", username).Delete(model).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Where(
+		"owner_type = ? AND owner = ?", QuotaUser, username,
+	).Delete(&ResourceQuota{}).Error; err != nil {
+		return err
+	}
+	// charges are part of the network's history, and are all settled by now
+	if err := tx.Unscoped().Model(&NetworkCharge{}).Where(
+		"payer_type = ? AND payer = ?", PayerUser, username,
+	).UpdateColumn("payer", anonName).Error; err != nil {
+		return err
+	}
+	if err := scrubAuditEvents(tx, username, anonName); err != nil {
+		return err
+	}
+
+	if mode == DeleteErase {
+		for _, model := range []interface{}{&Payments{}, &Usage{}, &Upload{}} {
+			if err := tx.Unscoped().Where("user_name = ?", username).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		for _, org := range orgs {
+			if org.AccountOwner != username {
+				continue
+			}
+			for _, member := range org.RegisteredUsers {
+				if member != username {
+					return errors.New("organization still has registered users")
+				}
+			}
+			if err := tx.Unscoped().Delete(&org).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(&Organization{}).Where("? = ANY(registered_users)", username).UpdateColumn(
+			"registered_users", gorm.Expr("array_remove(registered_users, ?)", username),
+		).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(user).Error
+	}
+
+	// keep accounting records under the anonymous name
+	for _, model := range []interface{}{&Payments{}, &Usage{}} {
+		if err := tx.Unscoped().Model(model).Where("user_name = ?", username).UpdateColumn(
+			"user_name", anonName,
+		).Error; err != nil {
+			return err
+		}
+	}
+	if err := tx.Unscoped().Model(&Upload{}).Where("user_name = ?", username).UpdateColumns(map[string]interface{}{
+		"user_name":            anonName,
+		"file_name":            "",
+		"file_name_lower_case": "",
+		"file_name_upper_case": "",
+		"extension":            "",
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Organization{}).Where("account_owner = ?", username).UpdateColumn(
+		"account_owner", anonName,
+	).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&Organization{}).Where("? = ANY(registered_users)", username).UpdateColumn(
+		"registered_users", gorm.Expr("array_replace(registered_users, ?, ?)", username, anonName),
+	).Error; err != nil {
+		return err
+	}
+	// scrub the user itself, soft deleting it so it can no longer be found
+	if err := tx.Model(user).UpdateColumns(map[string]interface{}{
+		"user_name":                anonName,
+		"email_address":            anonName,
+		"pending_email_address":    "",
+		"account_enabled":          false,
+		"email_enabled":            false,
+		"email_verification_token": "",
+		"hashed_password":          "",
+		"customer_object_hash":     "",
+		"ipfs_key_names":           gorm.Expr("'{}'"),
+		"ipfs_key_ids":             gorm.Expr("'{}'"),
+		"ipfs_network_names":       gorm.Expr("'{}'"),
+		"totp_secret":              "",
+		"totp_enabled":             false,
+		"totp_last_step":           0,
+		"locked_until":             nil,
+		"failed_logins_reset_at":   nil,
+		"suspension_reason":        "",
+		"suspension_reinstate_at":  nil,
+	}).Error; err != nil {
+		return err
+	}
+	return tx.Delete(user).Error
+}
+
+// likeEscaper escapes the wildcards of LIKE patterns
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// scrubAuditEvents replaces a deleted user's name with anonName in every
+// audit event recording them, and removes personal fields from the recorded
+// values. Other values, such as credit changes, are kept as they were.
+func scrubAuditEvents(tx *gorm.DB, username, anonName string) error {
+	mention := "%" + likeEscaper.Replace(strconv.Quote(username)) + "%"
+	var events []AuditEvent
+	if err := tx.Where(
+		`(subject_type = ? AND subject = ?) OR actor = ? OR "before" LIKE ? OR "after" LIKE ?`,
+		AuditSubjectUser, username, username, mention, mention,
+	).Find(&events).Error; err != nil {
+		return err
+	}
+	for _, event := range events {
+		if event.Actor == username {
+			event.Actor = anonName
+		}
+		// personal data is only removed from events about the user
+		personal := event.SubjectType == AuditSubjectUser && event.Subject == username
+		if personal {
+			event.Subject = anonName
+		}
+		var err error
+		if event.Before, err = scrubAuditValue(event.Before, username, anonName, personal); err != nil {
+			return err
+		}
+		if event.After, err = scrubAuditValue(event.After, username, anonName, personal); err != nil {
+			return err
+		}
+		if err := tx.Model(&event).UpdateColumns(map[string]interface{}{
+			"actor":   event.Actor,
+			"subject": event.Subject,
+			"before":  event.Before,
+			"after":   event.After,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrubAuditValue replaces username with anonName in the fields of an
+// encoded audit snapshot identifying users, and removes personal fields if
+// personal is set
+func scrubAuditValue(encoded, username, anonName string, personal bool) (string, error) {
+	if encoded == "" {
+		return "", nil
+	}
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(encoded)))
+	// keep numbers such as credit amounts exactly as they were recorded
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	out, err := json.Marshal(scrubAuditFields(v, username, anonName, personal))
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func scrubAuditFields(v interface{}, username, anonName string, personal bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if personal && auditPersonalFields[k] {
+				delete(v, k)
+				continue
+			}
+			if identity, ok := auditIdentityFields[k]; ok {
+				if identity.typeField == "" || v[identity.typeField] == identity.userType {
+					v[k] = scrubAuditIdentity(field, username, anonName)
+				}
+				continue
+			}
+			v[k] = scrubAuditFields(field, username, anonName, personal)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = scrubAuditFields(v[i], username, anonName, personal)
+		}
+	}
+	return v
+}
+
+// scrubAuditIdentity replaces username with anonName in the value of an
+// identity field, which is either a single name or a list of names
+func scrubAuditIdentity(v interface{}, username, anonName string) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = scrubAuditIdentity(v[i], username, anonName)
+		}
+	case string:
+		if v == username {
+			return anonName
+		}
+	}
+	return v
+}
@@ -0,0 +1,241 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAccountTestDB(t *testing.T) *UserManager {
+	db := newTestDB(t, &User{})
+	for _, model := range []interface{}{
+		Usage{}, Upload{}, EncryptedUpload{}, IPNS{}, IPNSRevision{}, Zone{}, Record{},
+		Payments{}, Organization{}, HostedNetwork{}, Session{}, UserToken{},
+		LoginAttempt{}, RecoveryCode{}, PasswordHistory{}, UserRole{}, EmailHistory{},
+		AccountSuspension{}, IPFSKey{}, KeyGrant{}, NetworkMember{}, ResourceQuota{},
+		NetworkCharge{},
+	} {
+		db.AutoMigrate(model)
+	}
+	return NewUserManager(db)
+}
+
+func TestUserManager_ExportUserData(t *testing.T) {
+	um := newAccountTestDB(t)
+	defer um.DB.Close()
+	user, err := um.NewUserAccount("exportuser", "password123", "exportuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "exportuser").Delete(&Usage{})
+	defer um.DB.Unscoped().Where("user_name = ?", "exportuser").Delete(&UserToken{})
+	defer um.DB.Unscoped().Where("user_name = ?", "exportuser").Delete(&RecoveryCode{})
+	if _, err := um.GeneratePasswordResetToken("exportuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.GenerateRecoveryCodes("exportuser"); err != nil {
+		t.Fatal(err)
+	}
+	// changes the user made to another user are exported without their details
+	if err := recordAudit(WithActor(um.DB, "exportuser"), AuditUserSuspended, AuditSubjectUser, "exportother",
+		nil, map[string]interface{}{"reason": "exportother@example.org"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Where("actor = ?", "exportuser").Delete(&AuditEvent{})
+	data, err := um.ExportUserData("exportuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export UserDataExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.User.UserName != "exportuser" {
+		t.Fatalf("unexpected user %s", export.User.UserName)
+	}
+	if export.User.HashedPassword != "" {
+		t.Fatal("password hash should not be exported")
+	}
+	if len(export.Usage) != 1 {
+		t.Fatalf("expected 1 usage entry, got %v", len(export.Usage))
+	}
+	if len(export.Tokens) != 1 || export.Tokens[0].TokenHash != "" {
+		t.Fatalf("unexpected tokens %+v", export.Tokens)
+	}
+	if export.RecoveryCodesUnused != RecoveryCodeCount || export.RecoveryCodesUsed != 0 {
+		t.Fatalf("unexpected recovery code counts %v/%v", export.RecoveryCodesUnused, export.RecoveryCodesUsed)
+	}
+	var redacted bool
+	for _, event := range export.AuditEvents {
+		if event.Actor == "exportuser" && event.Action == AuditUserSuspended {
+			if event.Subject != "" || event.After != "" {
+				t.Fatalf("another user's data should not be exported %+v", event)
+			}
+			redacted = true
+		}
+	}
+	if !redacted {
+		t.Fatal("changes made by the user should be exported")
+	}
+	if _, err := um.ExportUserData("notarealuser"); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestUserManager_DeleteAccount(t *testing.T) {
+	type args struct {
+		username string
+		mode     AccountDeletionMode
+	}
+	tests := []struct {
+		name string
+		args args
+	}{
+		{"Anonymise", args{"deleteanonuser", DeleteAnonymise}},
+		{"Erase", args{"deleteeraseuser", DeleteErase}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := newAccountTestDB(t)
+			defer um.DB.Close()
+			user, err := um.NewUserAccount(tt.args.username, "password123", tt.args.username+"@example.org")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer um.DB.Unscoped().Delete(user)
+			payment, err := NewPaymentManager(um.DB).NewPayment(
+				1, "0x0", tt.args.username+"-tx", 10, 10, "eth", "eth", tt.args.username,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer um.DB.Unscoped().Delete(payment)
+			// credits must be used or refunded before deletion
+			if _, err := um.AddCredits(tt.args.username, 10); err != nil {
+				t.Fatal(err)
+			}
+			if err := um.DeleteAccount(tt.args.username, tt.args.mode); err == nil {
+				t.Fatal("error expected")
+			} else if err.Error() != ErrOutstandingCredits {
+				t.Fatal(err)
+			}
+			if _, err := um.RemoveCredits(tt.args.username, 10); err != nil {
+				t.Fatal(err)
+			}
+			// network usage must be paid for before deletion
+			charge := &NetworkCharge{
+				NetworkName: tt.args.username + "-network",
+				PayerType:   PayerUser,
+				Payer:       tt.args.username,
+			}
+			if err := um.DB.Create(charge).Error; err != nil {
+				t.Fatal(err)
+			}
+			defer um.DB.Unscoped().Delete(charge)
+			if err := um.DeleteAccount(tt.args.username, tt.args.mode); err == nil ||
+				err.Error() != ErrUnsettledNetworkCharges {
+				t.Fatalf("expected unsettled charges error, got %v", err)
+			}
+			if err := um.DB.Model(charge).UpdateColumn("settled_at", time.Now()).Error; err != nil {
+				t.Fatal(err)
+			}
+			// networks the user is the only owner of must be handed over first
+			member := &NetworkMember{
+				NetworkName: tt.args.username + "-network",
+				UserName:    tt.args.username,
+				Role:        NetworkRoleOwner,
+			}
+			if err := um.DB.Create(member).Error; err != nil {
+				t.Fatal(err)
+			}
+			defer um.DB.Unscoped().Delete(member)
+			if err := um.DeleteAccount(tt.args.username, tt.args.mode); err == nil ||
+				err.Error() != ErrSoleNetworkOwner {
+				t.Fatalf("expected sole owner error, got %v", err)
+			}
+			coOwner := &NetworkMember{
+				NetworkName: tt.args.username + "-network",
+				UserName:    tt.args.username + "-coowner",
+				Role:        NetworkRoleOwner,
+			}
+			if err := um.DB.Create(coOwner).Error; err != nil {
+				t.Fatal(err)
+			}
+			defer um.DB.Unscoped().Delete(coOwner)
+			if err := um.DeleteAccount(tt.args.username, tt.args.mode); err != nil {
+				t.Fatal(err)
+			}
+			// the audit log is kept, without personal data but with credit changes
+			var events []AuditEvent
+			if err := um.DB.Where(
+				"action = ? AND subject_type = ?", AuditUserCreditsChanged, AuditSubjectUser,
+			).Where(`"after" = ? AND subject LIKE ?`, `{"credits":10}`, "deleted-%").Find(&events).Error; err != nil {
+				t.Fatal(err)
+			} else if len(events) == 0 {
+				t.Fatal("credit changes should be kept in the audit log")
+			}
+			defer um.DB.Unscoped().Where("subject = ?", events[0].Subject).Delete(&AuditEvent{})
+			if events, err := NewAuditManager(um.DB).FindBySubject(AuditSubjectUser, events[0].Subject); err != nil {
+				t.Fatal(err)
+			} else {
+				for _, event := range events {
+					if strings.Contains(event.After, "@example.org") {
+						t.Fatalf("personal data should be scrubbed from %+v", event)
+					}
+				}
+			}
+			if _, err := um.FindByUserName(tt.args.username); err == nil {
+				t.Fatal("user should no longer be found")
+			}
+			if _, err := NewUsageManager(um.DB).FindByUserName(tt.args.username); err == nil {
+				t.Fatal("usage should no longer be found by user name")
+			}
+			var p Payments
+			err = um.DB.Unscoped().Where("id = ?", payment.ID).First(&p).Error
+			switch tt.args.mode {
+			case DeleteAnonymise:
+				if err != nil {
+					t.Fatal("payment should be retained", err)
+				}
+				if p.UserName == tt.args.username {
+					t.Fatal("payment should be anonymised")
+				}
+				defer um.DB.Unscoped().Where("user_name = ?", p.UserName).Delete(&Usage{})
+			case DeleteErase:
+				if err == nil {
+					t.Fatal("payment should be removed")
+				}
+			}
+		})
+	}
+}
+
+func Test_scrubAuditValue(t *testing.T) {
+	tests := []struct {
+		name, encoded, want string
+		personal            bool
+	}{
+		{"Empty", "", "", true},
+		{"Personal", `{"email_address":"scrub@example.org"}`, `{}`, true},
+		{"Others", `{"email_address":"other@example.org"}`, `{"email_address":"other@example.org"}`, false},
+		{"Credits", `{"credits":10.5}`, `{"credits":10.5}`, true},
+		{"Identity", `{"owner":"scrubuser","users":["scrubuser","other"]}`, `{"owner":"deleted-1","users":["deleted-1","other"]}`, false},
+		{"Grantee", `{"grantee":"scrubuser","grantee_type":"user"}`, `{"grantee":"deleted-1","grantee_type":"user"}`, false},
+		{"Organization", `{"grantee":"scrubuser","grantee_type":"organization"}`, `{"grantee":"scrubuser","grantee_type":"organization"}`, false},
+		{"Unrelated", `{"role":"scrubuser","zone_name":"scrubuser"}`, `{"role":"scrubuser","zone_name":"scrubuser"}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scrubAuditValue(tt.encoded, "scrubuser", "deleted-1", tt.personal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("scrubAuditValue() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// actorKey is the gorm setting used to carry the actor performing changes
+const actorKey = "temporal:audit_actor"
+
+const (
+	// AuditSubjectUser is the subject type for changes to a user account,
+	// including its usage, credits, keys, networks and payments
+	AuditSubjectUser = "user"
+	// AuditSubjectOrganization is the subject type for changes to an organization
+	AuditSubjectOrganization = "organization"
+	// AuditSubjectNetwork is the subject type for changes to a hosted network
+	AuditSubjectNetwork = "network"
+	// AuditSubjectRole is the subject type for changes to a role
+	AuditSubjectRole = "role"
+	// AuditSubjectIPNS is the subject type for changes to an IPNS record
+	AuditSubjectIPNS = "ipns"
+	// AuditSubjectZone is the subject type for changes to a TNS zone
+	AuditSubjectZone = "zone"
+	// AuditSubjectRecord is the subject type for changes to a TNS record
+	AuditSubjectRecord = "record"
+	// AuditSubjectUpload is the subject type for changes to an upload, identified by its hash
+	AuditSubjectUpload = "upload"
+)
+
+const (
+	// AuditUserCreated is recorded when a user account is created
+	AuditUserCreated = "user.created"
+	// AuditUserNetworkAdded is recorded when a user is given access to a network
+	AuditUserNetworkAdded = "user.network_added"
+	// AuditUserNetworkRemoved is recorded when a user's network access is removed
+	AuditUserNetworkRemoved = "user.network_removed"
+	// AuditUserKeyAdded is recorded when a key is added to a user
+	AuditUserKeyAdded = "user.key_added"
+	// AuditUserKeyRemoved is recorded when a key is removed from a user
+	AuditUserKeyRemoved = "user.key_removed"
+	// AuditUserKeyGranted is recorded when a user shares a key
+	AuditUserKeyGranted = "user.key_granted"
+	// AuditUserKeyGrantRevoked is recorded when a user stops sharing a key
+	AuditUserKeyGrantRevoked = "user.key_grant_revoked"
+	// AuditUserPasswordChanged is recorded when a user changes their password
+	AuditUserPasswordChanged = "user.password_changed"
+	// AuditUserPasswordReset is recorded when a user's password is reset
+	AuditUserPasswordReset = "user.password_reset"
+	// AuditUserEmailVerified is recorded when a user verifies their email address
+	AuditUserEmailVerified = "user.email_verified"
+	// AuditUserEmailChangeRequested is recorded when a user requests a change of email address
+	AuditUserEmailChangeRequested = "user.email_change_requested"
+	// AuditUserEmailChanged is recorded when a user confirms a change of email address
+	AuditUserEmailChanged = "user.email_changed"
+	// AuditUserEmailChangeCancelled is recorded when a pending change of email address is abandoned
+	AuditUserEmailChangeCancelled = "user.email_change_cancelled"
+	// AuditUserCreditsChanged is recorded when a user's credit balance changes
+	AuditUserCreditsChanged = "user.credits_changed"
+	// AuditUserAdminToggled is recorded when a user's admin access is toggled
+	AuditUserAdminToggled = "user.admin_toggled"
+	// AuditUserCustomerObjectChanged is recorded when a user's customer object hash changes
+	AuditUserCustomerObjectChanged = "user.customer_object_changed"
+	// AuditUserLocked is recorded when an account is locked due to failed sign-ins
+	AuditUserLocked = "user.locked"
+	// AuditUserUnlocked is recorded when a locked account is unlocked
+	AuditUserUnlocked = "user.unlocked"
+	// AuditUserTwoFactorEnabled is recorded when a user enables two-factor authentication
+	AuditUserTwoFactorEnabled = "user.two_factor_enabled"
+	// AuditUserTwoFactorDisabled is recorded when a user disables two-factor authentication
+	AuditUserTwoFactorDisabled = "user.two_factor_disabled"
+	// AuditUserRecoveryCodesGenerated is recorded when a user's recovery codes are replaced
+	AuditUserRecoveryCodesGenerated = "user.recovery_codes_generated"
+	// AuditUserSessionsRevoked is recorded when all of a user's sessions are revoked
+	AuditUserSessionsRevoked = "user.sessions_revoked"
+	// AuditUserSuspended is recorded when an account is suspended
+	AuditUserSuspended = "user.suspended"
+	// AuditUserReinstated is recorded when a suspended account is reinstated
+	AuditUserReinstated = "user.reinstated"
+	// AuditUserDeleted is recorded under an anonymous name when an account is deleted
+	AuditUserDeleted = "user.deleted"
+	// AuditUsageCreated is recorded when a usage entry is created for a user
+	AuditUsageCreated = "usage.created"
+	// AuditUsageTierChanged is recorded when a user's tier changes
+	AuditUsageTierChanged = "usage.tier_changed"
+	// AuditUsageCountsReset is recorded when a user's monthly counters are reset
+	AuditUsageCountsReset = "usage.counts_reset"
+	// AuditUsageKeyCountChanged is recorded when a user's key count changes
+	AuditUsageKeyCountChanged = "usage.key_count_changed"
+	// AuditUsageENSChanged is recorded when a user claims or unclaims their ens name
+	AuditUsageENSChanged = "usage.ens_changed"
+	// AuditPaymentCreated is recorded when a payment is created
+	AuditPaymentCreated = "payment.created"
+	// AuditPaymentConfirmed is recorded when a payment is confirmed
+	AuditPaymentConfirmed = "payment.confirmed"
+	// AuditPaymentTxHashChanged is recorded when the tx hash of a payment changes
+	AuditPaymentTxHashChanged = "payment.tx_hash_changed"
+	// AuditOrgCreated is recorded when an organization is created
+	AuditOrgCreated = "organization.created"
+	// AuditOrgUserRegistered is recorded when a user is registered under an organization
+	AuditOrgUserRegistered = "organization.user_registered"
+	// AuditOrgAmountOwedChanged is recorded when the amount owed by an organization changes
+	AuditOrgAmountOwedChanged = "organization.amount_owed_changed"
+	// AuditNetworkCreated is recorded when a hosted network is created
+	AuditNetworkCreated = "network.created"
+	// AuditNetworkUpdated is recorded when a hosted network is updated
+	AuditNetworkUpdated = "network.updated"
+	// AuditNetworkDeleted is recorded when a hosted network is deleted
+	AuditNetworkDeleted = "network.deleted"
+	// AuditNetworkStateChanged is recorded when a hosted network changes lifecycle state
+	AuditNetworkStateChanged = "network.state_changed"
+	// AuditNetworkNodeAdded is recorded when a node is added to a hosted network
+	AuditNetworkNodeAdded = "network.node_added"
+	// AuditNetworkNodeRemoved is recorded when a node is removed from a hosted network
+	AuditNetworkNodeRemoved = "network.node_removed"
+	// AuditNetworkSwarmKeyRotated is recorded when the swarm key of a hosted network is rotated
+	AuditNetworkSwarmKeyRotated = "network.swarm_key_rotated"
+	// AuditNetworkCharged is recorded when a charge for a hosted network is paid
+	AuditNetworkCharged = "network.charged"
+	// AuditNetworkChargeUncollectable is recorded when a charge for a hosted network can't be paid because its payer was deleted
+	AuditNetworkChargeUncollectable = "network.charge_uncollectable"
+	// AuditResourceQuotaChanged is recorded when the network resource quota of a user or organization changes
+	AuditResourceQuotaChanged = "quota.changed"
+	// AuditIPNSRecordCreated is recorded when an IPNS record is created
+	AuditIPNSRecordCreated = "ipns.created"
+	// AuditIPNSRecordUpdated is recorded when an IPNS record is published with a new value
+	AuditIPNSRecordUpdated = "ipns.updated"
+	// AuditIPNSRecordTransferred is recorded when an IPNS record is handed over to another user
+	AuditIPNSRecordTransferred = "ipns.transferred"
+	// AuditIPNSRecordDeleted is recorded when an IPNS record is deleted
+	AuditIPNSRecordDeleted = "ipns.deleted"
+	// AuditZoneCreated is recorded when a TNS zone is created
+	AuditZoneCreated = "zone.created"
+	// AuditZoneUpdated is recorded when the latest IPFS hash of a TNS zone changes
+	AuditZoneUpdated = "zone.updated"
+	// AuditZoneRecordAdded is recorded when a record is added to a TNS zone
+	AuditZoneRecordAdded = "zone.record_added"
+	// AuditRecordCreated is recorded when a TNS record is created
+	AuditRecordCreated = "record.created"
+	// AuditRecordUpdated is recorded when the latest IPFS hash of a TNS record changes
+	AuditRecordUpdated = "record.updated"
+	// AuditUploadCreated is recorded when content is uploaded or pinned
+	AuditUploadCreated = "upload.created"
+	// AuditUploadUpdated is recorded when the hold time of an upload changes
+	AuditUploadUpdated = "upload.updated"
+	// AuditUploadRemoved is recorded when a pin is removed
+	AuditUploadRemoved = "upload.removed"
+	// AuditRoleCreated is recorded when a role is created
+	AuditRoleCreated = "role.created"
+	// AuditRoleUpdated is recorded when the permissions of a role change
+	AuditRoleUpdated = "role.updated"
+	// AuditRoleDeleted is recorded when a role is deleted
+	AuditRoleDeleted = "role.deleted"
+	// AuditRoleAssigned is recorded when a role is assigned to a user
+	AuditRoleAssigned = "role.assigned"
+	// AuditRoleRevoked is recorded when a role is revoked from a user
+	AuditRoleRevoked = "role.revoked"
+)
+
+// AuditEvent is an append-only record of a change made through one of the
+// model managers. Before and After hold JSON encoded snapshots of the
+// values that changed, with secrets omitted. Events are written in the same
+// transaction as the change they record.
+//
+// High volume metering operations such as data, pubsub and IPNS usage
+// counters, IPNS republishes and network billing runs are not audited.
+type AuditEvent struct {
+	ID          uint `gorm:"primary_key"`
+	CreatedAt   time.Time
+	Actor       string `gorm:"type:varchar(255);index"`
+	Action      string `gorm:"type:varchar(255)"`
+	SubjectType string `gorm:"type:varchar(255)"`
+	Subject     string `gorm:"type:varchar(255);index"`
+	Before      string `gorm:"type:text"`
+	After       string `gorm:"type:text"`
+}
+
+// WithActor returns a database handle that attributes every change made
+// through it to the given actor. Managers created from the returned handle,
+// and any managers they use internally, record the actor in the audit log.
+//
+//	um := models.NewUserManager(models.WithActor(db, "adminuser"))
+func WithActor(db *gorm.DB, actor string) *gorm.DB {
+	return db.Set(actorKey, actor)
+}
+
+// ActorFrom returns the actor attached to a database handle with
+// WithActor, or SystemActor if there is none
+func ActorFrom(db *gorm.DB) string {
+	if actor, ok := db.Get(actorKey); ok {
+		if s, ok := actor.(string); ok && s != "" {
+			return s
+		}
+	}
+	return SystemActor
+}
+
+// AuditManager is used to query the audit log
+type AuditManager struct {
+	DB *gorm.DB
+}
+
+// NewAuditManager is used to generate our audit manager helper
+func NewAuditManager(db *gorm.DB) *AuditManager {
+	return &AuditManager{DB: db}
+}
+
+// AuditQuery is used to filter audit events, empty fields are ignored
+type AuditQuery struct {
+	Actor       string
+	Action      string
+	SubjectType string
+	Subject     string
+	Since       time.Time
+	Until       time.Time
+	// Limit restricts the number of events returned, 0 for no limit
+	Limit int
+}
+
+// Find is used to find audit events matching the query, most recent first
+func (am *AuditManager) Find(q AuditQuery) ([]AuditEvent, error) {
+	db := am.DB.Model(&AuditEvent{})
+	if q.Actor != "" {
+		db = db.Where("actor = ?", q.Actor)
+	}
+	if q.Action != "" {
+		db = db.Where("action = ?", q.Action)
+	}
+	if q.SubjectType != "" {
+		db = db.Where("subject_type = ?", q.SubjectType)
+	}
+	if q.Subject != "" {
+		db = db.Where("subject = ?", q.Subject)
+	}
+	if q.Since != nilTime {
+		db = db.Where("created_at >= ?", q.Since)
+	}
+	if q.Until != nilTime {
+		db = db.Where("created_at < ?", q.Until)
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	var events []AuditEvent
+	if err := db.Order("created_at desc, id desc").Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// FindByActor is used to find all changes made by an actor
+func (am *AuditManager) FindByActor(actor string) ([]AuditEvent, error) {
+	return am.Find(AuditQuery{Actor: actor})
+}
+
+// FindBySubject is used to find all changes made to a subject
+func (am *AuditManager) FindBySubject(subjectType, subject string) ([]AuditEvent, error) {
+	return am.Find(AuditQuery{SubjectType: subjectType, Subject: subject})
+}
+
+// FindByTime is used to find all changes made within the given time range
+func (am *AuditManager) FindByTime(since, until time.Time) ([]AuditEvent, error) {
+	return am.Find(AuditQuery{Since: since, Until: until})
+}
+
+// recordAudit is used by the model managers to append an event to the audit
+// log, attributing it to the actor attached to db
+func recordAudit(db *gorm.DB, action, subjectType, subject string, before, after interface{}) error {
+	event := &AuditEvent{
+		Actor:       ActorFrom(db),
+		Action:      action,
+		SubjectType: subjectType,
+		Subject:     subject,
+	}
+	var err error
+	if event.Before, err = encodeAuditValue(before); err != nil {
+		return err
+	}
+	if event.After, err = encodeAuditValue(after); err != nil {
+		return err
+	}
+	return db.Create(event).Error
+}
+
+// withTransaction runs change within a transaction, so that it is only
+// committed along with the audit events it records. If db is already part of
+// a transaction that transaction is used, so that managers can be composed.
+func withTransaction(db *gorm.DB, change func(tx *gorm.DB) error) error {
+	if _, ok := db.CommonDB().(*sql.Tx); ok {
+		return change(db)
+	}
+	tx := db.Begin()
+	if err := change(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
+func encodeAuditValue(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
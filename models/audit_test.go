@@ -0,0 +1,162 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestActorFrom(t *testing.T) {
+	db := newTestDB(t, nil)
+	defer db.Close()
+	if actor := ActorFrom(db); actor != SystemActor {
+		t.Fatalf("ActorFrom() = %s, want %s", actor, SystemActor)
+	}
+	if actor := ActorFrom(WithActor(db, "adminuser")); actor != "adminuser" {
+		t.Fatalf("ActorFrom() = %s, want %s", actor, "adminuser")
+	}
+	// the actor should be carried into transactions
+	tx := WithActor(db, "adminuser").Begin()
+	defer tx.Rollback()
+	if actor := ActorFrom(tx); actor != "adminuser" {
+		t.Fatalf("ActorFrom() = %s, want %s", actor, "adminuser")
+	}
+}
+
+func TestAuditManager(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(Usage{})
+	var (
+		start = time.Now().Add(-time.Second)
+		um    = NewUserManager(WithActor(db, "audit-admin"))
+		am    = NewAuditManager(db)
+	)
+	user, err := um.NewUserAccount("audituser", "password123", "audituser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer db.Unscoped().Where("user_name = ?", "audituser").Delete(&Usage{})
+	defer db.Unscoped().Where("subject = ?", "audituser").Delete(&AuditEvent{})
+	if _, err := um.AddCredits("audituser", 10); err != nil {
+		t.Fatal(err)
+	}
+	events, err := am.FindBySubject(AuditSubjectUser, "audituser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// account creation also creates a usage entry
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	// most recent first
+	if events[0].Action != AuditUserCreditsChanged {
+		t.Fatalf("unexpected action %s", events[0].Action)
+	}
+	if events[0].Actor != "audit-admin" {
+		t.Fatalf("unexpected actor %s", events[0].Actor)
+	}
+	if events[0].Before != `{"credits":0}` || events[0].After != `{"credits":10}` {
+		t.Fatalf("unexpected snapshots %s -> %s", events[0].Before, events[0].After)
+	}
+	if events[2].Action != AuditUserCreated {
+		t.Fatalf("unexpected action %s", events[2].Action)
+	}
+	if events, err := am.FindByActor("audit-admin"); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %v", len(events))
+	}
+	if events, err := am.FindByTime(start, time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if len(events) < 3 {
+		t.Fatalf("expected at least 3 events, got %v", len(events))
+	}
+	if events, err := am.Find(AuditQuery{
+		Subject: "audituser",
+		Action:  AuditUserCreditsChanged,
+		Limit:   1,
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %v", len(events))
+	}
+	// changes made without an actor are attributed to the system
+	if _, err := NewUserManager(db).RemoveCredits("audituser", 5); err != nil {
+		t.Fatal(err)
+	}
+	if events, err := am.Find(AuditQuery{Actor: SystemActor, Subject: "audituser"}); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 1 {
+		t.Fatalf("expected 1 event, got %v", len(events))
+	}
+}
+
+func TestAuditManager_Content(t *testing.T) {
+	db := newTestDB(t, &Zone{})
+	defer db.Close()
+	db.AutoMigrate(Record{})
+	db.AutoMigrate(Upload{})
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(IPFSKey{})
+	var (
+		adb = WithActor(db, "audit-content")
+		am  = NewAuditManager(db)
+	)
+	defer db.Unscoped().Where("actor = ?", "audit-content").Delete(&AuditEvent{})
+	defer newZoneTestUser(t, db, "auditcontent", "managerkey", "zonekey")()
+	zone, err := NewZoneManager(adb).NewZone("auditcontent", "auditzone", "managerkey", "zonekey", "QmZone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(zone)
+	if _, err := NewZoneManager(adb).UpdateLatestIPFSHashForZone("auditzone", "auditcontent", "QmZone2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewZoneManager(adb).AddRecordForZone("auditzone", "auditrecord", "auditcontent"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := NewRecordManager(adb).AddRecord("auditcontent", "auditrecord", "recordkey", "auditzone", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(record)
+	if _, err := NewRecordManager(adb).UpdateLatestIPFSHash("auditcontent", "auditrecord", "QmRecord"); err != nil {
+		t.Fatal(err)
+	}
+	upload, err := NewUploadManager(adb).NewUpload("QmAuditUpload", "file", UploadOptions{
+		NetworkName:      "public",
+		Username:         "auditcontent",
+		HoldTimeInMonths: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(upload)
+	if _, err := NewUploadManager(adb).UpdateUpload(2, "auditcontent", "QmAuditUpload", "public"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		subjectType, subject string
+		actions              []string
+	}{
+		{AuditSubjectZone, "auditzone", []string{AuditZoneRecordAdded, AuditZoneUpdated, AuditZoneCreated}},
+		{AuditSubjectRecord, "auditrecord", []string{AuditRecordUpdated, AuditRecordCreated}},
+		{AuditSubjectUpload, "QmAuditUpload", []string{AuditUploadUpdated, AuditUploadCreated}},
+	} {
+		events, err := am.FindBySubject(tt.subjectType, tt.subject)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != len(tt.actions) {
+			t.Fatalf("expected %v %s events, got %v", len(tt.actions), tt.subjectType, len(events))
+		}
+		for i, action := range tt.actions {
+			if events[i].Action != action || events[i].Actor != "audit-content" {
+				t.Fatalf("unexpected event %+v", events[i])
+			}
+		}
+	}
+}
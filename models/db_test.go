@@ -27,6 +27,11 @@ func newTestDB(t *testing.T, model interface{}) *gorm.DB {
 	db.SetLogger(&testLogger{t})
 	db.LogMode(true)
 
+	// most managers record changes in the audit log
+	if check := db.AutoMigrate(&AuditEvent{}); check.Error != nil {
+		t.Fatalf("could not execute migration for audit events: %s", check.Error)
+	}
+
 	if model != nil {
 		if check := db.AutoMigrate(model); check.Error != nil {
 			t.Fatalf("could not execute migration for model '%+v': %s",
@@ -45,15 +50,35 @@ func TestAutoMigrate(t *testing.T) {
 		name string
 		args args
 	}{
+		{"account suspension", args{&AccountSuspension{}}},
+		{"audit event", args{&AuditEvent{}}},
+		{"email history", args{&EmailHistory{}}},
 		{"encrypted upload", args{&EncryptedUpload{}}},
+		{"ipfs key", args{&IPFSKey{}}},
 		{"ipfs networks", args{&HostedNetwork{}}},
 		{"ipns", args{&IPNS{}}},
+		{"ipns revision", args{&IPNSRevision{}}},
+		{"key grant", args{&KeyGrant{}}},
+		{"login attempt", args{&LoginAttempt{}}},
+		{"network charge", args{&NetworkCharge{}}},
+		{"network member", args{&NetworkMember{}}},
+		{"network node", args{&NetworkNode{}}},
+		{"network state transition", args{&NetworkStateTransition{}}},
+		{"node status change", args{&NodeStatusChange{}}},
+		{"password history", args{&PasswordHistory{}}},
 		{"payment", args{&Payments{}}},
 		{"record", args{&Record{}}},
+		{"recovery code", args{&RecoveryCode{}}},
+		{"resource quota", args{&ResourceQuota{}}},
+		{"role", args{&Role{}}},
+		{"session", args{&Session{}}},
+		{"swarm key rotation", args{&SwarmKeyRotation{}}},
 		{"tns zone", args{&Zone{}}},
 		{"upload", args{&Upload{}}},
 		{"usage", args{&Usage{}}},
 		{"user", args{&User{}}},
+		{"user role", args{&UserRole{}}},
+		{"user token", args{&UserToken{}}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -0,0 +1,150 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrEmailAddressInUse is an error triggered when changing to an email
+	// address that belongs to another account
+	ErrEmailAddressInUse = "email address is already in use"
+)
+
+// EmailHistory is a previous email address of a user, kept to help
+// investigate account recovery requests
+type EmailHistory struct {
+	gorm.Model
+	UserName     string `gorm:"type:varchar(255);index"`
+	EmailAddress string `gorm:"type:varchar(255);index"`
+	// Verified is whether the address had been verified when it was replaced
+	Verified bool `gorm:"type:boolean"`
+}
+
+// RequestEmailChange is used to begin changing a user's email address. The
+// new address is stored as pending, and the returned token must be sent to
+// it and supplied to ConfirmEmailChange. Requesting another change replaces
+// the pending address and invalidates the previous token.
+func (um *UserManager) RequestEmailChange(username, newEmail string) (string, error) {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return "", err
+	}
+	if newEmail == "" {
+		return "", errors.New("no email address provided")
+	}
+	if newEmail == user.EmailAddress {
+		return "", errors.New("new email address is the same as the current one")
+	}
+	// uniqueness is checked again on confirmation, this avoids sending
+	// a token that could never be used
+	if _, err := um.FindByEmail(newEmail); err == nil {
+		return "", errors.New(ErrEmailAddressInUse)
+	} else if err != gorm.ErrRecordNotFound {
+		return "", err
+	}
+	var token string
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("pending_email_address", newEmail).Error; err != nil {
+			return err
+		}
+		if _, token, err = NewUserTokenManager(tx).NewToken(username, TokenChangeEmail, 0); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserEmailChangeRequested, AuditSubjectUser, username,
+			map[string]interface{}{"pending_email_address": user.PendingEmailAddress},
+			map[string]interface{}{"pending_email_address": newEmail},
+		)
+	}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConfirmEmailChange is used to complete an email address change with a token
+// issued by RequestEmailChange. As the token was delivered to the new address,
+// the new address is considered verified. The previous address is kept in the
+// user's email history.
+func (um *UserManager) ConfirmEmailChange(username, token string) (*User, error) {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	if user.PendingEmailAddress == "" {
+		return nil, errors.New("no email address change is pending")
+	}
+	if _, err := NewUserTokenManager(um.DB).ConsumeToken(username, TokenChangeEmail, token); err != nil {
+		return nil, err
+	}
+	previous, email := user.EmailAddress, user.PendingEmailAddress
+	// the address may have been claimed by another account since the request
+	if _, err := um.FindByEmail(email); err == nil {
+		return nil, errors.New(ErrEmailAddressInUse)
+	} else if err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if previous != "" {
+			if err := tx.Create(&EmailHistory{
+				UserName:     username,
+				EmailAddress: previous,
+				Verified:     user.EmailEnabled,
+			}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Model(user).UpdateColumns(map[string]interface{}{
+			"email_address":         email,
+			"pending_email_address": "",
+			"email_enabled":         true,
+		}).Error; err != nil {
+			return err
+		}
+		// verification tokens sent to the previous address are no longer valid
+		if err := NewUserTokenManager(tx).InvalidateTokens(username, TokenVerifyEmail); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserEmailChanged, AuditSubjectUser, username,
+			map[string]interface{}{"email_address": previous},
+			map[string]interface{}{"email_address": email},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	user.EmailAddress = email
+	user.PendingEmailAddress = ""
+	user.EmailEnabled = true
+	return user, nil
+}
+
+// CancelEmailChange is used to abandon a pending email address change
+func (um *UserManager) CancelEmailChange(username string) error {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("pending_email_address", "").Error; err != nil {
+			return err
+		}
+		if err := NewUserTokenManager(tx).InvalidateTokens(username, TokenChangeEmail); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserEmailChangeCancelled, AuditSubjectUser, username,
+			map[string]interface{}{"pending_email_address": user.PendingEmailAddress},
+			map[string]interface{}{"pending_email_address": ""},
+		)
+	})
+}
+
+// GetEmailHistory is used to return the previous email addresses of a user, most recent first
+func (um *UserManager) GetEmailHistory(username string) ([]EmailHistory, error) {
+	var history []EmailHistory
+	if err := um.DB.Where("user_name = ?", username).Order(
+		"created_at desc",
+	).Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestUserManager_EmailChange(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(UserToken{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(EmailHistory{})
+	var um = NewUserManager(db)
+	user, err := um.NewUserAccount("emailchangeuser", "password123", "emailchangeuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "emailchangeuser").Delete(&Usage{})
+	defer um.DB.Unscoped().Where("user_name = ?", "emailchangeuser").Delete(&EmailHistory{})
+	other, err := um.NewUserAccount("emailchangeother", "password123", "emailchangeother@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(other)
+	defer um.DB.Unscoped().Where("user_name = ?", "emailchangeother").Delete(&Usage{})
+	if _, err := um.RequestEmailChange("emailchangeuser", "emailchangeother@example.org"); err == nil {
+		t.Fatal("error expected")
+	} else if err.Error() != ErrEmailAddressInUse {
+		t.Fatal(err)
+	}
+	if _, err := um.RequestEmailChange("emailchangeuser", "emailchangeuser@example.org"); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := um.ConfirmEmailChange("emailchangeuser", "notarealtoken"); err == nil {
+		t.Fatal("error expected")
+	}
+	token, err := um.RequestEmailChange("emailchangeuser", "emailchanged@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.ConfirmEmailChange("emailchangeuser", "notarealtoken"); err == nil {
+		t.Fatal("error expected")
+	}
+	changed, err := um.ConfirmEmailChange("emailchangeuser", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.EmailAddress != "emailchanged@example.org" || !changed.EmailEnabled {
+		t.Fatalf("unexpected user %+v", changed)
+	}
+	if _, err := um.ConfirmEmailChange("emailchangeuser", token); err == nil {
+		t.Fatal("error expected")
+	}
+	history, err := um.GetEmailHistory("emailchangeuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].EmailAddress != "emailchangeuser@example.org" {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	// the other account can't take the new address once confirmed
+	token, err = um.RequestEmailChange("emailchangeother", "emailchanged2@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := um.CancelEmailChange("emailchangeother"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.ConfirmEmailChange("emailchangeother", token); err == nil {
+		t.Fatal("error expected")
+	}
+	events, err := NewAuditManager(db).FindBySubject(AuditSubjectUser, "emailchangeother")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("subject = ?", "emailchangeother").Delete(&AuditEvent{})
+	var requested, cancelled bool
+	for _, event := range events {
+		requested = requested || event.Action == AuditUserEmailChangeRequested
+		cancelled = cancelled || event.Action == AuditUserEmailChangeCancelled
+	}
+	if !requested || !cancelled {
+		t.Fatalf("expected email change request and cancellation to be audited, got %+v", events)
+	}
+}
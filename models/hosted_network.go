@@ -2,7 +2,6 @@ package models
 
 import (
 	"errors"
-	"fmt"
 	"time"
 
 	"github.com/RTradeLtd/database/v2/utils"
@@ -19,18 +18,38 @@ type HostedNetwork struct {
 	Name      string     `gorm:"unique;type:varchar(255)"` // Name of the network node
 	Activated *time.Time // Activated represents the most recent activation, null if offline
 	Disabled  bool
+	// State is the lifecycle state of the network, changed with TransitionNetwork
+	State NetworkState `gorm:"type:varchar(255);index"`
 
-	PeerKey string // Private key used to generate peerID for this network node
+	// PeerKey is the private key used to generate peerID for this network node,
+	// encrypted at rest when a keyring is configured
+	PeerKey string
 
 	// SwarmAddr is the address of swarm port. Slated for deprecation if HTTP path
 	// support is added to the multiaddr spec and go-multiaddr
 	SwarmAddr string `gorm:"type:varchar(255)"`
-	// SwarmKey is the key used to connect to this peer
+	// SwarmKey is the key used to connect to this peer, encrypted at rest when
+	// a keyring is configured
 	SwarmKey string `gorm:"type:varchar(255)"`
+	// PreviousSwarmKey is the key replaced by the most recent rotation, which
+	// nodes keep using until SwarmKeyActivatesAt
+	PreviousSwarmKey    string `gorm:"type:varchar(255)"`
+	SwarmKeyActivatesAt *time.Time
 
 	// Used to set Allowed-Origin headers on API requests
+	//
+	// Deprecated: origins are stored in APIAllowedOrigins, this holds the first
+	// of them for delegators which don't load the full access policy
 	APIAllowedOrigin string `gorm:"type:varchar(255)"`
 
+	// Access policy of the network, changed with SetAccessPolicy
+	APIAllowedOrigins   pq.StringArray `gorm:"type:text[]"`
+	AllowedCIDRs        pq.StringArray `gorm:"type:text[];column:allowed_cidrs"`
+	DeniedCIDRs         pq.StringArray `gorm:"type:text[];column:denied_cidrs"`
+	RateLimitPerSecond  int
+	RateLimitBurst      int
+	GatewayAllowedPaths pq.StringArray `gorm:"type:text[]"`
+
 	// Toggles whether gateway should be exposed through Nexus delegator
 	GatewayPublic bool `gorm:"type:boolean"`
 
@@ -45,9 +64,13 @@ type HostedNetwork struct {
 
 	// Owner is the creator of the private network, and is allowed to invoke
 	// administrative commands, such as network destruction.
+	//
+	// Deprecated: owners are stored in the NetworkMember table, this is only read by MigrateNetworkMembership
 	Owners pq.StringArray `gorm:"type:text[]"`
 	// Users allowed to control this node. Includes API access.
-	Users pq.StringArray `gorm:"type:text[]"` // these are the users to which this IPFS network connection applies to specified by eth address
+	//
+	// Deprecated: users are stored in the NetworkMember table, this is only read by MigrateNetworkMembership
+	Users pq.StringArray `gorm:"type:text[]"`
 }
 
 // HostedNetworkManager is used to manipulate IPFS network models in the database
@@ -66,13 +89,20 @@ func (im *HostedNetworkManager) GetNetworkByName(name string) (*HostedNetwork, e
 	if check := im.DB.Model(&pnet).Where("name = ?", name).First(&pnet); check.Error != nil {
 		return nil, check.Error
 	}
+	if err := im.decryptNetwork(&pnet); err != nil {
+		return nil, err
+	}
 	return &pnet, nil
 }
 
 // SwarmDetails provides data about IPFS swarm connection
 type SwarmDetails struct {
 	Addr string
-	Key  string
+	// Key is the swarm key currently in use
+	Key string
+	// NextKey is the key nodes switch to at NextKeyActivatesAt, during a rotation
+	NextKey            string
+	NextKeyActivatesAt *time.Time
 }
 
 // GetSwarmDetails is used to retrieve data about IPFS swarm connection
@@ -81,15 +111,24 @@ func (im *HostedNetworkManager) GetSwarmDetails(network string) (*SwarmDetails,
 	if err != nil {
 		return nil, err
 	}
-	return &SwarmDetails{
+	details := &SwarmDetails{
 		Addr: pnet.SwarmAddr,
 		Key:  pnet.SwarmKey,
-	}, nil
+	}
+	if swarmKeyRotationPending(pnet, time.Now()) {
+		details.Key = pnet.PreviousSwarmKey
+		details.NextKey = pnet.SwarmKey
+		details.NextKeyActivatesAt = pnet.SwarmKeyActivatesAt
+	}
+	return details, nil
 }
 
-// APIDetails provides data about IPFS API connection
+// APIDetails provides data about IPFS API connection, along with the access
+// policy the delegator enforces for the network
 type APIDetails struct {
+	// AllowedOrigin is the first allowed origin of the access policy
 	AllowedOrigin string
+	NetworkAccessPolicy
 }
 
 // GetAPIDetails is used to retrieve data about IPFS API connection
@@ -98,26 +137,115 @@ func (im *HostedNetworkManager) GetAPIDetails(network string) (*APIDetails, erro
 	if err != nil {
 		return nil, err
 	}
-	return &APIDetails{
-		AllowedOrigin: pnet.APIAllowedOrigin,
-	}, nil
+	details := &APIDetails{NetworkAccessPolicy: networkAccessPolicy(pnet)}
+	if len(details.AllowedOrigins) > 0 {
+		details.AllowedOrigin = details.AllowedOrigins[0]
+	}
+	return details, nil
 }
 
-// UpdateNetworkByName updates the given network with given attributes
+// UpdateNetworkByName updates the given network with given attributes.
+// Bootstrap peers, access policies, lifecycle states, resources and swarm
+// keys can't be updated this way, since they must be validated.
 func (im *HostedNetworkManager) UpdateNetworkByName(name string, attrs map[string]interface{}) error {
-	var pnet HostedNetwork
-	if check := im.DB.Model(&pnet).Where("name = ?", name).First(&pnet).Update(attrs); check.Error != nil {
-		return check.Error
+	encrypted := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		switch k {
+		case "name", "Name":
+			return errors.New(ErrNetworkRenamed)
+		case "bootstrap_peer_addresses", "bootstrap_peer_ids", "BootstrapPeerAddresses", "BootstrapPeerIDs":
+			return errors.New("bootstrap peers must be changed with AddBootstrapPeer, RemoveBootstrapPeer or ReplaceBootstrapPeers")
+		}
+		if isAccessPolicyAttr(k) {
+			return errors.New("access policies must be changed with SetAccessPolicy")
+		}
+		if isNetworkStateAttr(k) {
+			return errors.New(ErrNetworkStateNotTransitioned)
+		}
+		if isSwarmKeyAttr(k) {
+			return errors.New(ErrSwarmKeyNotRotated)
+		}
+		switch k {
+		case "resources_cpus", "resources_disk_gb", "resources_memory_gb",
+			"ResourcesCPUs", "ResourcesDiskGB", "ResourcesMemoryGB":
+			return errors.New("network resources must be changed with ResizeNetwork")
+		}
+		if value, ok := v.(string); ok && isNetworkSecret(k) {
+			ciphertext, err := encryptSecret(im.DB, value)
+			if err != nil {
+				return err
+			}
+			v = ciphertext
+		}
+		encrypted[k] = v
 	}
-	return nil
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		var pnet HostedNetwork
+		if check := tx.Model(&pnet).Where("name = ?", name).First(&pnet).Update(encrypted); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditNetworkUpdated, AuditSubjectNetwork, name, nil, redactNetworkAttrs(attrs))
+	})
 }
 
-// SaveNetwork saves the given HostedNetwork in the database
+// SaveNetwork saves the given HostedNetwork in the database. An existing
+// network can't be renamed, and its lifecycle state and swarm key can't be
+// changed this way, TransitionNetwork and RotateSwarmKey must be used
+// instead. Growing its resources is subject to the quotas of its owners.
 func (im *HostedNetworkManager) SaveNetwork(n *HostedNetwork) error {
-	if check := im.DB.Save(n); check != nil && check.Error != nil {
-		return check.Error
+	if err := networkResources(n).Validate(); err != nil {
+		return err
+	}
+	policy, err := networkAccessPolicy(n).normalize()
+	if err != nil {
+		return err
+	}
+	applyAccessPolicy(n, policy)
+	// keep peer IDs consistent with the addresses being saved
+	addrs, ids, err := parseBootstrapPeers(n.BootstrapPeerAddresses)
+	if err != nil {
+		return err
+	}
+	n.BootstrapPeerAddresses, n.BootstrapPeerIDs = addrs, ids
+	peerKey, swarmKey, previousSwarmKey := n.PeerKey, n.SwarmKey, n.PreviousSwarmKey
+	if err := im.encryptNetwork(n); err != nil {
+		return err
 	}
-	return nil
+	err = withTransaction(im.DB, func(tx *gorm.DB) error {
+		if n.ID != 0 {
+			current := &HostedNetwork{}
+			if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+				"id = ?", n.ID,
+			).First(current).Error; err != nil {
+				return err
+			}
+			if current.Name != n.Name {
+				return errors.New(ErrNetworkRenamed)
+			}
+			if !sameNetworkState(current, n) {
+				return errors.New(ErrNetworkStateNotTransitioned)
+			}
+			if err := im.decryptNetwork(current); err != nil {
+				return err
+			}
+			if current.SwarmKey != swarmKey || current.PreviousSwarmKey != previousSwarmKey ||
+				!sameTime(current.SwarmKeyActivatesAt, n.SwarmKeyActivatesAt) {
+				return errors.New(ErrSwarmKeyNotRotated)
+			}
+			if err := NewHostedNetworkManager(tx).checkResizeQuotas(
+				n.Name, networkResources(current), networkResources(n),
+			); err != nil {
+				return err
+			}
+		}
+		if err := tx.Save(n).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkUpdated, AuditSubjectNetwork, n.Name, nil, networkAuditSnapshot(n))
+	})
+	// callers continue to work with the plaintext keys
+	n.PeerKey, n.SwarmKey, n.PreviousSwarmKey = peerKey, swarmKey, previousSwarmKey
+	return err
 }
 
 // GetOfflineNetworks returns all currently offline networks
@@ -127,18 +255,35 @@ func (im *HostedNetworkManager) GetOfflineNetworks(disabled bool) ([]*HostedNetw
 		Where("activated is null").
 		Where("disabled = ?", disabled).
 		Find(&networks)
-	return networks, check.Error
+	if check.Error != nil {
+		return nil, check.Error
+	}
+	for _, n := range networks {
+		if err := im.decryptNetwork(n); err != nil {
+			return nil, err
+		}
+	}
+	return networks, nil
 }
 
 // NetworkAccessOptions configures access to a hosted private network
 type NetworkAccessOptions struct {
-	Owner            string
-	Users            []string
+	// Owner is the user administering and paying for the network, and is required
+	Owner string
+	Users []string
+	// APIAllowedOrigin and PublicGateway are shorthands merged into Policy
 	APIAllowedOrigin string
 	PublicGateway    bool
+	// Policy is the access policy the delegator enforces for the network
+	Policy NetworkAccessPolicy
+	// Resources to allocate to the network node, counted against the
+	// resource quotas of the owner and the owner's organization
+	Resources NetworkResources
 }
 
-// CreateHostedPrivateNetwork is used to store a new hosted private network in the database
+// CreateHostedPrivateNetwork is used to store a new hosted private network in
+// the database. The swarm key must be the contents of a swarm.key file, if it
+// is empty a new key is generated.
 func (im *HostedNetworkManager) CreateHostedPrivateNetwork(
 	name, swarmKey string,
 	peers []string,
@@ -152,68 +297,203 @@ func (im *HostedNetworkManager) CreateHostedPrivateNetwork(
 	if pnet.CreatedAt != nilTime {
 		return nil, errors.New("private network already exists")
 	}
-
-	// parse peers
-	if peers != nil {
-		for _, v := range peers {
-			// parse peer address
-			addr, err := utils.GenerateMultiAddrFromString(v)
-			if err != nil {
-				return nil, err
-			}
-			valid, err := utils.ParseMultiAddrForIPFSPeer(addr)
-			if err != nil {
-				return nil, err
-			}
-			if !valid {
-				return nil, fmt.Errorf("provided peer '%s' is not a valid bootstrap peer", addr)
-			}
-
-			// parse peer ID
-			peer := addr.String()
-			formattedBAddr, err := utils.GenerateMultiAddrFromString(peer)
-			if err != nil {
-				return nil, err
-			}
-			parsedBPeerID, err := utils.ParsePeerIDFromIPFSMultiAddr(formattedBAddr)
-			if err != nil {
-				return nil, err
+	if access.Owner == "" {
+		return nil, errors.New("private network must have an owner")
+	}
+	if err := access.Resources.Validate(); err != nil {
+		return nil, err
+	}
+	policy := access.Policy
+	if access.APIAllowedOrigin != "" {
+		origins := []string{access.APIAllowedOrigin}
+		for _, origin := range policy.AllowedOrigins {
+			if origin != access.APIAllowedOrigin {
+				origins = append(origins, origin)
 			}
-
-			// register peer
-			pnet.BootstrapPeerAddresses = append(pnet.BootstrapPeerAddresses, peer)
-			pnet.BootstrapPeerIDs = append(pnet.BootstrapPeerIDs, parsedBPeerID)
 		}
+		policy.AllowedOrigins = origins
 	}
-
-	// parse authorized users
-	if access.Users != nil && len(access.Users) > 0 {
-		for _, v := range access.Users {
-			pnet.Users = append(pnet.Users, v)
+	policy.GatewayPublic = policy.GatewayPublic || access.PublicGateway
+	policy, err := policy.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if swarmKey == "" {
+		generated, err := utils.GenerateSwarmKey()
+		if err != nil {
+			return nil, err
 		}
+		swarmKey = generated
+	} else if _, err := utils.ParseSwarmKey(swarmKey); err != nil {
+		return nil, err
+	}
+	if err := im.checkResourceQuotas(access.Owner, 1, access.Resources); err != nil {
+		return nil, err
 	}
 
-	// set the owner of the network
-	pnet.Owners = []string{access.Owner}
+	// parse peers
+	if peers != nil {
+		addrs, ids, err := parseBootstrapPeers(peers)
+		if err != nil {
+			return nil, err
+		}
+		pnet.BootstrapPeerAddresses = addrs
+		pnet.BootstrapPeerIDs = ids
+	}
 
 	// assign misc details
 	pnet.Name = name
-	pnet.SwarmKey = swarmKey
-	pnet.APIAllowedOrigin = access.APIAllowedOrigin
-	pnet.GatewayPublic = access.PublicGateway
+	encryptedSwarmKey, err := encryptSecret(im.DB, swarmKey)
+	if err != nil {
+		return nil, err
+	}
+	pnet.SwarmKey = encryptedSwarmKey
+	applyAccessPolicy(pnet, policy)
+	pnet.State = NetworkRequested
+	pnet.ResourcesCPUs = access.Resources.CPUs
+	pnet.ResourcesDiskGB = access.Resources.DiskGB
+	pnet.ResourcesMemoryGB = access.Resources.MemoryGB
 
-	// create network entry
-	if check := im.DB.Create(pnet); check.Error != nil {
-		return nil, check.Error
+	// create network entry along with its owner and authorized users
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(pnet).Error; err != nil {
+			return err
+		}
+		if _, err := addNetworkMember(tx, name, access.Owner, NetworkRoleOwner); err != nil {
+			return err
+		}
+		for _, user := range access.Users {
+			if user == access.Owner {
+				continue
+			}
+			if _, err := addNetworkMember(tx, name, user, NetworkRoleUser); err != nil {
+				return err
+			}
+		}
+		if err := recordNetworkTransition(tx, name, "", NetworkRequested, "network created", pnet.CreatedAt); err != nil {
+			return err
+		}
+		snapshot := networkAuditSnapshot(pnet)
+		snapshot["owner"] = access.Owner
+		snapshot["users"] = access.Users
+		return recordAudit(tx, AuditNetworkCreated, AuditSubjectNetwork, name, nil, snapshot)
+	}); err != nil {
+		return nil, err
 	}
+	pnet.SwarmKey = swarmKey
 	return pnet, nil
 }
 
-// Delete is used to remove a network from the database
+// Delete is used to remove a network from the database. The network is
+// charged for its usage up until it is deleted, since its history is
+// removed along with it. A final charge that can't be paid yet is retried
+// by ChargeNetworks like any other.
 func (im *HostedNetworkManager) Delete(name string) error {
 	net, err := im.GetNetworkByName(name)
 	if err != nil {
 		return err
 	}
-	return im.DB.Unscoped().Delete(net).Error
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		billing := NewHostedNetworkManager(tx)
+		charge, err := billing.chargeNetwork(name, time.Now())
+		if err != nil {
+			return err
+		}
+		if charge != nil {
+			if err := billing.settleNetworkCharge(charge.ID); err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Delete(net).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&NetworkMember{}, &NetworkStateTransition{}, &NetworkNode{}, &NodeStatusChange{}, &SwarmKeyRotation{},
+		} {
+			if err := tx.Unscoped().Where("network_name = ?", name).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return recordAudit(tx, AuditNetworkDeleted, AuditSubjectNetwork, name, networkAuditSnapshot(net), nil)
+	})
+}
+
+// RotateNetworkSecrets is used to re-encrypt the keys of every network with
+// the primary key of the configured keyring, after which older keys may be
+// removed from the keyring. It returns the number of networks updated.
+func (im *HostedNetworkManager) RotateNetworkSecrets() (int, error) {
+	return reencryptSecretColumns(im.DB, &HostedNetwork{}, false, "peer_key", "swarm_key", "previous_swarm_key")
+}
+
+// MigrateNetworkSecrets is used to encrypt network keys stored before a
+// keyring was configured. It does nothing if there is no keyring.
+func (im *HostedNetworkManager) MigrateNetworkSecrets() error {
+	if KeyringFrom(im.DB) == nil {
+		return nil
+	}
+	_, err := reencryptSecretColumns(im.DB, &HostedNetwork{}, true, "peer_key", "swarm_key", "previous_swarm_key")
+	return err
+}
+
+// encryptNetwork encrypts the keys of a network in place
+func (im *HostedNetworkManager) encryptNetwork(n *HostedNetwork) error {
+	var err error
+	if n.PeerKey, err = encryptSecret(im.DB, n.PeerKey); err != nil {
+		return err
+	}
+	if n.SwarmKey, err = encryptSecret(im.DB, n.SwarmKey); err != nil {
+		return err
+	}
+	n.PreviousSwarmKey, err = encryptSecret(im.DB, n.PreviousSwarmKey)
+	return err
+}
+
+// decryptNetwork decrypts the keys of a network in place
+func (im *HostedNetworkManager) decryptNetwork(n *HostedNetwork) error {
+	var err error
+	if n.PeerKey, err = decryptSecret(im.DB, n.PeerKey); err != nil {
+		return err
+	}
+	if n.SwarmKey, err = decryptSecret(im.DB, n.SwarmKey); err != nil {
+		return err
+	}
+	n.PreviousSwarmKey, err = decryptSecret(im.DB, n.PreviousSwarmKey)
+	return err
+}
+
+// isNetworkSecret returns whether an update attribute is a network key
+func isNetworkSecret(attr string) bool {
+	switch attr {
+	case "peer_key", "swarm_key", "previous_swarm_key", "PeerKey", "SwarmKey", "PreviousSwarmKey":
+		return true
+	}
+	return false
+}
+
+// networkAuditSnapshot returns the audited fields of a network, omitting its keys
+func networkAuditSnapshot(n *HostedNetwork) map[string]interface{} {
+	return map[string]interface{}{
+		"disabled":                 n.Disabled,
+		"state":                    n.State,
+		"activated":                n.Activated,
+		"swarm_addr":               n.SwarmAddr,
+		"access_policy":            networkAccessPolicy(n),
+		"bootstrap_peer_addresses": n.BootstrapPeerAddresses,
+		"resources_cpus":           n.ResourcesCPUs,
+		"resources_disk_gb":        n.ResourcesDiskGB,
+		"resources_memory_gb":      n.ResourcesMemoryGB,
+	}
+}
+
+// redactNetworkAttrs returns a copy of update attributes with any keys redacted
+func redactNetworkAttrs(attrs map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(attrs))
+	for k, v := range attrs {
+		if isNetworkSecret(k) {
+			redacted[k] = "[redacted]"
+		} else {
+			redacted[k] = v
+		}
+	}
+	return redacted
 }
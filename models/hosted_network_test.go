@@ -3,15 +3,44 @@ package models
 import (
 	"testing"
 	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
-func TestHostedNetworkManager_Access(t *testing.T) {
+// testSwarmKey is a valid swarm.key file for creating test networks
+const testSwarmKey = "/key/swarm/psk/1.0.0/\n/base16/\n" +
+	"7b5e8f0c1d2a3b4c5d6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4"
+
+// newNetworkTestDB migrates hosted networks along with the tables the
+// network manager reads and writes as a side effect, such as when charging
+// a network that is being deleted
+func newNetworkTestDB(t *testing.T) *gorm.DB {
 	db := newTestDB(t, &HostedNetwork{})
+	for _, model := range []interface{}{
+		NetworkMember{}, NetworkStateTransition{}, NetworkNode{}, NodeStatusChange{}, SwarmKeyRotation{},
+		User{}, Organization{}, Upload{}, NetworkCharge{},
+	} {
+		db.AutoMigrate(model)
+	}
+	// network keys can't be stored without a keyring
+	return WithKeyring(db, testKeyring("old"))
+}
+
+func TestHostedNetworkManager_Access(t *testing.T) {
+	db := newNetworkTestDB(t)
 	defer db.Close()
 	var hm = NewHostedNetworkManager(db)
-	network, err := hm.CreateHostedPrivateNetwork(
+	if _, err := hm.CreateHostedPrivateNetwork(
 		"myveryrandomnetworkname",
-		"such swarm much protec",
+		testSwarmKey,
+		nil,
+		NetworkAccessOptions{Users: []string{"testuserguy2"}},
+	); err == nil {
+		t.Fatal("error expected creating a network without an owner")
+	}
+	_, err := hm.CreateHostedPrivateNetwork(
+		"myveryrandomnetworkname",
+		testSwarmKey,
 		nil,
 		NetworkAccessOptions{
 			Owner: "testuserguy1",
@@ -22,20 +51,25 @@ func TestHostedNetworkManager_Access(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer hm.Delete("myveryrandomnetworkname")
-	var found bool
-	for _, owner := range network.Owners {
-		if owner == "testuserguy1" {
-			found = true
-			break
-		}
+	owners, err := hm.GetNetworkOwners("myveryrandomnetworkname")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !found {
+	if len(owners) != 1 || owners[0] != "testuserguy1" {
 		t.Fatal("failed to correctly set network owner during creation")
 	}
+	// the owner is not duplicated as a regular user
+	members, err := hm.GetNetworkMembers("myveryrandomnetworkname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("expected 2 members, got %v", len(members))
+	}
 }
 
 func TestHostedNetworkManager_GetOfflineNetworks(t *testing.T) {
-	db := newTestDB(t, &HostedNetwork{})
+	db := newNetworkTestDB(t)
 	defer db.Close()
 	var hm = NewHostedNetworkManager(db)
 
@@ -0,0 +1,194 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// KeyTypeRSA is an RSA IPFS key
+	KeyTypeRSA = "rsa"
+	// KeyTypeED25519 is an ed25519 IPFS key
+	KeyTypeED25519 = "ed25519"
+
+	// ErrKeyNotFound is an error triggered when a user has no active key with the given name
+	ErrKeyNotFound = "key not found"
+)
+
+// IPFSKey is an IPFS key created by a user, used to publish IPNS records
+// and sign TNS zones. Removed keys are marked as revoked rather than deleted,
+// so their names may be reused.
+type IPFSKey struct {
+	gorm.Model
+	// UserName is the owner of the key
+	UserName string `gorm:"type:varchar(255);index"`
+	Name     string `gorm:"type:varchar(255)"`
+	// PeerID is the public key hash of the key
+	PeerID      string `gorm:"type:varchar(255);index"`
+	KeyType     string `gorm:"type:varchar(255)"`
+	NetworkName string `gorm:"type:varchar(255)"`
+	LastUsedAt  *time.Time
+	RevokedAt   *time.Time
+}
+
+// IPFSKeyOptions configures optional details of a new key
+type IPFSKeyOptions struct {
+	// KeyType is KeyTypeRSA or KeyTypeED25519, or empty if unknown
+	KeyType     string
+	NetworkName string
+}
+
+// NewIPFSKey is used to record a key created by a user. Key names must be
+// unique amongst the user's active keys, and peer IDs amongst all active keys.
+func (um *UserManager) NewIPFSKey(username, name, peerID string, opts IPFSKeyOptions) (*IPFSKey, error) {
+	switch opts.KeyType {
+	case "", KeyTypeRSA, KeyTypeED25519:
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", opts.KeyType)
+	}
+	if _, err := um.FindByUserName(username); err != nil {
+		return nil, err
+	}
+	if _, err := um.FindIPFSKeyByName(username, name); err == nil {
+		return nil, errors.New("key already exists in database for user")
+	} else if err.Error() != ErrKeyNotFound {
+		return nil, err
+	}
+	if peerID != "" {
+		if _, err := um.FindIPFSKeyByPeerID(peerID); err == nil {
+			return nil, errors.New("key with peer id already exists in database")
+		} else if err.Error() != ErrKeyNotFound {
+			return nil, err
+		}
+	}
+	key := &IPFSKey{
+		UserName:    username,
+		Name:        name,
+		PeerID:      peerID,
+		KeyType:     opts.KeyType,
+		NetworkName: opts.NetworkName,
+	}
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserKeyAdded, AuditSubjectUser, username,
+			nil, map[string]interface{}{"key_name": name, "key_id": peerID},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// FindIPFSKeyByName is used to find an active key of a user by its name
+func (um *UserManager) FindIPFSKeyByName(username, name string) (*IPFSKey, error) {
+	key := &IPFSKey{}
+	if err := um.DB.Where(
+		"user_name = ? AND name = ? AND revoked_at IS NULL", username, name,
+	).First(key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrKeyNotFound)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// FindIPFSKeyByPeerID is used to find an active key by its peer ID
+func (um *UserManager) FindIPFSKeyByPeerID(peerID string) (*IPFSKey, error) {
+	key := &IPFSKey{}
+	if err := um.DB.Where(
+		"peer_id = ? AND revoked_at IS NULL", peerID,
+	).First(key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrKeyNotFound)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// FindIPFSKeysByUser is used to find the active keys of a user, oldest first
+func (um *UserManager) FindIPFSKeysByUser(username string) ([]IPFSKey, error) {
+	var keys []IPFSKey
+	if err := um.DB.Where(
+		"user_name = ? AND revoked_at IS NULL", username,
+	).Order("created_at asc, id asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CountIPFSKeys is used to count the active keys of a user
+func (um *UserManager) CountIPFSKeys(username string) (int64, error) {
+	return countIPFSKeys(um.DB, username)
+}
+
+// MarkIPFSKeyUsed is used to record that a key has just been used
+func (um *UserManager) MarkIPFSKeyUsed(username, name string) error {
+	key, err := um.FindIPFSKeyByName(username, name)
+	if err != nil {
+		return err
+	}
+	return um.DB.Model(key).UpdateColumn("last_used_at", time.Now()).Error
+}
+
+// MigrateIPFSKeyArrays is used to copy keys stored in the legacy
+// User.IPFSKeyNames and User.IPFSKeyIDs arrays into the IPFSKey table.
+// Names and IDs are paired by position, if the arrays are of different
+// lengths the names without a matching ID are migrated without a peer ID.
+// Keys that have already been migrated are skipped, and the arrays of each
+// user are emptied once their keys have been migrated.
+func (um *UserManager) MigrateIPFSKeyArrays() error {
+	var users []User
+	if err := um.DB.Where(
+		"array_length(ipfs_key_names, 1) > 0 OR array_length(ipfs_key_ids, 1) > 0",
+	).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, user := range users {
+		if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+			for i, name := range user.IPFSKeyNames {
+				var count int
+				if err := tx.Model(&IPFSKey{}).Where(
+					"user_name = ? AND name = ?", user.UserName, name,
+				).Count(&count).Error; err != nil {
+					return err
+				}
+				if count > 0 {
+					continue
+				}
+				key := &IPFSKey{
+					UserName: user.UserName,
+					Name:     name,
+				}
+				if i < len(user.IPFSKeyIDs) {
+					key.PeerID = user.IPFSKeyIDs[i]
+				}
+				if err := tx.Create(key).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Model(&user).UpdateColumns(map[string]interface{}{
+				"ipfs_key_names": gorm.Expr("'{}'"),
+				"ipfs_key_ids":   gorm.Expr("'{}'"),
+			}).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countIPFSKeys counts the active keys of a user
+func countIPFSKeys(db *gorm.DB, username string) (int64, error) {
+	var count int64
+	err := db.Model(&IPFSKey{}).Where(
+		"user_name = ? AND revoked_at IS NULL", username,
+	).Count(&count).Error
+	return count, err
+}
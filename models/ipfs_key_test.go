@@ -0,0 +1,123 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestUserManager_IPFSKeys(t *testing.T) {
+	db := newTestDB(t, &IPFSKey{})
+	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(KeyGrant{})
+	db.AutoMigrate(PasswordHistory{})
+	var um = NewUserManager(db)
+	user, err := um.NewUserAccount("ipfskeyuser", "password123", "ipfskeyuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "ipfskeyuser").Delete(&Usage{})
+	defer um.DB.Unscoped().Where("user_name = ?", "ipfskeyuser").Delete(&IPFSKey{})
+	key, err := um.NewIPFSKey("ipfskeyuser", "key1", "ipfskeyuser-peer1", IPFSKeyOptions{
+		KeyType:     KeyTypeED25519,
+		NetworkName: "public",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.KeyType != KeyTypeED25519 || key.NetworkName != "public" {
+		t.Fatalf("unexpected key %+v", key)
+	}
+	if _, err := um.NewIPFSKey("ipfskeyuser", "key1", "ipfskeyuser-peer2", IPFSKeyOptions{}); err == nil {
+		t.Fatal("error expected for duplicate name")
+	}
+	if _, err := um.NewIPFSKey("ipfskeyuser", "key2", "ipfskeyuser-peer1", IPFSKeyOptions{}); err == nil {
+		t.Fatal("error expected for duplicate peer id")
+	}
+	if _, err := um.NewIPFSKey("ipfskeyuser", "key2", "ipfskeyuser-peer2", IPFSKeyOptions{KeyType: "dsa"}); err == nil {
+		t.Fatal("error expected for unsupported key type")
+	}
+	if err := um.AddIPFSKeyForUser("ipfskeyuser", "key2", "ipfskeyuser-peer2"); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := um.CountIPFSKeys("ipfskeyuser"); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected 2 keys, got %v", count)
+	}
+	if err := um.MarkIPFSKeyUsed("ipfskeyuser", "key1"); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := um.FindIPFSKeyByName("ipfskeyuser", "key1"); err != nil {
+		t.Fatal(err)
+	} else if key.LastUsedAt == nil {
+		t.Fatal("last used should be set")
+	}
+	// removing requires the name and id to match the same key
+	if err := um.RemoveIPFSKeyForUser("ipfskeyuser", "key1", "ipfskeyuser-peer2"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := um.RemoveIPFSKeyForUser("ipfskeyuser", "key1", "ipfskeyuser-peer1"); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := um.GetKeysForUser("ipfskeyuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys["key_names"]) != 1 || keys["key_names"][0] != "key2" || keys["key_ids"][0] != "ipfskeyuser-peer2" {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+	// names of removed keys can be reused
+	if err := um.AddIPFSKeyForUser("ipfskeyuser", "key1", "ipfskeyuser-peer3"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := um.GetKeyIDByName("ipfskeyuser", "key1"); err != nil {
+		t.Fatal(err)
+	} else if id != "ipfskeyuser-peer3" {
+		t.Fatalf("unexpected key id %s", id)
+	}
+}
+
+func TestUserManager_MigrateIPFSKeyArrays(t *testing.T) {
+	db := newTestDB(t, &IPFSKey{})
+	defer db.Close()
+	db.AutoMigrate(User{})
+	var um = NewUserManager(db)
+	user := &User{
+		UserName:     "ipfskeymigrateuser",
+		EmailAddress: "ipfskeymigrateuser@example.org",
+		IPFSKeyNames: []string{"key1", "key2", "key3"},
+		IPFSKeyIDs:   []string{"ipfskeymigrate-peer1", "ipfskeymigrate-peer2"},
+	}
+	if err := um.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "ipfskeymigrateuser").Delete(&IPFSKey{})
+	// running the migration twice should not duplicate keys
+	for i := 0; i < 2; i++ {
+		if err := um.MigrateIPFSKeyArrays(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys, err := um.FindIPFSKeysByUser("ipfskeymigrateuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 keys, got %v", len(keys))
+	}
+	if keys[1].Name != "key2" || keys[1].PeerID != "ipfskeymigrate-peer2" {
+		t.Fatalf("unexpected key %+v", keys[1])
+	}
+	if keys[2].PeerID != "" {
+		t.Fatal("key without a matching id should have no peer id")
+	}
+	// the legacy arrays are emptied so removed keys aren't migrated again
+	if migrated, err := um.FindByUserName("ipfskeymigrateuser"); err != nil {
+		t.Fatal(err)
+	} else if len(migrated.IPFSKeyNames) != 0 || len(migrated.IPFSKeyIDs) != 0 {
+		t.Fatalf("unexpected legacy keys %+v %+v", migrated.IPFSKeyNames, migrated.IPFSKeyIDs)
+	}
+}
@@ -2,26 +2,52 @@ package models
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
 )
 
-// IPNS will hold all of the IPNS entries in our system
+const (
+	// ErrIPNSKeyNotOwned is an error triggered when a user publishes an IPNS
+	// record with a key they neither own nor have been shared for publishing
+	ErrIPNSKeyNotOwned = "user does not have access to the key of the ipns record"
+)
+
+// IPNS will hold all of the IPNS entries in our system. A record is
+// identified by its ipns hash and the network it is published on.
 type IPNS struct {
 	gorm.Model
 	Sequence int64 `gorm:"type:integer"`
 	// the ipns hash, is the peer id of the peer used to sign the entry
-	IPNSHash string `gorm:"type:varchar(255);unique"`
+	IPNSHash string `gorm:"type:varchar(255);unique_index:idx_ipns_network"`
 	// List of content hashes this IPNS entry has pointed to
+	//
+	// Deprecated: history is stored in the IPNSRevision table, this is only read by MigrateIPNSRevisions
 	IPFSHashes      pq.StringArray `gorm:"type:text[]"`
 	CurrentIPFSHash string         `gorm:"type:varchar(255)"`
-	LifeTime        string         `gorm:"type:varchar(255)"`
-	TTL             string         `gorm:"type:varchar(255)"`
-	Key             string         `gorm:"type:varchar(255)"`
-	NetworkName     string         `gorm:"type:varchar(255)"`
-	UserName        string         `gorm:"type:varchar(255)"`
+	// LifeTime and TTL are formatted with time.Duration.String(), and kept
+	// in step with LifeTimeDuration and TTLDuration for older readers
+	LifeTime    string `gorm:"type:varchar(255)"`
+	TTL         string `gorm:"type:varchar(255)"`
+	Key         string `gorm:"type:varchar(255)"`
+	NetworkName string `gorm:"type:varchar(255);unique_index:idx_ipns_network"`
+	UserName    string `gorm:"type:varchar(255)"`
+
+	LifeTimeDuration time.Duration `gorm:"type:bigint"`
+	TTLDuration      time.Duration `gorm:"type:bigint"`
+	// ExpiresAt is when the most recent publish of the record expires, null
+	// if the record was published without a lifetime
+	ExpiresAt *time.Time `gorm:"index"`
+
+	// Republish state, managed by ClaimRecordsForRepublish,
+	// MarkRepublishSucceeded and MarkRepublishFailed
+	RepublishLeaseOwner     string `gorm:"type:varchar(255)"`
+	RepublishLeaseExpiresAt *time.Time
+	LastRepublishedAt       *time.Time
+	RepublishFailures       int
+	LastRepublishError      string `gorm:"type:text"`
 }
 
 // IpnsManager is used for manipulating IPNS records in our database
@@ -45,6 +71,26 @@ func (im *IpnsManager) FindByUserName(username string) (*[]IPNS, error) {
 	return &entries, nil
 }
 
+// CheckIfUserCanPublish is used to check whether a user may publish the IPNS
+// record for the given hash on a network, either because they own the key it
+// is signed with or because the key has been shared with them. Records whose
+// key is not tracked in the IPFSKey table may only be published by the
+// creator of the record on that network.
+func (im *IpnsManager) CheckIfUserCanPublish(username, ipnsHash, networkName string) (bool, error) {
+	um := NewUserManager(im.DB)
+	if _, err := um.FindIPFSKeyByPeerID(ipnsHash); err != nil {
+		if err.Error() != ErrKeyNotFound {
+			return false, err
+		}
+		entry, err := im.FindByIPNSHashAndNetwork(ipnsHash, networkName)
+		if err != nil {
+			return false, err
+		}
+		return entry.UserName == username, nil
+	}
+	return um.CheckIfUserCanUseKey(username, ipnsHash, KeyPermPublishIPNS)
+}
+
 // FindAll is used to find all IPNS records
 func (im *IpnsManager) FindAll() ([]IPNS, error) {
 	entries := []IPNS{}
@@ -55,66 +101,304 @@ func (im *IpnsManager) FindAll() ([]IPNS, error) {
 }
 
 // FindByIPNSHash is used to find an IPNS record from our database searching for
-// the public key hash of the key that was used to pulish a record
+// the public key hash of the key that was used to pulish a record. If the
+// record is published on several networks, the oldest is returned.
 func (im *IpnsManager) FindByIPNSHash(ipnsHash string) (*IPNS, error) {
 	var entry IPNS
-	if check := im.DB.Where("ip_ns_hash = ?", ipnsHash).First(&entry); check.Error != nil {
+	if check := im.DB.Where("ip_ns_hash = ?", ipnsHash).Order("id asc").First(&entry); check.Error != nil {
 		return nil, check.Error
 	}
 	return &entry, nil
 }
 
-// UpdateIPNSEntry is used to update an already existing IPNS entry, creating a no record matching the hash exists
-func (im *IpnsManager) UpdateIPNSEntry(ipnsHash, ipfsHash, networkName, username string, lifetime, ttl time.Duration) (*IPNS, error) {
+// FindByIPNSHashAndNetwork is used to find the IPNS record for a hash on a network
+func (im *IpnsManager) FindByIPNSHashAndNetwork(ipnsHash, networkName string) (*IPNS, error) {
 	var entry IPNS
-	// search for an IPNS entry that matches the given ipns hash
-	if check := im.DB.Where("ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName).First(&entry); check.Error != nil {
+	if check := im.DB.Where(
+		"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+	).First(&entry); check.Error != nil {
 		return nil, check.Error
 	}
-	// increase sequence
-	entry.Sequence++
-	// update the hashes it has pointed to
-	entry.IPFSHashes = append(entry.IPFSHashes, ipfsHash)
-	// update the current hash this record points to
-	entry.CurrentIPFSHash = ipfsHash
-	// update the lifetime
-	entry.LifeTime = lifetime.String()
-	// update the ttl
-	entry.TTL = ttl.String()
-	// only update  changed fields
-	check := im.DB.Model(&entry).Updates(map[string]interface{}{
-		"sequence":           entry.Sequence,
-		"ip_fs_hashes":       entry.IPFSHashes,
-		"current_ip_fs_hash": entry.CurrentIPFSHash,
-		"life_time":          entry.LifeTime,
-		"ttl":                entry.TTL,
-	})
+	return &entry, nil
+}
 
-	if check.Error != nil {
-		return nil, check.Error
+// UpdateIPNSEntry is used to update an already existing IPNS entry, recording
+// the new value as a revision published by the given user. The user must
+// have access to the record's key.
+func (im *IpnsManager) UpdateIPNSEntry(ipnsHash, ipfsHash, networkName, username string, lifetime, ttl time.Duration) (*IPNS, error) {
+	var entry IPNS
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		// search for an IPNS entry that matches the given ipns hash
+		if check := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+		).First(&entry); check.Error != nil {
+			return check.Error
+		}
+		if _, err := im.checkKeyAccess(username, ipnsHash, networkName); err != nil {
+			return err
+		}
+		// increase sequence
+		entry.Sequence++
+		// update the current hash this record points to
+		before := entry.CurrentIPFSHash
+		entry.CurrentIPFSHash = ipfsHash
+		// update the lifetime and ttl, along with when the record expires
+		now := time.Now()
+		setIPNSDurations(&entry, lifetime, ttl, now)
+		// a new publish replaces any failed republish
+		entry.RepublishFailures = 0
+		entry.LastRepublishError = ""
+		// only update  changed fields
+		check := tx.Model(&entry).Updates(map[string]interface{}{
+			"sequence":             entry.Sequence,
+			"current_ip_fs_hash":   entry.CurrentIPFSHash,
+			"life_time":            entry.LifeTime,
+			"ttl":                  entry.TTL,
+			"life_time_duration":   entry.LifeTimeDuration,
+			"ttl_duration":         entry.TTLDuration,
+			"expires_at":           entry.ExpiresAt,
+			"republish_failures":   entry.RepublishFailures,
+			"last_republish_error": entry.LastRepublishError,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		if err := recordIPNSRevision(tx, &entry, lifetime, ttl, username, now); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditIPNSRecordUpdated, AuditSubjectIPNS, ipnsHash,
+			map[string]interface{}{"network_name": networkName, "ipfs_hash": before},
+			map[string]interface{}{
+				"network_name": networkName,
+				"ipfs_hash":    ipfsHash,
+				"sequence":     entry.Sequence,
+				"publisher":    username,
+			},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return &entry, nil
 }
 
-// CreateEntry is used to create a brand new IPNS entry in our database
+// CreateEntry is used to create a brand new IPNS entry in our database. The
+// user must own the key the record is signed with, or have had it shared
+// with them for publishing. Creating a record that was deleted restores it,
+// continuing its sequence so that the new value supersedes the old one.
 func (im *IpnsManager) CreateEntry(ipnsHash, ipfsHash, key, networkName, username string, lifetime, ttl time.Duration) (*IPNS, error) {
-	// See above UpdateEntry function for an explanation
-	if _, err := im.FindByIPNSHash(ipnsHash); err == nil {
+	deleted := &IPNS{}
+	if err := im.DB.Unscoped().Where(
+		"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+	).First(deleted).Error; err == nil && deleted.DeletedAt == nil {
 		return nil, errors.New("ipns hash already exists in database")
+	} else if err == gorm.ErrRecordNotFound {
+		deleted = nil
+	} else if err != nil {
+		return nil, err
 	}
-	entry := IPNS{
-		Sequence:        1,
-		IPNSHash:        ipnsHash,
-		CurrentIPFSHash: ipfsHash,
-		IPFSHashes:      pq.StringArray{ipfsHash},
-		LifeTime:        lifetime.String(),
-		TTL:             ttl.String(),
-		Key:             key,
-		NetworkName:     networkName,
-		UserName:        username,
-	}
-	if check := im.DB.Create(&entry); check.Error != nil {
-		return nil, check.Error
+	if signer, err := im.checkKeyAccess(username, ipnsHash, networkName); err != nil {
+		return nil, err
+	} else if signer.Name != key {
+		return nil, errors.New("key does not sign this ipns record")
+	}
+	var (
+		now   = time.Now()
+		entry = IPNS{
+			Sequence:        1,
+			IPNSHash:        ipnsHash,
+			CurrentIPFSHash: ipfsHash,
+			Key:             key,
+			NetworkName:     networkName,
+			UserName:        username,
+		}
+	)
+	setIPNSDurations(&entry, lifetime, ttl, now)
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if deleted != nil {
+			entry.Model = gorm.Model{ID: deleted.ID, CreatedAt: deleted.CreatedAt}
+			entry.Sequence = deleted.Sequence + 1
+			if check := tx.Unscoped().Save(&entry); check.Error != nil {
+				return check.Error
+			}
+		} else if check := tx.Create(&entry); check.Error != nil {
+			return check.Error
+		}
+		if err := recordIPNSRevision(tx, &entry, lifetime, ttl, username, now); err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditIPNSRecordCreated, AuditSubjectIPNS, ipnsHash, nil, map[string]interface{}{
+			"network_name": networkName,
+			"ipfs_hash":    ipfsHash,
+			"key":          key,
+			"sequence":     entry.Sequence,
+			"publisher":    username,
+		})
+	}); err != nil {
+		return nil, err
 	}
 	return &entry, nil
 }
+
+// setIPNSDurations sets the lifetime and ttl of a record published at the
+// given time, along with when it expires
+func setIPNSDurations(entry *IPNS, lifetime, ttl time.Duration, publishedAt time.Time) {
+	entry.LifeTime = lifetime.String()
+	entry.TTL = ttl.String()
+	entry.LifeTimeDuration = lifetime
+	entry.TTLDuration = ttl
+	entry.ExpiresAt = nil
+	if lifetime > 0 {
+		expiresAt := publishedAt.Add(lifetime)
+		entry.ExpiresAt = &expiresAt
+	}
+}
+
+// TransferIPNSRecord is used to hand an IPNS record over to another user, who
+// must have access to the key the record is signed with
+func (im *IpnsManager) TransferIPNSRecord(ipnsHash, networkName, from, to string) (*IPNS, error) {
+	entry := &IPNS{}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+		).First(entry).Error; err != nil {
+			return err
+		}
+		if entry.UserName != from {
+			return errors.New("ipns record is not owned by user")
+		}
+		if from == to {
+			return errors.New("ipns record is already owned by user")
+		}
+		if _, err := im.checkKeyAccess(to, ipnsHash, networkName); err != nil {
+			return err
+		}
+		if err := tx.Model(entry).UpdateColumn("user_name", to).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditIPNSRecordTransferred, AuditSubjectIPNS, ipnsHash,
+			map[string]interface{}{"user_name": from, "network_name": networkName},
+			map[string]interface{}{"user_name": to, "network_name": networkName},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// MigrateIPNSIdentity is used to drop the global uniqueness of ipns hashes
+// from databases created before records were identified by their hash and
+// network, so that a record may be published on several networks
+func (im *IpnsManager) MigrateIPNSIdentity() error {
+	table := im.DB.NewScope(&IPNS{}).TableName()
+	return im.DB.Exec(fmt.Sprintf(
+		"ALTER TABLE %s DROP CONSTRAINT IF EXISTS %s_ip_ns_hash_key", table, table,
+	)).Error
+}
+
+// checkKeyAccess checks that a user may publish an IPNS record, returning
+// the key with the record's peer ID that they own or that has been shared
+// with them. The key must belong to the record's network if it is scoped to one.
+func (im *IpnsManager) checkKeyAccess(username, ipnsHash, networkName string) (*IPFSKey, error) {
+	um := NewUserManager(im.DB)
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	key, err := um.findUsableIPFSKeyByPeerID(user, ipnsHash, KeyPermPublishIPNS)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return nil, errors.New(ErrIPNSKeyNotOwned)
+		}
+		return nil, err
+	}
+	if key.NetworkName != "" && key.NetworkName != networkName {
+		return nil, errors.New("key does not belong to the network of this ipns record")
+	}
+	return key, nil
+}
+
+// Delete is used to delete an IPNS record owned by the given user. Records
+// are soft deleted, so that their revisions remain as history. Deleting a
+// record doesn't return quota to the user's Usage, since
+// IPNSRecordsPublished counts publishes made during the billing cycle rather
+// than records that currently exist.
+func (im *IpnsManager) Delete(ipnsHash, networkName, username string) error {
+	entry, err := im.FindByIPNSHashAndNetwork(ipnsHash, networkName)
+	if err != nil {
+		return err
+	}
+	if entry.UserName != username {
+		return errors.New("ipns record is not owned by user")
+	}
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		return deleteIPNSRecord(tx, entry)
+	})
+}
+
+// DeleteIPNSRecordsByKey is used to delete every IPNS record signed with the
+// named key of a user, including records published by users the key was
+// shared with, returning the number of records deleted. The user's active key
+// with that name is used, or their most recently removed one. As with Delete,
+// quota is not returned to the user's Usage.
+func (im *IpnsManager) DeleteIPNSRecordsByKey(username, keyName string) (int, error) {
+	key := &IPFSKey{}
+	if err := im.DB.Where(
+		"user_name = ? AND name = ?", username, keyName,
+	).Order("revoked_at IS NULL desc, id desc").First(key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return 0, errors.New(ErrKeyNotFound)
+		}
+		return 0, err
+	}
+	if key.PeerID == "" {
+		return 0, errors.New("key has no peer id to match records with")
+	}
+	var entries []IPNS
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"ip_ns_hash = ?", key.PeerID,
+		).Find(&entries).Error; err != nil {
+			return err
+		}
+		for i := range entries {
+			if err := deleteIPNSRecord(tx, &entries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// FindRecordsWithRemovedKeys is used to find IPNS records signed with a key
+// that has been removed with UserManager.RemoveIPFSKeyForUser, and so can no
+// longer be published
+func (im *IpnsManager) FindRecordsWithRemovedKeys() ([]IPNS, error) {
+	var entries []IPNS
+	if err := im.DB.Where(
+		"ip_ns_hash IN (?)",
+		im.DB.Model(&IPFSKey{}).Select("peer_id").Where("revoked_at IS NOT NULL AND peer_id <> ''").SubQuery(),
+	).Where(
+		"ip_ns_hash NOT IN (?)",
+		im.DB.Model(&IPFSKey{}).Select("peer_id").Where("revoked_at IS NULL AND peer_id <> ''").SubQuery(),
+	).Order("id asc").Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// deleteIPNSRecord soft deletes an IPNS record within tx
+func deleteIPNSRecord(tx *gorm.DB, entry *IPNS) error {
+	if err := tx.Delete(entry).Error; err != nil {
+		return err
+	}
+	return recordAudit(tx, AuditIPNSRecordDeleted, AuditSubjectIPNS, entry.IPNSHash, map[string]interface{}{
+		"network_name":       entry.NetworkName,
+		"user_name":          entry.UserName,
+		"key":                entry.Key,
+		"sequence":           entry.Sequence,
+		"current_ip_fs_hash": entry.CurrentIPFSHash,
+	}, nil)
+}
@@ -0,0 +1,184 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrRepublishLeaseNotHeld is an error triggered when a worker reports on a
+	// republish it no longer holds the lease for
+	ErrRepublishLeaseNotHeld = "republish lease is not held by this worker"
+)
+
+var (
+	// IPNSRepublishRetryDelay is how long a record waits before being retried
+	// after its first failed republish, doubling with every further failure
+	IPNSRepublishRetryDelay = time.Minute
+	// IPNSRepublishMaxRetryDelay is the longest a record waits before being retried
+	IPNSRepublishMaxRetryDelay = time.Hour
+)
+
+// ClaimRecordsForRepublish is used by a republish worker to lease up to limit
+// records expiring within the given duration. Leased records aren't returned
+// to other workers until the lease ends, so that workers can run concurrently.
+// Only records of users whose tier republishes IPNS records, and who haven't
+// used up their IPNS publishes, are claimed.
+func (im *IpnsManager) ClaimRecordsForRepublish(worker string, within, lease time.Duration, limit int) ([]IPNS, error) {
+	if worker == "" {
+		return nil, errors.New("republish worker must be named")
+	}
+	var tiers []DataUsageTier
+	for _, tier := range []DataUsageTier{Unverified, Free, Paid, Partner, WhiteLabeled} {
+		if tier.RepublishesIPNS() {
+			tiers = append(tiers, tier)
+		}
+	}
+	var (
+		now     = time.Now()
+		entries []IPNS
+	)
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE SKIP LOCKED").Where(
+			"expires_at IS NOT NULL AND expires_at <= ?", now.Add(within),
+		).Where(
+			"republish_lease_expires_at IS NULL OR republish_lease_expires_at <= ?", now,
+		).Where("user_name IN (?)", tx.Model(&Usage{}).Select("user_name").Where(
+			"tier IN (?) AND ip_ns_records_published < ip_ns_records_allowed", tiers,
+		).SubQuery()).Order("expires_at asc").Limit(limit).Find(&entries).Error; err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+		var (
+			ids       = make([]uint, 0, len(entries))
+			leaseEnds = now.Add(lease)
+		)
+		for i := range entries {
+			ids = append(ids, entries[i].ID)
+			entries[i].RepublishLeaseOwner = worker
+			entries[i].RepublishLeaseExpiresAt = &leaseEnds
+		}
+		return tx.Model(&IPNS{}).Where("id IN (?)", ids).UpdateColumns(map[string]interface{}{
+			"republish_lease_owner":      worker,
+			"republish_lease_expires_at": leaseEnds,
+		}).Error
+	}); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// MarkRepublishSucceeded is used by a worker to record that it republished a
+// record it claimed. The record expires a lifetime from now, and the republish
+// is counted against the IPNS publishes of the record's owner, up to the
+// number of publishes they are allowed.
+func (im *IpnsManager) MarkRepublishSucceeded(ipnsHash, networkName, worker string) (*IPNS, error) {
+	return im.finishRepublish(ipnsHash, networkName, worker, func(tx *gorm.DB, entry *IPNS, now time.Time) error {
+		setIPNSDurations(entry, entry.LifeTimeDuration, entry.TTLDuration, now)
+		entry.LastRepublishedAt = &now
+		entry.RepublishFailures = 0
+		entry.LastRepublishError = ""
+		entry.RepublishLeaseExpiresAt = nil
+		if err := tx.Model(entry).UpdateColumns(map[string]interface{}{
+			"expires_at":                 entry.ExpiresAt,
+			"last_republished_at":        entry.LastRepublishedAt,
+			"republish_failures":         entry.RepublishFailures,
+			"last_republish_error":       entry.LastRepublishError,
+			"republish_lease_owner":      "",
+			"republish_lease_expires_at": entry.RepublishLeaseExpiresAt,
+		}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&Usage{}).Where(
+			"user_name = ? AND ip_ns_records_published < ip_ns_records_allowed", entry.UserName,
+		).UpdateColumn(
+			"ip_ns_records_published", gorm.Expr("ip_ns_records_published + 1"),
+		).Error
+	})
+}
+
+// MarkRepublishFailed is used by a worker to record that it failed to
+// republish a record it claimed. The record is released to be retried after
+// a delay which grows with each consecutive failure.
+func (im *IpnsManager) MarkRepublishFailed(ipnsHash, networkName, worker, reason string) (*IPNS, error) {
+	return im.finishRepublish(ipnsHash, networkName, worker, func(tx *gorm.DB, entry *IPNS, now time.Time) error {
+		entry.RepublishFailures++
+		entry.LastRepublishError = reason
+		retryAt := now.Add(republishRetryDelay(entry.RepublishFailures))
+		entry.RepublishLeaseExpiresAt = &retryAt
+		return tx.Model(entry).UpdateColumns(map[string]interface{}{
+			"republish_failures":         entry.RepublishFailures,
+			"last_republish_error":       entry.LastRepublishError,
+			"republish_lease_owner":      "",
+			"republish_lease_expires_at": entry.RepublishLeaseExpiresAt,
+		}).Error
+	})
+}
+
+// finishRepublish locks a record leased by worker while update records the
+// outcome of its republish, releasing the lease. Workers whose lease has
+// ended may no longer report, since the record may have been claimed again.
+func (im *IpnsManager) finishRepublish(
+	ipnsHash, networkName, worker string,
+	update func(tx *gorm.DB, entry *IPNS, now time.Time) error,
+) (*IPNS, error) {
+	entry := &IPNS{}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+		).First(entry).Error; err != nil {
+			return err
+		}
+		now := time.Now()
+		if entry.RepublishLeaseOwner == "" || entry.RepublishLeaseOwner != worker ||
+			entry.RepublishLeaseExpiresAt == nil || !now.Before(*entry.RepublishLeaseExpiresAt) {
+			return errors.New(ErrRepublishLeaseNotHeld)
+		}
+		return update(tx, entry, now)
+	}); err != nil {
+		return nil, err
+	}
+	entry.RepublishLeaseOwner = ""
+	return entry, nil
+}
+
+// MigrateIPNSDurations is used to fill in the durations and expiry of
+// records published before they were stored, by parsing their lifetime and
+// ttl. Records are assumed to have last been published when last updated.
+func (im *IpnsManager) MigrateIPNSDurations() error {
+	var entries []IPNS
+	if err := im.DB.Where("life_time_duration IS NULL").Find(&entries).Error; err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// unparseable durations are treated as never expiring
+		lifetime, _ := time.ParseDuration(entry.LifeTime)
+		ttl, _ := time.ParseDuration(entry.TTL)
+		setIPNSDurations(&entry, lifetime, ttl, entry.UpdatedAt)
+		if err := im.DB.Model(&entry).UpdateColumns(map[string]interface{}{
+			"life_time_duration": entry.LifeTimeDuration,
+			"ttl_duration":       entry.TTLDuration,
+			"expires_at":         entry.ExpiresAt,
+		}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// republishRetryDelay returns how long to wait after the given number of
+// consecutive republish failures
+func republishRetryDelay(failures int) time.Duration {
+	delay := IPNSRepublishRetryDelay
+	for i := 1; i < failures && delay < IPNSRepublishMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > IPNSRepublishMaxRetryDelay {
+		delay = IPNSRepublishMaxRetryDelay
+	}
+	return delay
+}
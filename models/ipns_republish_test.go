@@ -0,0 +1,178 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_republishRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := republishRetryDelay(tt.failures); got != tt.want {
+			t.Fatalf("republishRetryDelay(%v) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestDataUsageTier_RepublishesIPNS(t *testing.T) {
+	for tier, want := range map[DataUsageTier]bool{
+		Unverified:   false,
+		Free:         false,
+		Paid:         true,
+		Partner:      true,
+		WhiteLabeled: true,
+	} {
+		if got := tier.RepublishesIPNS(); got != want {
+			t.Fatalf("%s.RepublishesIPNS() = %v, want %v", tier, got, want)
+		}
+	}
+}
+
+func TestIpnsManager_Republish(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var (
+		im = NewIPNSManager(db)
+		um = NewUserManager(db)
+		bm = NewUsageManager(db)
+	)
+	for _, name := range []string{"republishpaid", "republishfree"} {
+		user, err := um.NewUserAccount(name, "password123", name+"@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer um.DB.Unscoped().Delete(user)
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&Usage{})
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&IPFSKey{})
+	}
+	if err := bm.UpdateTier("republishpaid", Paid); err != nil {
+		t.Fatal(err)
+	}
+	if err := bm.UpdateTier("republishfree", Free); err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []struct{ hash, user string }{
+		{"12D3KooWRepublishPaid", "republishpaid"},
+		{"12D3KooWRepublishFree", "republishfree"},
+	} {
+		if _, err := um.NewIPFSKey(record.user, "republishkey", record.hash, IPFSKeyOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		entry, err := im.CreateEntry(record.hash, "QmRepublish", "republishkey", "public", record.user, time.Hour, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer im.DB.Unscoped().Delete(entry)
+		defer im.DB.Unscoped().Where("ip_ns_hash = ?", record.hash).Delete(&IPNSRevision{})
+		if entry.ExpiresAt == nil || entry.LifeTimeDuration != time.Hour {
+			t.Fatalf("unexpected expiry %+v", entry)
+		}
+	}
+	if claimed, err := im.ClaimRecordsForRepublish("worker1", time.Minute, time.Minute, 10); err != nil {
+		t.Fatal(err)
+	} else if len(claimed) != 0 {
+		t.Fatal("records should not be claimed long before they expire")
+	}
+	claimed, err := im.ClaimRecordsForRepublish("worker1", 2*time.Hour, time.Minute, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// free tier records are never republished
+	if len(claimed) != 1 || claimed[0].IPNSHash != "12D3KooWRepublishPaid" {
+		t.Fatalf("unexpected claimed records %+v", claimed)
+	}
+	if again, err := im.ClaimRecordsForRepublish("worker2", 2*time.Hour, time.Minute, 10); err != nil {
+		t.Fatal(err)
+	} else if len(again) != 0 {
+		t.Fatal("leased records should not be claimed by another worker")
+	}
+	if _, err := im.MarkRepublishSucceeded("12D3KooWRepublishPaid", "public", "worker2"); err == nil ||
+		err.Error() != ErrRepublishLeaseNotHeld {
+		t.Fatalf("expected lease error, got %v", err)
+	}
+	failed, err := im.MarkRepublishFailed("12D3KooWRepublishPaid", "public", "worker1", "routing timed out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed.RepublishFailures != 1 || failed.LastRepublishError != "routing timed out" {
+		t.Fatalf("unexpected failed record %+v", failed)
+	}
+	// failed records wait before they are retried
+	if retried, err := im.ClaimRecordsForRepublish("worker2", 2*time.Hour, time.Minute, 10); err != nil {
+		t.Fatal(err)
+	} else if len(retried) != 0 {
+		t.Fatal("failed records should not be retried immediately")
+	}
+	if err := db.Model(&IPNS{}).Where("ip_ns_hash = ?", "12D3KooWRepublishPaid").UpdateColumn(
+		"republish_lease_expires_at", time.Now().Add(-time.Second),
+	).Error; err != nil {
+		t.Fatal(err)
+	}
+	if retried, err := im.ClaimRecordsForRepublish("worker2", 2*time.Hour, time.Minute, 10); err != nil {
+		t.Fatal(err)
+	} else if len(retried) != 1 {
+		t.Fatal("failed record should be retried once its delay has passed")
+	}
+	// workers may not report once their lease has ended
+	if err := db.Model(&IPNS{}).Where("ip_ns_hash = ?", "12D3KooWRepublishPaid").UpdateColumn(
+		"republish_lease_expires_at", time.Now().Add(-time.Second),
+	).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.MarkRepublishSucceeded("12D3KooWRepublishPaid", "public", "worker2"); err == nil ||
+		err.Error() != ErrRepublishLeaseNotHeld {
+		t.Fatalf("expected lease error, got %v", err)
+	}
+	if retried, err := im.ClaimRecordsForRepublish("worker2", 2*time.Hour, time.Minute, 10); err != nil {
+		t.Fatal(err)
+	} else if len(retried) != 1 {
+		t.Fatal("record should be claimed again once its lease has ended")
+	}
+	before, err := bm.FindByUserName("republishpaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	republished, err := im.MarkRepublishSucceeded("12D3KooWRepublishPaid", "public", "worker2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if republished.RepublishFailures != 0 || republished.LastRepublishedAt == nil ||
+		!republished.ExpiresAt.After(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("unexpected republished record %+v", republished)
+	}
+	after, err := bm.FindByUserName("republishpaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.IPNSRecordsPublished != before.IPNSRecordsPublished+1 {
+		t.Fatal("republish should count against ipns usage")
+	}
+	// publishes are never counted beyond what the owner is allowed
+	if err := db.Model(&Usage{}).Where("user_name = ?", "republishpaid").UpdateColumn(
+		"ip_ns_records_published", after.IPNSRecordsAllowed,
+	).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&IPNS{}).Where("ip_ns_hash = ?", "12D3KooWRepublishPaid").UpdateColumns(map[string]interface{}{
+		"republish_lease_owner":      "worker3",
+		"republish_lease_expires_at": time.Now().Add(time.Minute),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.MarkRepublishSucceeded("12D3KooWRepublishPaid", "public", "worker3"); err != nil {
+		t.Fatal(err)
+	}
+	if capped, err := bm.FindByUserName("republishpaid"); err != nil {
+		t.Fatal(err)
+	} else if capped.IPNSRecordsPublished != after.IPNSRecordsAllowed {
+		t.Fatalf("expected %v publishes, got %v", after.IPNSRecordsAllowed, capped.IPNSRecordsPublished)
+	}
+}
@@ -0,0 +1,120 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrIPNSRevisionNotFound is an error triggered when an IPNS record has no matching revision
+	ErrIPNSRevisionNotFound = "ipns revision not found"
+)
+
+// IPNSRevision is a value an IPNS record was published with
+type IPNSRevision struct {
+	gorm.Model
+	IPNSHash    string        `gorm:"type:varchar(255);unique_index:idx_ipns_revision"`
+	NetworkName string        `gorm:"type:varchar(255);unique_index:idx_ipns_revision"`
+	Sequence    int64         `gorm:"unique_index:idx_ipns_revision"`
+	IPFSHash    string        `gorm:"type:varchar(255)"`
+	LifeTime    time.Duration `gorm:"type:bigint"`
+	TTL         time.Duration `gorm:"type:bigint"`
+	PublishedAt time.Time     `gorm:"index"`
+	// Publisher is the user who published the revision
+	Publisher string `gorm:"type:varchar(255)"`
+}
+
+// GetIPNSRevisions is used to return every revision of an IPNS record, oldest first
+func (im *IpnsManager) GetIPNSRevisions(ipnsHash, networkName string) ([]IPNSRevision, error) {
+	var revisions []IPNSRevision
+	if err := im.DB.Where(
+		"ip_ns_hash = ? AND network_name = ?", ipnsHash, networkName,
+	).Order("sequence asc").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+// GetIPNSValueAt is used to return the revision an IPNS record resolved to at the given time
+func (im *IpnsManager) GetIPNSValueAt(ipnsHash, networkName string, at time.Time) (*IPNSRevision, error) {
+	revision := &IPNSRevision{}
+	if err := im.DB.Where(
+		"ip_ns_hash = ? AND network_name = ? AND published_at <= ?", ipnsHash, networkName, at,
+	).Order("published_at desc, sequence desc").First(revision).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrIPNSRevisionNotFound)
+		}
+		return nil, err
+	}
+	return revision, nil
+}
+
+// RollbackIPNSEntry is used to point an IPNS record back to the value of an
+// earlier revision. Since IPNS sequences may only increase, the value is
+// recorded as a new revision, which the caller is responsible for publishing.
+func (im *IpnsManager) RollbackIPNSEntry(ipnsHash, networkName string, sequence int64, username string) (*IPNS, error) {
+	revision := &IPNSRevision{}
+	if err := im.DB.Where(
+		"ip_ns_hash = ? AND network_name = ? AND sequence = ?", ipnsHash, networkName, sequence,
+	).First(revision).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrIPNSRevisionNotFound)
+		}
+		return nil, err
+	}
+	return im.UpdateIPNSEntry(ipnsHash, revision.IPFSHash, networkName, username, revision.LifeTime, revision.TTL)
+}
+
+// MigrateIPNSRevisions is used to move the history stored in the legacy
+// IPNS.IPFSHashes array into the IPNSRevision table. The array only holds
+// hashes, so earlier revisions are given the record's current lifetime and
+// ttl, and are recorded as published when the record was created. Migrated
+// arrays are emptied so that records are only migrated once.
+func (im *IpnsManager) MigrateIPNSRevisions() error {
+	var entries []IPNS
+	if err := im.DB.Where(
+		"array_length(ip_fs_hashes, 1) > 0",
+	).Find(&entries).Error; err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// durations were stored with time.Duration.String()
+		lifetime, _ := time.ParseDuration(entry.LifeTime)
+		ttl, _ := time.ParseDuration(entry.TTL)
+		if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+			for i, hash := range entry.IPFSHashes {
+				latest := i == len(entry.IPFSHashes)-1
+				publishedAt := entry.CreatedAt
+				if latest {
+					publishedAt = entry.UpdatedAt
+				}
+				revision := entry
+				revision.Sequence = entry.Sequence - int64(len(entry.IPFSHashes)-1-i)
+				revision.CurrentIPFSHash = hash
+				if err := recordIPNSRevision(tx, &revision, lifetime, ttl, entry.UserName, publishedAt); err != nil {
+					return err
+				}
+			}
+			return tx.Model(&entry).UpdateColumn("ip_fs_hashes", gorm.Expr("'{}'")).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordIPNSRevision records the current value of an IPNS record as a revision
+func recordIPNSRevision(db *gorm.DB, entry *IPNS, lifetime, ttl time.Duration, publisher string, at time.Time) error {
+	return db.Create(&IPNSRevision{
+		IPNSHash:    entry.IPNSHash,
+		NetworkName: entry.NetworkName,
+		Sequence:    entry.Sequence,
+		IPFSHash:    entry.CurrentIPFSHash,
+		LifeTime:    lifetime,
+		TTL:         ttl,
+		PublishedAt: at,
+		Publisher:   publisher,
+	}).Error
+}
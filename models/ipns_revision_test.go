@@ -0,0 +1,125 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestIpnsManager_Revisions(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var (
+		im       = NewIPNSManager(db)
+		ipnsHash = "12D3KooWRevisionsHash"
+	)
+	defer newIPNSTestPublisher(t, db, "revisionowner", "revisionkey", ipnsHash)()
+	defer newIPNSTestPublisher(t, db, "revisionpublisher", "otherkey", "")()
+	// the key is shared so that another user may publish the record
+	grant, err := NewUserManager(db).GrantKeyAccess(
+		"revisionowner", "revisionkey", GranteeUser, "revisionpublisher", []KeyPermission{KeyPermPublishIPNS},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(grant)
+	entry, err := im.CreateEntry(ipnsHash, "QmFirst", "revisionkey", "public", "revisionowner", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.DB.Unscoped().Delete(entry)
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", ipnsHash).Delete(&IPNSRevision{})
+	beforeUpdate := time.Now()
+	if _, err := im.UpdateIPNSEntry(ipnsHash, "QmSecond", "public", "revisionpublisher", 2*time.Hour, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("subject = ?", ipnsHash).Delete(&AuditEvent{})
+	if events, err := NewAuditManager(db).FindBySubject(AuditSubjectIPNS, ipnsHash); err != nil {
+		t.Fatal(err)
+	} else if len(events) != 2 || events[0].Action != AuditIPNSRecordUpdated || events[1].Action != AuditIPNSRecordCreated {
+		t.Fatalf("unexpected audit events %+v", events)
+	}
+	revisions, err := im.GetIPNSRevisions(ipnsHash, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("expected 2 revisions, got %v", len(revisions))
+	}
+	if revisions[1].Sequence != 2 || revisions[1].IPFSHash != "QmSecond" ||
+		revisions[1].LifeTime != 2*time.Hour || revisions[1].Publisher != "revisionpublisher" {
+		t.Fatalf("unexpected revision %+v", revisions[1])
+	}
+	// the record resolved to its first value until it was updated
+	if value, err := im.GetIPNSValueAt(ipnsHash, "public", beforeUpdate); err != nil {
+		t.Fatal(err)
+	} else if value.IPFSHash != "QmFirst" {
+		t.Fatalf("expected first value, got %s", value.IPFSHash)
+	}
+	if value, err := im.GetIPNSValueAt(ipnsHash, "public", time.Now()); err != nil {
+		t.Fatal(err)
+	} else if value.IPFSHash != "QmSecond" {
+		t.Fatalf("expected second value, got %s", value.IPFSHash)
+	}
+	if _, err := im.GetIPNSValueAt(ipnsHash, "public", entry.CreatedAt.Add(-time.Hour)); err == nil ||
+		err.Error() != ErrIPNSRevisionNotFound {
+		t.Fatalf("expected missing revision, got %v", err)
+	}
+	if _, err := im.RollbackIPNSEntry(ipnsHash, "public", 5, "revisionowner"); err == nil {
+		t.Fatal("error expected")
+	}
+	rolledBack, err := im.RollbackIPNSEntry(ipnsHash, "public", 1, "revisionowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rolledBack.Sequence != 3 || rolledBack.CurrentIPFSHash != "QmFirst" || rolledBack.LifeTime != time.Hour.String() {
+		t.Fatalf("unexpected rolled back record %+v", rolledBack)
+	}
+}
+
+func TestIpnsManager_MigrateIPNSRevisions(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var (
+		im       = NewIPNSManager(db)
+		ipnsHash = "12D3KooWLegacyHistoryHash"
+	)
+	entry := &IPNS{
+		Sequence:        3,
+		IPNSHash:        ipnsHash,
+		IPFSHashes:      pq.StringArray{"QmOne", "QmTwo", "QmThree"},
+		CurrentIPFSHash: "QmThree",
+		LifeTime:        time.Hour.String(),
+		TTL:             time.Minute.String(),
+		NetworkName:     "public",
+		UserName:        "legacyowner",
+	}
+	if err := db.Create(entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer im.DB.Unscoped().Delete(entry)
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", ipnsHash).Delete(&IPNSRevision{})
+	if err := im.MigrateIPNSRevisions(); err != nil {
+		t.Fatal(err)
+	}
+	// running the migration again must not duplicate history
+	if err := im.MigrateIPNSRevisions(); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := im.GetIPNSRevisions(ipnsHash, "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 3 {
+		t.Fatalf("expected 3 revisions, got %v", len(revisions))
+	}
+	for i, hash := range []string{"QmOne", "QmTwo", "QmThree"} {
+		if revisions[i].IPFSHash != hash || revisions[i].Sequence != int64(i+1) {
+			t.Fatalf("unexpected revision %+v", revisions[i])
+		}
+	}
+	if revisions[2].LifeTime != time.Hour || revisions[2].Publisher != "legacyowner" {
+		t.Fatalf("unexpected revision %+v", revisions[2])
+	}
+}
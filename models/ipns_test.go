@@ -3,6 +3,8 @@ package models
 import (
 	"testing"
 	"time"
+
+	"github.com/jinzhu/gorm"
 )
 
 const (
@@ -13,10 +15,47 @@ var (
 	testCfgPath = "../testenv/config.json"
 )
 
-func TestIpnsManager_NewEntry(t *testing.T) {
+const testIPNSHash = "12D3KooWSev8mmycrPbCMs4Awe4AFGkUQKPh7CTuifh51U8iFEr8"
+
+// newIPNSTestDB returns a test database with the IPNS tables, and the tables
+// needed to check key access, migrated
+func newIPNSTestDB(t *testing.T) *gorm.DB {
 	db := newTestDB(t, &IPNS{})
+	for _, model := range []interface{}{
+		IPNSRevision{}, User{}, Usage{}, PasswordHistory{}, IPFSKey{}, KeyGrant{},
+	} {
+		db.AutoMigrate(model)
+	}
+	if err := NewIPNSManager(db).MigrateIPNSIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// newIPNSTestPublisher creates a user owning a key with the given peer ID,
+// returning a function which removes them
+func newIPNSTestPublisher(t *testing.T, db *gorm.DB, username, keyName, peerID string) func() {
+	um := NewUserManager(db)
+	user, err := um.NewUserAccount(username, "password123", username+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := um.NewIPFSKey(username, keyName, peerID, IPFSKeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		um.DB.Unscoped().Delete(key)
+		um.DB.Unscoped().Where("user_name = ?", username).Delete(&Usage{})
+		um.DB.Unscoped().Delete(user)
+	}
+}
+
+func TestIpnsManager_NewEntry(t *testing.T) {
+	db := newIPNSTestDB(t)
 	defer db.Close()
 	var im = NewIPNSManager(db)
+	defer newIPNSTestPublisher(t, db, "username", "keybrooooooooo", testIPNSHash)()
 	type args struct {
 		ipnsHash    string
 		ipfsHash    string
@@ -30,7 +69,7 @@ func TestIpnsManager_NewEntry(t *testing.T) {
 		name string
 		args args
 	}{
-		{"Test1", args{"12D3KooWSev8mmycrPbCMs4Awe4AFGkUQKPh7CTuifh51U8iFEr8", "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "keybrooooooooo", "public", time.Hour, time.Hour, "username"}},
+		{"Test1", args{testIPNSHash, "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "keybrooooooooo", "public", time.Hour, time.Hour, "username"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -46,6 +85,7 @@ func TestIpnsManager_NewEntry(t *testing.T) {
 			if err != nil {
 				t.Fatal(err)
 			}
+			defer im.DB.Unscoped().Where("ip_ns_hash = ?", tt.args.ipnsHash).Delete(&IPNSRevision{})
 			entries, err := im.FindAll()
 			if err != nil {
 				t.Fatal(err)
@@ -68,9 +108,10 @@ func TestIpnsManager_NewEntry(t *testing.T) {
 }
 
 func TestIpnsManager_UpdateEntry(t *testing.T) {
-	db := newTestDB(t, &IPNS{})
+	db := newIPNSTestDB(t)
 	defer db.Close()
 	var im = NewIPNSManager(db)
+	defer newIPNSTestPublisher(t, db, "username", "key", testIPNSHash)()
 	type args struct {
 		ipnsHash    string
 		ipfsHash    string
@@ -84,7 +125,7 @@ func TestIpnsManager_UpdateEntry(t *testing.T) {
 		name string
 		args args
 	}{
-		{"Test1", args{"12D3KooWSev8mmycrPbCMs4Awe4AFGkUQKPh7CTuifh51U8iFEr8", "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
+		{"Test1", args{testIPNSHash, "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -101,6 +142,7 @@ func TestIpnsManager_UpdateEntry(t *testing.T) {
 				t.Fatal(err)
 			}
 			defer im.DB.Unscoped().Delete(entry)
+			defer im.DB.Unscoped().Where("ip_ns_hash = ?", tt.args.ipnsHash).Delete(&IPNSRevision{})
 			entryCopy, err := im.UpdateIPNSEntry(
 				tt.args.ipnsHash,
 				newIpfsHash,
@@ -120,9 +162,10 @@ func TestIpnsManager_UpdateEntry(t *testing.T) {
 }
 
 func TestIpnsManager_FindByIPNSHash(t *testing.T) {
-	db := newTestDB(t, &IPNS{})
+	db := newIPNSTestDB(t)
 	defer db.Close()
 	var im = NewIPNSManager(db)
+	defer newIPNSTestPublisher(t, db, "username", "key", testIPNSHash)()
 	type args struct {
 		ipnsHash    string
 		ipfsHash    string
@@ -136,7 +179,7 @@ func TestIpnsManager_FindByIPNSHash(t *testing.T) {
 		name string
 		args args
 	}{
-		{"Test1", args{"12D3KooWSev8mmycrPbCMs4Awe4AFGkUQKPh7CTuifh51U8iFEr8", "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
+		{"Test1", args{testIPNSHash, "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -153,6 +196,7 @@ func TestIpnsManager_FindByIPNSHash(t *testing.T) {
 				t.Fatal(err)
 			}
 			defer im.DB.Unscoped().Delete(entry)
+			defer im.DB.Unscoped().Where("ip_ns_hash = ?", tt.args.ipnsHash).Delete(&IPNSRevision{})
 			entryCopy, err := im.FindByIPNSHash(tt.args.ipnsHash)
 			if err != nil {
 				t.Fatal(err)
@@ -165,9 +209,10 @@ func TestIpnsManager_FindByIPNSHash(t *testing.T) {
 }
 
 func TestIpnsManager_FindByUser(t *testing.T) {
-	db := newTestDB(t, &IPNS{})
+	db := newIPNSTestDB(t)
 	defer db.Close()
 	var im = NewIPNSManager(db)
+	defer newIPNSTestPublisher(t, db, "username", "key", testIPNSHash)()
 	type args struct {
 		ipnsHash    string
 		ipfsHash    string
@@ -181,7 +226,7 @@ func TestIpnsManager_FindByUser(t *testing.T) {
 		name string
 		args args
 	}{
-		{"Test1", args{"12D3KooWSev8mmycrPbCMs4Awe4AFGkUQKPh7CTuifh51U8iFEr8", "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
+		{"Test1", args{testIPNSHash, "QmQxXGDe84eUjCg2ZspvduEZxjWZk5DCB2N7bwPjXahoXE", "key", "public", time.Hour, time.Hour, "username"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -198,9 +243,197 @@ func TestIpnsManager_FindByUser(t *testing.T) {
 				t.Fatal(err)
 			}
 			defer im.DB.Unscoped().Delete(entry)
+			defer im.DB.Unscoped().Where("ip_ns_hash = ?", tt.args.ipnsHash).Delete(&IPNSRevision{})
 			if _, err := im.FindByUserName(tt.args.userName); err != nil {
 				t.Fatal(err)
 			}
 		})
 	}
 }
+
+func TestIpnsManager_Ownership(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var im = NewIPNSManager(WithActor(db, "ipnsadmin"))
+	defer newIPNSTestPublisher(t, db, "ipnsowner", "ownedkey", testIPNSHash)()
+	defer newIPNSTestPublisher(t, db, "ipnsother", "otherkey", "")()
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", testIPNSHash).Delete(&IPNS{})
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", testIPNSHash).Delete(&IPNSRevision{})
+	if _, err := im.CreateEntry(testIPNSHash, "QmHash", "ownedkey", "public", "ipnsother", time.Hour, time.Hour); err == nil ||
+		err.Error() != ErrIPNSKeyNotOwned {
+		t.Fatalf("expected key access error, got %v", err)
+	}
+	if _, err := im.CreateEntry("12D3KooWAnotherHash", "QmHash", "ownedkey", "public", "ipnsowner", time.Hour, time.Hour); err == nil {
+		t.Fatal("records must be signed with the key's peer id")
+	}
+	// the same record may be published on several networks
+	for _, network := range []string{"public", "privatenetwork"} {
+		if _, err := im.CreateEntry(testIPNSHash, "QmHash", "ownedkey", network, "ipnsowner", time.Hour, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := im.CreateEntry(testIPNSHash, "QmHash", "ownedkey", "public", "ipnsowner", time.Hour, time.Hour); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := im.UpdateIPNSEntry(testIPNSHash, "QmOther", "public", "ipnsother", time.Hour, time.Hour); err == nil {
+		t.Fatal("records may only be updated by users with access to the key")
+	}
+	if _, err := im.UpdateIPNSEntry(testIPNSHash, "QmOther", "public", "ipnsowner", time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := im.FindByIPNSHashAndNetwork(testIPNSHash, "privatenetwork"); err != nil {
+		t.Fatal(err)
+	} else if entry.CurrentIPFSHash != "QmHash" {
+		t.Fatal("updating a record should not change it on other networks")
+	}
+	// the recipient of a record must be able to publish with its key
+	if _, err := im.TransferIPNSRecord(testIPNSHash, "public", "ipnsowner", "ipnsother"); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := im.TransferIPNSRecord(testIPNSHash, "public", "ipnsother", "ipnsowner"); err == nil {
+		t.Fatal("error expected")
+	}
+	um := NewUserManager(db)
+	grant, err := um.GrantKeyAccess("ipnsowner", "ownedkey", GranteeUser, "ipnsother", []KeyPermission{KeyPermPublishIPNS})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(grant)
+	entry, err := im.TransferIPNSRecord(testIPNSHash, "public", "ipnsowner", "ipnsother")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.UserName != "ipnsother" {
+		t.Fatal("record should have been transferred")
+	}
+	// access is checked against the key with the record's peer id, so owning
+	// another key with the same name doesn't stop the shared key being used
+	samename, err := um.NewIPFSKey("ipnsother", "ownedkey", "12D3KooWSameNameHash", IPFSKeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(samename)
+	if _, err := im.UpdateIPNSEntry(testIPNSHash, "QmShared", "public", "ipnsother", time.Hour, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// keys without a peer id can't sign records
+	if _, err := im.CreateEntry("", "QmHash", "otherkey", "public", "ipnsother", time.Hour, time.Hour); err == nil {
+		t.Fatal("error expected")
+	}
+	var count int
+	if err := db.Model(&AuditEvent{}).Where(
+		"action = ? AND subject = ? AND actor = ?", AuditIPNSRecordTransferred, testIPNSHash, "ipnsadmin",
+	).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count == 0 {
+		t.Fatal("transfer should be audited")
+	}
+	defer db.Unscoped().Where("subject = ?", testIPNSHash).Delete(&AuditEvent{})
+}
+
+func TestIpnsManager_CheckIfUserCanPublish(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var (
+		im       = NewIPNSManager(db)
+		ipnsHash = "12D3KooWUntrackedKeyHash"
+	)
+	// records signed with keys created before keys were tracked
+	for _, record := range []struct{ network, user string }{
+		{"public", "untrackedowner"},
+		{"privatenetwork", "untrackedother"},
+	} {
+		entry := &IPNS{IPNSHash: ipnsHash, NetworkName: record.network, UserName: record.user}
+		if err := db.Create(entry).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(entry)
+	}
+	tests := []struct {
+		username, network string
+		want              bool
+	}{
+		{"untrackedowner", "public", true},
+		{"untrackedother", "public", false},
+		{"untrackedother", "privatenetwork", true},
+		{"untrackedowner", "privatenetwork", false},
+	}
+	for _, tt := range tests {
+		if can, err := im.CheckIfUserCanPublish(tt.username, ipnsHash, tt.network); err != nil {
+			t.Fatal(err)
+		} else if can != tt.want {
+			t.Fatalf("CheckIfUserCanPublish(%s, %s) = %v, want %v", tt.username, tt.network, can, tt.want)
+		}
+	}
+}
+
+func TestIpnsManager_Delete(t *testing.T) {
+	db := newIPNSTestDB(t)
+	defer db.Close()
+	var im = NewIPNSManager(db)
+	defer newIPNSTestPublisher(t, db, "deleteowner", "deletekey", testIPNSHash)()
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", testIPNSHash).Delete(&IPNS{})
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", testIPNSHash).Delete(&IPNSRevision{})
+	for _, network := range []string{"public", "privatenetwork"} {
+		if _, err := im.CreateEntry(testIPNSHash, "QmHash", "deletekey", network, "deleteowner", time.Hour, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := im.Delete(testIPNSHash, "public", "notowner"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := im.Delete(testIPNSHash, "public", "deleteowner"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.FindByIPNSHashAndNetwork(testIPNSHash, "public"); err == nil {
+		t.Fatal("deleted record should not be found")
+	}
+	// history is kept, and continues when the record is published again
+	if revisions, err := im.GetIPNSRevisions(testIPNSHash, "public"); err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 1 {
+		t.Fatal("deleted record should keep its history")
+	}
+	entry, err := im.CreateEntry(testIPNSHash, "QmNewHash", "deletekey", "public", "deleteowner", time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Sequence != 2 {
+		t.Fatalf("expected sequence to continue from deleted record, got %v", entry.Sequence)
+	}
+	// records signed with a removed key are found, and can be cleaned up
+	if err := NewUserManager(db).RemoveIPFSKeyForUser("deleteowner", "deletekey", testIPNSHash); err != nil {
+		t.Fatal(err)
+	}
+	orphaned, err := im.FindRecordsWithRemovedKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 2 {
+		t.Fatalf("expected 2 records with removed keys, got %v", len(orphaned))
+	}
+	// records published with the key by anyone it was shared with are deleted too
+	if err := db.Create(&IPNS{
+		IPNSHash:    testIPNSHash,
+		Key:         "sharedname",
+		NetworkName: "othernetwork",
+		UserName:    "deletegrantee",
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.DeleteIPNSRecordsByKey("deleteowner", "notarealkey"); err == nil ||
+		err.Error() != ErrKeyNotFound {
+		t.Fatalf("expected key not found error, got %v", err)
+	}
+	if deleted, err := im.DeleteIPNSRecordsByKey("deleteowner", "deletekey"); err != nil {
+		t.Fatal(err)
+	} else if deleted != 3 {
+		t.Fatalf("expected 3 records deleted, got %v", deleted)
+	}
+	if entries, err := im.FindByUserName("deleteowner"); err != nil {
+		t.Fatal(err)
+	} else if len(*entries) != 0 {
+		t.Fatal("every record of the key should be deleted")
+	}
+}
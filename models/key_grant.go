@@ -0,0 +1,311 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// KeyPermission is an action another user may be granted on an IPFS key
+type KeyPermission string
+
+// String returns the value of KeyPermission as a string
+func (p KeyPermission) String() string {
+	return string(p)
+}
+
+var (
+	// KeyPermPublishIPNS allows publishing IPNS records with a key
+	KeyPermPublishIPNS KeyPermission = "publish-ipns"
+	// KeyPermSignTNS allows signing TNS zones with a key
+	KeyPermSignTNS KeyPermission = "sign-tns"
+
+	// AllKeyPermissions is every permission that may be granted on a key
+	AllKeyPermissions = []KeyPermission{
+		KeyPermPublishIPNS,
+		KeyPermSignTNS,
+	}
+)
+
+const (
+	// GranteeUser indicates a key grant is to a single user
+	GranteeUser = "user"
+	// GranteeOrganization indicates a key grant is to every member of an organization
+	GranteeOrganization = "organization"
+)
+
+// KeyGrant allows a user, or every member of an organization, to use an
+// IPFS key owned by someone else. Grants are never removed, instead they
+// are marked as revoked.
+type KeyGrant struct {
+	gorm.Model
+	// KeyID is the ID of the IPFSKey being shared
+	KeyID       uint           `gorm:"index"`
+	GranteeType string         `gorm:"type:varchar(255)"`
+	Grantee     string         `gorm:"type:varchar(255);index"`
+	Permissions pq.StringArray `gorm:"type:text[]"`
+	GrantedBy   string         `gorm:"type:varchar(255)"`
+	RevokedBy   string         `gorm:"type:varchar(255)"`
+	RevokedAt   *time.Time
+}
+
+// HasPermission returns whether the grant allows the given permission
+func (g *KeyGrant) HasPermission(perm KeyPermission) bool {
+	for _, p := range g.Permissions {
+		if p == perm.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantKeyAccess is used by the owner of a key to share it with another user
+// or an organization. Granting to a grantee that already has access replaces
+// their permissions.
+func (um *UserManager) GrantKeyAccess(owner, keyName, granteeType, grantee string, perms []KeyPermission) (*KeyGrant, error) {
+	if len(perms) == 0 {
+		return nil, errors.New("no permissions provided")
+	}
+	if err := validateKeyPermissions(perms); err != nil {
+		return nil, err
+	}
+	key, err := um.FindIPFSKeyByName(owner, keyName)
+	if err != nil {
+		return nil, err
+	}
+	switch granteeType {
+	case GranteeUser:
+		if grantee == owner {
+			return nil, errors.New("key owner already has access to key")
+		}
+		if _, err := um.FindByUserName(grantee); err != nil {
+			return nil, err
+		}
+	case GranteeOrganization:
+		if _, err := NewOrgManager(um.DB).FindByName(grantee); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errors.New("unsupported grantee type")
+	}
+	arr := make(pq.StringArray, 0, len(perms))
+	for _, p := range perms {
+		arr = append(arr, p.String())
+	}
+	grant := &KeyGrant{}
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"key_id = ? AND grantee_type = ? AND grantee = ? AND revoked_at IS NULL", key.ID, granteeType, grantee,
+		).First(grant).Error
+		switch err {
+		case nil:
+			if err := tx.Model(grant).Update("permissions", arr).Error; err != nil {
+				return err
+			}
+			grant.Permissions = arr
+		case gorm.ErrRecordNotFound:
+			grant = &KeyGrant{
+				KeyID:       key.ID,
+				GranteeType: granteeType,
+				Grantee:     grantee,
+				Permissions: arr,
+				GrantedBy:   owner,
+			}
+			if err := tx.Create(grant).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		return recordAudit(tx, AuditUserKeyGranted, AuditSubjectUser, owner, nil, map[string]interface{}{
+			"key_name":     keyName,
+			"grantee_type": granteeType,
+			"grantee":      grantee,
+			"permissions":  arr,
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// RevokeKeyAccess is used by the owner of a key to stop sharing it with a user or organization
+func (um *UserManager) RevokeKeyAccess(owner, keyName, granteeType, grantee string) error {
+	key, err := um.FindIPFSKeyByName(owner, keyName)
+	if err != nil {
+		return err
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		check := tx.Model(&KeyGrant{}).Where(
+			"key_id = ? AND grantee_type = ? AND grantee = ? AND revoked_at IS NULL", key.ID, granteeType, grantee,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at": time.Now(),
+			"revoked_by": owner,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		if check.RowsAffected == 0 {
+			return errors.New("key is not shared with grantee")
+		}
+		return recordAudit(tx, AuditUserKeyGrantRevoked, AuditSubjectUser, owner, map[string]interface{}{
+			"key_name":     keyName,
+			"grantee_type": granteeType,
+			"grantee":      grantee,
+		}, nil)
+	})
+}
+
+// GetKeyGrants is used to return the active grants of a key
+func (um *UserManager) GetKeyGrants(owner, keyName string) ([]KeyGrant, error) {
+	key, err := um.FindIPFSKeyByName(owner, keyName)
+	if err != nil {
+		return nil, err
+	}
+	var grants []KeyGrant
+	if err := um.DB.Where(
+		"key_id = ? AND revoked_at IS NULL", key.ID,
+	).Order("created_at asc").Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// FindSharedIPFSKeys is used to find the active keys other users have shared
+// with a user, either directly or through the user's organization
+func (um *UserManager) FindSharedIPFSKeys(username string) ([]IPFSKey, error) {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	var keys []IPFSKey
+	if err := um.DB.Where(
+		"revoked_at IS NULL AND id IN (?)", grantedKeyIDs(um.DB, user).SubQuery(),
+	).Order("created_at asc, id asc").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// CheckIfUserCanUseKey is used to check whether a user may use the key with
+// the given peer ID for an action, either as its owner or through a grant
+func (um *UserManager) CheckIfUserCanUseKey(username, peerID string, perm KeyPermission) (bool, error) {
+	key, err := um.FindIPFSKeyByPeerID(peerID)
+	if err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if key.UserName == username {
+		return true, nil
+	}
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	grants, err := activeKeyGrants(um.DB, user, key.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, grant := range grants {
+		if grant.HasPermission(perm) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CanUseKey is used to check whether a user may use the named key for an
+// action, either as its owner or through a grant. Keys owned by the user are
+// preferred over keys of the same name shared with them.
+func (um *UserManager) CanUseKey(username, keyName string, perm KeyPermission) (bool, error) {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	if _, err := um.findUsableIPFSKey(user, keyName, perm); err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// findUsableIPFSKey finds an active key by name that a user owns, or failing
+// that one that has been shared with them with the given permission
+func (um *UserManager) findUsableIPFSKey(user *User, keyName string, perm KeyPermission) (*IPFSKey, error) {
+	key, err := um.FindIPFSKeyByName(user.UserName, keyName)
+	if err == nil || err.Error() != ErrKeyNotFound {
+		return key, err
+	}
+	key = &IPFSKey{}
+	if err := um.DB.Where(
+		"name = ? AND revoked_at IS NULL AND id IN (?)", keyName,
+		grantedKeyIDs(um.DB, user).Where("? = ANY(permissions)", perm.String()).SubQuery(),
+	).Order("created_at asc").First(key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrKeyNotFound)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// findUsableIPFSKeyByPeerID finds an active key with the given peer ID that
+// a user owns, or that has been shared with them with the given permission
+func (um *UserManager) findUsableIPFSKeyByPeerID(user *User, peerID string, perm KeyPermission) (*IPFSKey, error) {
+	if peerID == "" {
+		return nil, errors.New(ErrKeyNotFound)
+	}
+	key := &IPFSKey{}
+	if err := um.DB.Where(
+		"peer_id = ? AND revoked_at IS NULL AND (user_name = ? OR id IN (?))", peerID, user.UserName,
+		grantedKeyIDs(um.DB, user).Where("? = ANY(permissions)", perm.String()).SubQuery(),
+	).Order(gorm.Expr("user_name = ? desc, created_at asc", user.UserName)).First(key).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrKeyNotFound)
+		}
+		return nil, err
+	}
+	return key, nil
+}
+
+// activeKeyGrants returns the grants of a key that apply to a user
+func activeKeyGrants(db *gorm.DB, user *User, keyID uint) ([]KeyGrant, error) {
+	var grants []KeyGrant
+	err := db.Where(
+		"key_id = ? AND revoked_at IS NULL AND ((grantee_type = ? AND grantee = ?) OR (grantee_type = ? AND grantee = ?))",
+		keyID, GranteeUser, user.UserName, GranteeOrganization, user.Organization,
+	).Find(&grants).Error
+	return grants, err
+}
+
+// grantedKeyIDs returns a query selecting the IDs of keys shared with a user
+func grantedKeyIDs(db *gorm.DB, user *User) *gorm.DB {
+	return db.Model(&KeyGrant{}).Select("key_id").Where(
+		"revoked_at IS NULL AND ((grantee_type = ? AND grantee = ?) OR (grantee_type = ? AND grantee = ?))",
+		GranteeUser, user.UserName, GranteeOrganization, user.Organization,
+	)
+}
+
+// validateKeyPermissions checks that every permission may be granted on a key
+func validateKeyPermissions(perms []KeyPermission) error {
+	for _, p := range perms {
+		known := false
+		for _, other := range AllKeyPermissions {
+			if p == other {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown key permission '%s'", p)
+		}
+	}
+	return nil
+}
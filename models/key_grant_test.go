@@ -0,0 +1,164 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestUserManager_KeyGrants(t *testing.T) {
+	db := newTestDB(t, &KeyGrant{})
+	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(IPNS{})
+	db.AutoMigrate(IPNSRevision{})
+	db.AutoMigrate(Organization{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(Zone{})
+	var (
+		um = NewUserManager(db)
+		om = NewOrgManager(db)
+		im = NewIPNSManager(db)
+	)
+	for _, name := range []string{"keyowner", "keygrantee", "keyorgowner"} {
+		user, err := um.NewUserAccount(name, "password123", name+"@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer um.DB.Unscoped().Delete(user)
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&Usage{})
+	}
+	org, err := om.NewOrganization("keyorg", "keyorgowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer om.DB.Unscoped().Delete(org)
+	member, err := om.RegisterOrgUser("keyorg", "keyorgmember", "password123", "keyorgmember@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(member)
+	defer um.DB.Unscoped().Where("user_name = ?", "keyorgmember").Delete(&Usage{})
+	key, err := um.NewIPFSKey("keyowner", "sharedkey", "keyowner-peer", IPFSKeyOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(key)
+	defer um.DB.Unscoped().Where("key_id = ?", key.ID).Delete(&KeyGrant{})
+	entry, err := im.CreateEntry("keyowner-peer", "QmHash", "sharedkey", "public", "keyowner", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer im.DB.Unscoped().Delete(entry)
+	defer im.DB.Unscoped().Where("ip_ns_hash = ?", "keyowner-peer").Delete(&IPNSRevision{})
+
+	if _, err := um.GrantKeyAccess("keyowner", "sharedkey", GranteeUser, "keyowner", []KeyPermission{KeyPermSignTNS}); err == nil {
+		t.Fatal("error expected granting to owner")
+	}
+	if _, err := um.GrantKeyAccess("keyowner", "sharedkey", GranteeUser, "notarealuser", []KeyPermission{KeyPermSignTNS}); err == nil {
+		t.Fatal("error expected granting to unknown user")
+	}
+	if _, err := um.GrantKeyAccess("keygrantee", "sharedkey", GranteeUser, "keyowner", []KeyPermission{KeyPermSignTNS}); err == nil {
+		t.Fatal("error expected granting a key that isn't owned")
+	}
+	if _, err := um.GrantKeyAccess("keyowner", "sharedkey", GranteeUser, "keygrantee", []KeyPermission{"delete-key"}); err == nil {
+		t.Fatal("error expected granting an unknown permission")
+	}
+	if _, err := um.GrantKeyAccess("keyowner", "sharedkey", GranteeUser, "keygrantee", []KeyPermission{KeyPermSignTNS}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.GrantKeyAccess("keyowner", "sharedkey", GranteeOrganization, "keyorg", []KeyPermission{KeyPermPublishIPNS}); err != nil {
+		t.Fatal(err)
+	}
+	type args struct {
+		username string
+		perm     KeyPermission
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{"Owner", args{"keyowner", KeyPermPublishIPNS}, true},
+		{"Grantee-Granted", args{"keygrantee", KeyPermSignTNS}, true},
+		{"Grantee-NotGranted", args{"keygrantee", KeyPermPublishIPNS}, false},
+		{"OrgMember", args{"keyorgmember", KeyPermPublishIPNS}, true},
+		{"OrgMember-NotGranted", args{"keyorgmember", KeyPermSignTNS}, false},
+		{"Unrelated", args{"keyorgowner", KeyPermSignTNS}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if can, err := um.CheckIfUserCanUseKey(tt.args.username, "keyowner-peer", tt.args.perm); err != nil {
+				t.Fatal(err)
+			} else if can != tt.want {
+				t.Fatalf("CheckIfUserCanUseKey() = %v, want %v", can, tt.want)
+			}
+			if can, err := um.CanUseKey(tt.args.username, "sharedkey", tt.args.perm); err != nil {
+				t.Fatal(err)
+			} else if can != tt.want {
+				t.Fatalf("CanUseKey() = %v, want %v", can, tt.want)
+			}
+			if tt.args.perm == KeyPermPublishIPNS {
+				if can, err := im.CheckIfUserCanPublish(tt.args.username, "keyowner-peer", "public"); err != nil {
+					t.Fatal(err)
+				} else if can != tt.want {
+					t.Fatalf("CheckIfUserCanPublish() = %v, want %v", can, tt.want)
+				}
+			}
+		})
+	}
+	// sharing a key doesn't make the grantee its owner
+	if owned, err := um.CheckIfKeyOwnedByUser("keygrantee", "sharedkey"); err != nil {
+		t.Fatal(err)
+	} else if owned {
+		t.Fatal("shared key should not be owned by grantee")
+	}
+	if _, err := um.GetKeyIDByName("keygrantee", "sharedkey"); err == nil {
+		t.Fatal("error expected looking up a key that isn't owned")
+	}
+	// zones may only be signed with keys shared for signing
+	zm := NewZoneManager(db)
+	zone, err := zm.NewZone("keygrantee", "sharedzone", "sharedkey", "sharedkey", "QmZone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(zone)
+	if _, err := zm.NewZone("keyorgmember", "sharedzone", "sharedkey", "sharedkey", "QmZone"); err == nil ||
+		err.Error() != ErrZoneKeyNotUsable {
+		t.Fatalf("expected zone key error, got %v", err)
+	}
+	if keys, err := um.FindSharedIPFSKeys("keyorgmember"); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 1 {
+		t.Fatalf("expected 1 shared key, got %v", len(keys))
+	}
+	if grants, err := um.GetKeyGrants("keyowner", "sharedkey"); err != nil {
+		t.Fatal(err)
+	} else if len(grants) != 2 {
+		t.Fatalf("expected 2 grants, got %v", len(grants))
+	}
+	if err := um.RevokeKeyAccess("keyowner", "sharedkey", GranteeUser, "keygrantee"); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.RevokeKeyAccess("keyowner", "sharedkey", GranteeUser, "keygrantee"); err == nil {
+		t.Fatal("error expected")
+	}
+	if can, err := um.CanUseKey("keygrantee", "sharedkey", KeyPermSignTNS); err != nil {
+		t.Fatal(err)
+	} else if can {
+		t.Fatal("revoked key should not be usable")
+	}
+	if _, err := zm.UpdateLatestIPFSHashForZone("sharedzone", "keygrantee", "QmZone2"); err == nil ||
+		err.Error() != ErrZoneKeyNotUsable {
+		t.Fatalf("expected zone key error, got %v", err)
+	}
+	// removing the key revokes the remaining grants
+	if err := um.RemoveIPFSKeyForUser("keyowner", "sharedkey", "keyowner-peer"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err := um.FindSharedIPFSKeys("keyorgmember"); err != nil {
+		t.Fatal(err)
+	} else if len(keys) != 0 {
+		t.Fatalf("expected no shared keys, got %v", len(keys))
+	}
+}
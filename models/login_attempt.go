@@ -0,0 +1,97 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// LoginSuccess indicates a sign-in attempt succeeded
+	LoginSuccess = "success"
+	// LoginUnknownAccount indicates no account matched the supplied username or email
+	LoginUnknownAccount = "unknown account"
+	// LoginInvalidPassword indicates an incorrect password was supplied
+	LoginInvalidPassword = "invalid password"
+	// LoginAccountDisabled indicates the account is disabled
+	LoginAccountDisabled = "account disabled"
+	// LoginAccountLocked indicates the account is locked due to too many failed attempts
+	LoginAccountLocked = "account locked"
+	// LoginSecondFactorRequired indicates the password was correct but a second factor is required
+	LoginSecondFactorRequired = "second factor required"
+	// LoginInvalidSecondFactor indicates an incorrect two-factor or recovery code was supplied
+	LoginInvalidSecondFactor = "invalid second factor"
+)
+
+// LoginAttempt is a record of a single sign-in attempt
+type LoginAttempt struct {
+	gorm.Model
+	// UserName is the account the attempt resolved to, empty if unknown
+	UserName string `gorm:"type:varchar(255);index"`
+	// Identifier is the username or email address supplied by the client
+	Identifier string `gorm:"type:varchar(255)"`
+	Success    bool   `gorm:"type:boolean"`
+	Reason     string `gorm:"type:varchar(255)"`
+	IPAddress  string `gorm:"type:varchar(255)"`
+}
+
+// LoginAttemptManager is used to manipulate login attempt records
+type LoginAttemptManager struct {
+	DB *gorm.DB
+}
+
+// NewLoginAttemptManager is used to generate our login attempt manager helper
+func NewLoginAttemptManager(db *gorm.DB) *LoginAttemptManager {
+	return &LoginAttemptManager{DB: db}
+}
+
+// RecordAttempt is used to store a sign-in attempt
+func (lm *LoginAttemptManager) RecordAttempt(username, identifier, ipAddress, reason string) (*LoginAttempt, error) {
+	attempt := &LoginAttempt{
+		UserName:   username,
+		Identifier: identifier,
+		Success:    reason == LoginSuccess,
+		Reason:     reason,
+		IPAddress:  ipAddress,
+	}
+	if err := lm.DB.Create(attempt).Error; err != nil {
+		return nil, err
+	}
+	return attempt, nil
+}
+
+// FindAttemptsByUser is used to find all sign-in attempts for an account since the given time
+func (lm *LoginAttemptManager) FindAttemptsByUser(username string, since time.Time) ([]LoginAttempt, error) {
+	var attempts []LoginAttempt
+	if err := lm.DB.Where(
+		"user_name = ? AND created_at >= ?", username, since,
+	).Order("created_at desc").Find(&attempts).Error; err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// FindFailedAttempts is used to find failed sign-in attempts for an account since
+// the given time. Attempts with a correct password that are waiting on a second
+// factor are not failures.
+func (lm *LoginAttemptManager) FindFailedAttempts(username string, since time.Time) ([]LoginAttempt, error) {
+	var attempts []LoginAttempt
+	if err := lm.DB.Where(
+		"user_name = ? AND success = ? AND reason <> ? AND created_at >= ?",
+		username, false, LoginSecondFactorRequired, since,
+	).Order("created_at desc").Find(&attempts).Error; err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// CountFailedCredentialAttempts is used to count how many times an incorrect
+// password or second factor has been supplied for an account since the given time
+func (lm *LoginAttemptManager) CountFailedCredentialAttempts(username string, since time.Time) (int, error) {
+	var count int
+	err := lm.DB.Model(&LoginAttempt{}).Where(
+		"user_name = ? AND reason IN (?) AND created_at > ?",
+		username, []string{LoginInvalidPassword, LoginInvalidSecondFactor}, since,
+	).Count(&count).Error
+	return count, err
+}
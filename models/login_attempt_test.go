@@ -0,0 +1,54 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginAttemptManager(t *testing.T) {
+	db := newTestDB(t, &LoginAttempt{})
+	defer db.Close()
+	var lm = NewLoginAttemptManager(db)
+	defer lm.DB.Unscoped().Where("identifier = ?", "attemptuser").Delete(&LoginAttempt{})
+	type args struct {
+		username string
+		reason   string
+	}
+	tests := []struct {
+		name        string
+		args        args
+		wantSuccess bool
+	}{
+		{"Success", args{"attemptuser", LoginSuccess}, true},
+		{"InvalidPassword", args{"attemptuser", LoginInvalidPassword}, false},
+		{"Locked", args{"attemptuser", LoginAccountLocked}, false},
+		{"Unknown", args{"", LoginUnknownAccount}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempt, err := lm.RecordAttempt(tt.args.username, "attemptuser", "127.0.0.1", tt.args.reason)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attempt.Success != tt.wantSuccess {
+				t.Fatalf("RecordAttempt success = %v, wantSuccess %v", attempt.Success, tt.wantSuccess)
+			}
+		})
+	}
+	since := time.Now().Add(-time.Minute)
+	if attempts, err := lm.FindAttemptsByUser("attemptuser", since); err != nil {
+		t.Fatal(err)
+	} else if len(attempts) != 3 {
+		t.Fatalf("expected 3 attempts, got %v", len(attempts))
+	}
+	if attempts, err := lm.FindFailedAttempts("attemptuser", since); err != nil {
+		t.Fatal(err)
+	} else if len(attempts) != 2 {
+		t.Fatalf("expected 2 failed attempts, got %v", len(attempts))
+	}
+	if count, err := lm.CountFailedCredentialAttempts("attemptuser", since); err != nil {
+		t.Fatal(err)
+	} else if count != 1 {
+		t.Fatalf("expected 1 failed credential attempt, got %v", count)
+	}
+}
@@ -0,0 +1,428 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// PayerUser indicates a network charge is paid from a user's credits
+	PayerUser = "user"
+	// PayerOrganization indicates a network charge is added to the amount owed by an organization
+	PayerOrganization = "organization"
+)
+
+var (
+	// NetworkCPUPricePerHour is the price of a cpu allocated to a network node for an hour
+	NetworkCPUPricePerHour = 0.02
+	// NetworkMemoryPricePerGBHour is the price of a gb of memory allocated to a network node for an hour
+	NetworkMemoryPricePerGBHour = 0.005
+	// NetworkDiskPricePerGBHour is the price of a gb of disk allocated to a network node for an hour
+	NetworkDiskPricePerGBHour = 0.10 / 730
+	// NetworkStoragePricePerGBHour is the price of a gb uploaded to a network for an hour
+	NetworkStoragePricePerGBHour = Paid.PricePerGBPerHour()
+)
+
+// NetworkMeter is the metered usage of a hosted network over a period, and
+// what that usage costs. Resources are metered for every hour a node of the
+// network is up, storage for every hour each upload was kept in the period.
+type NetworkMeter struct {
+	NodeHours     float64
+	CPUHours      float64
+	MemoryGBHours float64
+	DiskGBHours   float64
+	// StorageBytes is the size of the network's uploads at the end of the period
+	StorageBytes   int64
+	StorageGBHours float64
+	ComputeCost    float64
+	StorageCost    float64
+}
+
+// Total returns the cost of the metered usage
+func (m NetworkMeter) Total() float64 {
+	return m.ComputeCost + m.StorageCost
+}
+
+// NetworkCharge is the amount billed for a hosted network over a period.
+// A charge is settled once it has been paid by its payer, or uncollectable
+// if it has no payer or its payer was deleted before it could be paid.
+// Charges are kept after their network is deleted.
+type NetworkCharge struct {
+	gorm.Model
+	NetworkName string    `gorm:"type:varchar(255);index;unique_index:idx_network_charge_period"`
+	PeriodStart time.Time `gorm:"unique_index:idx_network_charge_period"`
+	PeriodEnd   time.Time
+	NetworkMeter
+	Amount float64
+	// PayerType is PayerUser or PayerOrganization
+	PayerType       string `gorm:"type:varchar(255)"`
+	Payer           string `gorm:"type:varchar(255)"`
+	SettledAt       *time.Time
+	UncollectableAt *time.Time
+}
+
+// NetworkCostReport summarizes the usage and charges of a network over a period
+type NetworkCostReport struct {
+	NetworkName string
+	Since       time.Time
+	Until       time.Time
+	// Usage is metered from the network's history, whether charged yet or not
+	Usage   NetworkMeter
+	Uploads int
+	// Charged is the total of charges for periods ending within the report,
+	// of which Outstanding has not been settled yet
+	Charged     float64
+	Outstanding float64
+	Charges     []NetworkCharge
+}
+
+// MeterNetwork is used to meter the usage of a network between two times.
+// Until its first node is registered, a network is metered as a single node
+// with its own resources for as long as the network itself was up. Each
+// registered node, including removed ones, is then metered with its own
+// resources for as long as its status history shows it up, so that
+// registering nodes doesn't change the usage of earlier periods.
+func (im *HostedNetworkManager) MeterNetwork(name string, since, until time.Time) (*NetworkMeter, error) {
+	if until.Before(since) {
+		return nil, errors.New("until must not be before since")
+	}
+	pnet, err := im.GetNetworkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	var nodes []NetworkNode
+	if err := im.DB.Unscoped().Where(
+		"network_name = ? AND created_at < ?", name, until,
+	).Order("created_at asc, id asc").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	meter := &NetworkMeter{}
+	add := func(uptime time.Duration, r NetworkResources) {
+		hours := uptime.Hours()
+		meter.NodeHours += hours
+		meter.CPUHours += hours * float64(r.CPUs)
+		meter.MemoryGBHours += hours * float64(r.MemoryGB)
+		meter.DiskGBHours += hours * float64(r.DiskGB)
+	}
+	firstNode := until
+	if len(nodes) > 0 {
+		firstNode = nodes[0].CreatedAt
+	}
+	if firstNode.After(since) {
+		uptime, err := im.GetNetworkUptime(name, since, firstNode)
+		if err != nil {
+			return nil, err
+		}
+		add(uptime, networkResources(pnet))
+	}
+	for i := range nodes {
+		uptime, err := im.GetNodeUptime(&nodes[i], since, until)
+		if err != nil {
+			return nil, err
+		}
+		add(uptime, NetworkResources{
+			CPUs:     nodes[i].ResourcesCPUs,
+			DiskGB:   nodes[i].ResourcesDiskGB,
+			MemoryGB: nodes[i].ResourcesMemoryGB,
+		})
+	}
+	if meter.StorageBytes, _, err = im.networkStorage(name, until); err != nil {
+		return nil, err
+	}
+	byteSeconds, err := im.networkStorageTime(name, since, until)
+	if err != nil {
+		return nil, err
+	}
+	meter.StorageGBHours = byteSeconds / float64(datasize.GB.Bytes()) / time.Hour.Seconds()
+	meter.ComputeCost = meter.CPUHours*NetworkCPUPricePerHour +
+		meter.MemoryGBHours*NetworkMemoryPricePerGBHour +
+		meter.DiskGBHours*NetworkDiskPricePerGBHour
+	meter.StorageCost = meter.StorageGBHours * NetworkStoragePricePerGBHour
+	return meter, nil
+}
+
+// ChargeNetworks is used to bill every network for its usage since it was
+// last charged, up until the given time, and is intended to be run on a
+// schedule. Each charge is paid by the organization of the network owner,
+// or from the owner's credits if they don't belong to one. Charges which
+// couldn't be paid, such as when an owner is out of credits, are retried
+// on every run, unless they have no payer or their payer no longer exists.
+// It returns the charges created by this run.
+func (im *HostedNetworkManager) ChargeNetworks(until time.Time) ([]NetworkCharge, error) {
+	var names []string
+	if err := im.DB.Model(&HostedNetwork{}).Where(
+		"created_at < ?", until,
+	).Order("name asc").Pluck("name", &names).Error; err != nil {
+		return nil, err
+	}
+	var charges []NetworkCharge
+	for _, name := range names {
+		charge, err := im.chargeNetwork(name, until)
+		if err != nil {
+			return nil, err
+		}
+		if charge != nil {
+			charges = append(charges, *charge)
+		}
+	}
+	var unsettled []NetworkCharge
+	if err := im.DB.Where(
+		"settled_at IS NULL AND uncollectable_at IS NULL",
+	).Order("id asc").Find(&unsettled).Error; err != nil {
+		return nil, err
+	}
+	for _, charge := range unsettled {
+		if err := im.settleNetworkCharge(charge.ID); err != nil {
+			return nil, err
+		}
+	}
+	// return the settlement of this run's charges
+	for i := range charges {
+		if err := im.DB.First(&charges[i], charges[i].ID).Error; err != nil {
+			return nil, err
+		}
+	}
+	return charges, nil
+}
+
+// GetNetworkCharges is used to return every charge of a network, oldest first
+func (im *HostedNetworkManager) GetNetworkCharges(network string) ([]NetworkCharge, error) {
+	var charges []NetworkCharge
+	if err := im.DB.Where("network_name = ?", network).Order(
+		"period_start asc, id asc",
+	).Find(&charges).Error; err != nil {
+		return nil, err
+	}
+	return charges, nil
+}
+
+// GetNetworkCostReport is used to report the usage and charges of a network between two times
+func (im *HostedNetworkManager) GetNetworkCostReport(network string, since, until time.Time) (*NetworkCostReport, error) {
+	usage, err := im.MeterNetwork(network, since, until)
+	if err != nil {
+		return nil, err
+	}
+	report := &NetworkCostReport{
+		NetworkName: network,
+		Since:       since,
+		Until:       until,
+		Usage:       *usage,
+	}
+	if _, report.Uploads, err = im.networkStorage(network, until); err != nil {
+		return nil, err
+	}
+	if err := im.DB.Where(
+		"network_name = ? AND period_end > ? AND period_end <= ?", network, since, until,
+	).Order("period_start asc, id asc").Find(&report.Charges).Error; err != nil {
+		return nil, err
+	}
+	for _, charge := range report.Charges {
+		report.Charged += charge.Amount
+		if charge.SettledAt == nil {
+			report.Outstanding += charge.Amount
+		}
+	}
+	return report, nil
+}
+
+// chargeNetwork records a charge for a network's usage since its last
+// charge, returning nil if there is no period left to charge
+func (im *HostedNetworkManager) chargeNetwork(name string, until time.Time) (*NetworkCharge, error) {
+	pnet := &HostedNetwork{}
+	if err := im.DB.Where("name = ?", name).First(pnet).Error; err != nil {
+		return nil, err
+	}
+	start := pnet.CreatedAt
+	last := &NetworkCharge{}
+	if err := im.DB.Where("network_name = ?", name).Order(
+		"period_end desc",
+	).First(last).Error; err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	} else if err == nil && last.PeriodEnd.After(start) {
+		// charges of a deleted network with the same name are ignored
+		start = last.PeriodEnd
+	}
+	if !until.After(start) {
+		return nil, nil
+	}
+	meter, err := im.MeterNetwork(name, start, until)
+	if err != nil {
+		return nil, err
+	}
+	charge := &NetworkCharge{
+		NetworkName:  name,
+		PeriodStart:  start,
+		PeriodEnd:    until,
+		NetworkMeter: *meter,
+		Amount:       meter.Total(),
+	}
+	owners, err := im.GetNetworkOwners(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(owners) > 0 {
+		if charge.PayerType, charge.Payer, err = networkPayer(im.DB, owners[0]); err != nil {
+			return nil, err
+		}
+	}
+	if err := im.DB.Create(charge).Error; err != nil {
+		return nil, err
+	}
+	return charge, nil
+}
+
+// settleNetworkCharge pays an unsettled charge, leaving it unsettled if the
+// payer can't afford it. A charge without a payer, as its network had no
+// owner, or whose payer no longer exists is marked uncollectable, so that it
+// is no longer retried and doesn't stop other charges from being settled.
+func (im *HostedNetworkManager) settleNetworkCharge(id uint) error {
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		charge := &NetworkCharge{}
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"settled_at IS NULL AND uncollectable_at IS NULL",
+		).First(charge, id).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				return nil
+			}
+			return err
+		}
+		var paid bool
+		switch {
+		case charge.Amount <= 0:
+			paid = true
+		case charge.PayerType == PayerOrganization:
+			org := &Organization{}
+			if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+				"name = ?", charge.Payer,
+			).First(org).Error; err == gorm.ErrRecordNotFound {
+				return markNetworkChargeUncollectable(tx, charge)
+			} else if err != nil {
+				return err
+			}
+			owed := org.AmountOwed + charge.Amount
+			if err := tx.Model(org).UpdateColumn("amount_owed", owed).Error; err != nil {
+				return err
+			}
+			if err := recordAudit(tx, AuditOrgAmountOwedChanged, AuditSubjectOrganization, org.Name,
+				map[string]interface{}{"amount_owed": org.AmountOwed},
+				map[string]interface{}{"amount_owed": owed, "network_charge": charge.ID},
+			); err != nil {
+				return err
+			}
+			paid = true
+		case charge.PayerType == PayerUser:
+			user := &User{}
+			if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+				"user_name = ?", charge.Payer,
+			).First(user).Error; err == gorm.ErrRecordNotFound {
+				return markNetworkChargeUncollectable(tx, charge)
+			} else if err != nil {
+				return err
+			}
+			if user.Credits < charge.Amount {
+				break
+			}
+			credits := user.Credits - charge.Amount
+			if err := tx.Model(user).UpdateColumn("credits", credits).Error; err != nil {
+				return err
+			}
+			if err := recordAudit(tx, AuditUserCreditsChanged, AuditSubjectUser, user.UserName,
+				map[string]interface{}{"credits": user.Credits},
+				map[string]interface{}{"credits": credits, "network_charge": charge.ID},
+			); err != nil {
+				return err
+			}
+			paid = true
+		default:
+			return markNetworkChargeUncollectable(tx, charge)
+		}
+		if !paid {
+			return nil
+		}
+		if err := tx.Model(charge).UpdateColumn("settled_at", time.Now()).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkCharged, AuditSubjectNetwork, charge.NetworkName, nil, networkChargeSnapshot(charge))
+	})
+}
+
+// markNetworkChargeUncollectable records that a charge can't be paid
+// because it has no payer, or its payer no longer exists
+func markNetworkChargeUncollectable(tx *gorm.DB, charge *NetworkCharge) error {
+	if err := tx.Model(charge).UpdateColumn("uncollectable_at", time.Now()).Error; err != nil {
+		return err
+	}
+	return recordAudit(tx, AuditNetworkChargeUncollectable, AuditSubjectNetwork, charge.NetworkName, nil,
+		networkChargeSnapshot(charge),
+	)
+}
+
+// networkChargeSnapshot returns the audited fields of a charge
+func networkChargeSnapshot(charge *NetworkCharge) map[string]interface{} {
+	return map[string]interface{}{
+		"charge":       charge.ID,
+		"period_start": charge.PeriodStart,
+		"period_end":   charge.PeriodEnd,
+		"amount":       charge.Amount,
+		"payer_type":   charge.PayerType,
+		"payer":        charge.Payer,
+	}
+}
+
+// networkStorage returns the total size and number of uploads to a network
+// that were kept at the given time, including those removed since
+func (im *HostedNetworkManager) networkStorage(network string, at time.Time) (int64, int, error) {
+	var (
+		size  int64
+		count int
+	)
+	if err := im.DB.Unscoped().Model(&Upload{}).Select("coalesce(sum(size), 0), count(*)").Where(
+		"network_name = ? AND created_at < ? AND (deleted_at IS NULL OR deleted_at >= ?)", network, at, at,
+	).Row().Scan(&size, &count); err != nil {
+		return 0, 0, err
+	}
+	return size, count, nil
+}
+
+// networkStorageTime returns the byte seconds of storage used by a network
+// between two times, integrating the size of each upload, including removed
+// ones, over the part of the period it was kept
+func (im *HostedNetworkManager) networkStorageTime(network string, since, until time.Time) (float64, error) {
+	var byteSeconds float64
+	if err := im.DB.Unscoped().Model(&Upload{}).Select(
+		"coalesce(sum(size * extract(epoch from least(coalesce(deleted_at, ?), ?) - greatest(created_at, ?))), 0)",
+		until, until, since,
+	).Where(
+		"network_name = ? AND created_at < ? AND (deleted_at IS NULL OR deleted_at > ?)", network, until, since,
+	).Row().Scan(&byteSeconds); err != nil {
+		return 0, err
+	}
+	return byteSeconds, nil
+}
+
+// networkPayer returns who pays for the networks of a user: the
+// organization the user belongs to or owns, otherwise the user
+func networkPayer(db *gorm.DB, username string) (string, string, error) {
+	var member []string
+	if err := db.Model(&User{}).Where(
+		"user_name = ? AND organization <> ''", username,
+	).Pluck("organization", &member).Error; err != nil {
+		return "", "", err
+	}
+	if len(member) > 0 {
+		return PayerOrganization, member[0], nil
+	}
+	var owned []string
+	if err := db.Model(&Organization{}).Where(
+		"account_owner = ?", username,
+	).Pluck("name", &owned).Error; err != nil {
+		return "", "", err
+	}
+	if len(owned) > 0 {
+		return PayerOrganization, owned[0], nil
+	}
+	return PayerUser, username, nil
+}
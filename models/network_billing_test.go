@@ -0,0 +1,237 @@
+package models
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/jinzhu/gorm"
+)
+
+func TestHostedNetworkManager_ChargeNetworks(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(Organization{})
+	db.AutoMigrate(Upload{})
+	db.AutoMigrate(NetworkCharge{})
+	var (
+		hm = NewHostedNetworkManager(db)
+		um = NewUserManager(db)
+	)
+	owner, err := um.NewUserAccount("billingowner", "password123", "billingowner@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(owner)
+	defer um.DB.Unscoped().Where("user_name = ?", "billingowner").Delete(&Usage{})
+	network, err := hm.CreateHostedPrivateNetwork("billingnetwork", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "billingowner",
+		Resources: NetworkResources{CPUs: 2, DiskGB: 10, MemoryGB: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("billingnetwork")
+	defer db.Unscoped().Where("network_name = ?", "billingnetwork").Delete(&NetworkCharge{})
+	// the network is up for 4 of the first 10 hours after it was created
+	start := network.CreatedAt
+	for _, transition := range []struct {
+		at    time.Duration
+		state NetworkState
+	}{
+		{time.Hour, NetworkOnline},
+		{5 * time.Hour, NetworkStopped},
+	} {
+		if err := db.Create(&NetworkStateTransition{
+			Model:       gorm.Model{CreatedAt: start.Add(transition.at)},
+			NetworkName: "billingnetwork",
+			ToState:     transition.state,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// storage is metered for as long as each upload was kept, including
+	// uploads that have since been removed
+	upload := &Upload{
+		Model:       gorm.Model{CreatedAt: start},
+		Hash:        "billinghash",
+		Type:        "file",
+		NetworkName: "billingnetwork",
+		UserName:    "billingowner",
+		Size:        int64(datasize.GB.Bytes()),
+	}
+	removedAt := start.Add(4 * time.Hour)
+	removed := &Upload{
+		Model:       gorm.Model{CreatedAt: start.Add(2 * time.Hour), DeletedAt: &removedAt},
+		Hash:        "billingremoved",
+		Type:        "file",
+		NetworkName: "billingnetwork",
+		UserName:    "billingowner",
+		Size:        int64(datasize.GB.Bytes()),
+	}
+	for _, u := range []*Upload{upload, removed} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+		defer db.Unscoped().Delete(u)
+	}
+	until := start.Add(10 * time.Hour)
+	meter, err := hm.MeterNetwork("billingnetwork", start, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meter.NodeHours != 4 || meter.CPUHours != 8 || meter.MemoryGBHours != 16 || meter.DiskGBHours != 40 {
+		t.Fatalf("unexpected resource usage %+v", meter)
+	}
+	if meter.StorageBytes != upload.Size || math.Abs(meter.StorageGBHours-12) > 1e-6 {
+		t.Fatalf("unexpected storage usage %+v", meter)
+	}
+	if early, err := hm.MeterNetwork("billingnetwork", start, start.Add(3*time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if early.StorageBytes != 2*upload.Size || math.Abs(early.StorageGBHours-4) > 1e-6 {
+		t.Fatalf("unexpected storage usage %+v", early)
+	}
+	// the owner can't pay yet, so the charge is left unsettled
+	charges, err := hm.ChargeNetworks(until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	charge := findNetworkCharge(charges, "billingnetwork")
+	if charge == nil {
+		t.Fatal("network should have been charged")
+	}
+	if charge.SettledAt != nil || charge.PayerType != PayerUser || charge.Payer != "billingowner" {
+		t.Fatalf("unexpected charge %+v", charge)
+	}
+	if math.Abs(charge.Amount-meter.Total()) > 1e-9 {
+		t.Fatalf("expected amount %v, got %v", meter.Total(), charge.Amount)
+	}
+	if _, err := um.AddCredits("billingowner", 100); err != nil {
+		t.Fatal(err)
+	}
+	// the period has already been charged, but the outstanding charge is paid
+	charges, err = hm.ChargeNetworks(until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if findNetworkCharge(charges, "billingnetwork") != nil {
+		t.Fatal("network should not be charged twice for a period")
+	}
+	credits, err := um.GetCreditsForUser("billingowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(credits-(100-charge.Amount)) > 1e-9 {
+		t.Fatalf("unexpected credits %v", credits)
+	}
+	report, err := hm.GetNetworkCostReport("billingnetwork", start, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Uploads != 1 || len(report.Charges) != 1 || report.Outstanding != 0 ||
+		math.Abs(report.Charged-charge.Amount) > 1e-9 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// a period may only be charged once
+	if err := db.Create(&NetworkCharge{
+		NetworkName: "billingnetwork",
+		PeriodStart: charge.PeriodStart,
+		PeriodEnd:   charge.PeriodEnd,
+	}).Error; err == nil {
+		t.Fatal("error expected")
+	}
+	// charges whose payer is gone don't stop other charges from settling
+	orphaned := &NetworkCharge{
+		NetworkName: "billingnetwork",
+		PeriodStart: until.Add(time.Hour),
+		PeriodEnd:   until.Add(time.Hour),
+		Amount:      1,
+		PayerType:   PayerOrganization,
+		Payer:       "deletedbillingorg",
+	}
+	if err := db.Create(orphaned).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hm.ChargeNetworks(until); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(orphaned, orphaned.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if orphaned.SettledAt != nil || orphaned.UncollectableAt == nil {
+		t.Fatalf("unexpected orphaned charge %+v", orphaned)
+	}
+	if err := db.Unscoped().Delete(orphaned).Error; err != nil {
+		t.Fatal(err)
+	}
+	// as are charges without a payer, made while a network had no owner
+	unowned := &NetworkCharge{
+		NetworkName: "billingnetwork",
+		PeriodStart: until.Add(2 * time.Hour),
+		PeriodEnd:   until.Add(2 * time.Hour),
+		Amount:      1,
+	}
+	if err := db.Create(unowned).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(unowned)
+	if _, err := hm.ChargeNetworks(until); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(unowned, unowned.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if unowned.SettledAt != nil || unowned.UncollectableAt == nil {
+		t.Fatalf("unexpected charge without a payer %+v", unowned)
+	}
+	// registering nodes doesn't change the usage of earlier periods
+	if _, err := hm.AddNetworkNode("billingnetwork", NetworkNodeOptions{
+		PeerID:    "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT",
+		Resources: NetworkResources{CPUs: 1, DiskGB: 10, MemoryGB: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&NetworkNode{}).Where(
+		"network_name = ?", "billingnetwork",
+	).UpdateColumn("created_at", until).Error; err != nil {
+		t.Fatal(err)
+	}
+	if metered, err := hm.MeterNetwork("billingnetwork", start, until); err != nil {
+		t.Fatal(err)
+	} else if metered.NodeHours != meter.NodeHours || metered.CPUHours != meter.CPUHours {
+		t.Fatalf("expected usage %+v, got %+v", meter, metered)
+	}
+	// deleting a network charges it for the rest of its usage
+	deleted, err := hm.CreateHostedPrivateNetwork("billingdeleted", testSwarmKey, nil, NetworkAccessOptions{
+		Owner: "billingowner",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Where("network_name = ?", "billingdeleted").Delete(&NetworkCharge{})
+	created := deleted.CreatedAt.Add(-2 * time.Hour).Round(time.Microsecond)
+	if err := db.Model(deleted).UpdateColumn("created_at", created).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.Delete("billingdeleted"); err != nil {
+		t.Fatal(err)
+	}
+	if charges, err := hm.GetNetworkCharges("billingdeleted"); err != nil {
+		t.Fatal(err)
+	} else if len(charges) != 1 || !charges[0].PeriodStart.Equal(created) || charges[0].SettledAt == nil {
+		t.Fatalf("unexpected charges after delete %+v", charges)
+	}
+}
+
+func findNetworkCharge(charges []NetworkCharge, network string) *NetworkCharge {
+	for i := range charges {
+		if charges[i].NetworkName == network {
+			return &charges[i]
+		}
+	}
+	return nil
+}
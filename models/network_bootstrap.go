@@ -0,0 +1,119 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// AddBootstrapPeer is used to add a peer for a network's nodes to bootstrap
+// onto. The address must be a multiaddr including the peer ID, and the peer
+// must not already be a bootstrap peer of the network.
+func (im *HostedNetworkManager) AddBootstrapPeer(network, peerAddr string) error {
+	return im.updateBootstrapPeers(network, func(addrs []string) ([]string, error) {
+		return append(addrs, peerAddr), nil
+	})
+}
+
+// RemoveBootstrapPeer is used to remove the bootstrap peer with the given peer ID from a network
+func (im *HostedNetworkManager) RemoveBootstrapPeer(network, peerID string) error {
+	return im.updateBootstrapPeers(network, func(addrs []string) ([]string, error) {
+		_, ids, err := parseBootstrapPeers(addrs)
+		if err != nil {
+			return nil, err
+		}
+		var kept []string
+		for i, id := range ids {
+			if id != peerID {
+				kept = append(kept, addrs[i])
+			}
+		}
+		if len(kept) == len(addrs) {
+			return nil, errors.New("peer is not a bootstrap peer of this network")
+		}
+		return kept, nil
+	})
+}
+
+// ReplaceBootstrapPeers is used to replace every bootstrap peer of a network
+func (im *HostedNetworkManager) ReplaceBootstrapPeers(network string, peerAddrs []string) error {
+	return im.updateBootstrapPeers(network, func([]string) ([]string, error) {
+		return peerAddrs, nil
+	})
+}
+
+// updateBootstrapPeers locks a network while change computes its new
+// bootstrap peer addresses, then validates and stores them along with their
+// peer IDs
+func (im *HostedNetworkManager) updateBootstrapPeers(network string, change func([]string) ([]string, error)) error {
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		pnet := &HostedNetwork{}
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"name = ?", network,
+		).First(pnet).Error; err != nil {
+			return err
+		}
+		before := []string(pnet.BootstrapPeerAddresses)
+		updated, err := change(append([]string(nil), before...))
+		if err != nil {
+			return err
+		}
+		addrs, ids, err := parseBootstrapPeers(updated)
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(pnet).UpdateColumns(map[string]interface{}{
+			"bootstrap_peer_addresses": addrs,
+			"bootstrap_peer_ids":       ids,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkUpdated, AuditSubjectNetwork, network,
+			map[string]interface{}{"bootstrap_peer_addresses": before},
+			map[string]interface{}{"bootstrap_peer_addresses": addrs},
+		)
+	})
+}
+
+// parseBootstrapPeers validates bootstrap peer multiaddrs, returning the
+// formatted addresses along with their peer IDs. Every address must include
+// a peer ID, and each peer may only be given once.
+func parseBootstrapPeers(peers []string) (pq.StringArray, pq.StringArray, error) {
+	var (
+		addrs = pq.StringArray{}
+		ids   = pq.StringArray{}
+		seen  = make(map[string]bool, len(peers))
+	)
+	for _, v := range peers {
+		// parse peer address
+		addr, err := utils.GenerateMultiAddrFromString(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		valid, err := utils.ParseMultiAddrForIPFSPeer(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !valid {
+			return nil, nil, fmt.Errorf("provided peer '%s' is not a valid bootstrap peer", addr)
+		}
+
+		// parse peer ID
+		peerID, err := utils.ParsePeerIDFromIPFSMultiAddr(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[peerID] {
+			return nil, nil, fmt.Errorf("peer '%s' is already a bootstrap peer", peerID)
+		}
+		seen[peerID] = true
+
+		// register peer
+		addrs = append(addrs, addr.String())
+		ids = append(ids, peerID)
+	}
+	return addrs, ids, nil
+}
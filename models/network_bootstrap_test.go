@@ -0,0 +1,91 @@
+package models
+
+import "testing"
+
+const (
+	testBootstrapPeer1 = "/ip4/192.168.1.242/tcp/4001/ipfs/QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT"
+	testBootstrapPeer2 = "/ip4/192.168.1.243/tcp/4001/ipfs/QmPvnFXWAz1eSghXD6JKpHxaGjbVo4VhBXY2wdBxKPbne5"
+)
+
+func Test_parseBootstrapPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		peers   []string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"valid", []string{testBootstrapPeer1, testBootstrapPeer2}, false},
+		{"invalid multiaddr", []string{"notamultiaddr"}, true},
+		{"missing peer id", []string{"/ip4/192.168.1.242/tcp/4001"}, true},
+		{"duplicate peer id", []string{
+			testBootstrapPeer1,
+			"/ip4/10.0.0.1/tcp/4001/ipfs/QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT",
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, ids, err := parseBootstrapPeers(tt.peers)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseBootstrapPeers() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(addrs) != len(ids) {
+				t.Fatal("addresses and peer ids should be the same length")
+			}
+		})
+	}
+}
+
+func TestHostedNetworkManager_BootstrapPeers(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(db)
+	if _, err := hm.CreateHostedPrivateNetwork(
+		"bootstrapnetwork", testSwarmKey, []string{testBootstrapPeer1},
+		NetworkAccessOptions{Owner: "bootstrapowner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("bootstrapnetwork")
+	if err := hm.AddBootstrapPeer("bootstrapnetwork", testBootstrapPeer1); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.AddBootstrapPeer("bootstrapnetwork", "/ip4/192.168.1.243/tcp/4001"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.AddBootstrapPeer("bootstrapnetwork", testBootstrapPeer2); err != nil {
+		t.Fatal(err)
+	}
+	network, err := hm.GetNetworkByName("bootstrapnetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(network.BootstrapPeerAddresses) != 2 || len(network.BootstrapPeerIDs) != 2 ||
+		network.BootstrapPeerIDs[1] != "QmPvnFXWAz1eSghXD6JKpHxaGjbVo4VhBXY2wdBxKPbne5" {
+		t.Fatalf("unexpected bootstrap peers %v %v", network.BootstrapPeerAddresses, network.BootstrapPeerIDs)
+	}
+	if err := hm.RemoveBootstrapPeer("bootstrapnetwork", "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.RemoveBootstrapPeer("bootstrapnetwork", "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.ReplaceBootstrapPeers("bootstrapnetwork", []string{testBootstrapPeer1, testBootstrapPeer1}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.ReplaceBootstrapPeers("bootstrapnetwork", []string{testBootstrapPeer1}); err != nil {
+		t.Fatal(err)
+	}
+	network, err = hm.GetNetworkByName("bootstrapnetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(network.BootstrapPeerIDs) != 1 ||
+		network.BootstrapPeerIDs[0] != "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT" {
+		t.Fatalf("unexpected bootstrap peers %v", network.BootstrapPeerIDs)
+	}
+	if err := hm.UpdateNetworkByName("bootstrapnetwork", map[string]interface{}{
+		"bootstrap_peer_addresses": []string{"notamultiaddr"},
+	}); err == nil {
+		t.Fatal("error expected")
+	}
+}
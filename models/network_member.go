@@ -0,0 +1,202 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// NetworkRoleOwner is allowed to administer a hosted network, such as destroying it
+	NetworkRoleOwner = "owner"
+	// NetworkRoleUser is allowed to use a network, including API access
+	NetworkRoleUser = "user"
+
+	// ErrNetworkRenamed is an error triggered when changing the name of a
+	// network, which its memberships and history are recorded against
+	ErrNetworkRenamed = "network name can not be changed"
+)
+
+// NetworkMember grants a user access to a private network. Membership is
+// removed by deleting the row, the audit log records who granted and removed it.
+type NetworkMember struct {
+	gorm.Model
+	UserName    string `gorm:"type:varchar(255);unique_index:idx_network_member"`
+	NetworkName string `gorm:"type:varchar(255);unique_index:idx_network_member;index"`
+	Role        string `gorm:"type:varchar(255)"`
+	GrantedBy   string `gorm:"type:varchar(255)"`
+}
+
+// AddNetworkMember is used to give a user access to a network with the given role
+func (im *HostedNetworkManager) AddNetworkMember(network, username, role string) (*NetworkMember, error) {
+	return addNetworkMember(im.DB, network, username, role)
+}
+
+// RemoveNetworkMember is used to remove a user's access to a network
+func (im *HostedNetworkManager) RemoveNetworkMember(network, username string) error {
+	member := &NetworkMember{}
+	if err := im.DB.Where(
+		"network_name = ? AND user_name = ?", network, username,
+	).First(member).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return errors.New("user was not registered for this network")
+		}
+		return err
+	}
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(member).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserNetworkRemoved, AuditSubjectUser, username,
+			map[string]interface{}{"network_name": network, "role": member.Role}, nil)
+	})
+}
+
+// GetNetworkMembers is used to return every member of a network
+func (im *HostedNetworkManager) GetNetworkMembers(network string) ([]NetworkMember, error) {
+	var members []NetworkMember
+	if err := im.DB.Where("network_name = ?", network).Order(
+		"created_at asc",
+	).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+// GetNetworkOwners is used to return the names of the owners of a network
+func (im *HostedNetworkManager) GetNetworkOwners(network string) ([]string, error) {
+	var owners []string
+	err := im.DB.Model(&NetworkMember{}).Where(
+		"network_name = ? AND role = ?", network, NetworkRoleOwner,
+	).Order("created_at asc").Pluck("user_name", &owners).Error
+	return owners, err
+}
+
+// CheckIfUserIsNetworkOwner is used to check if a user is allowed to administer a network
+func (im *HostedNetworkManager) CheckIfUserIsNetworkOwner(network, username string) (bool, error) {
+	var count int
+	err := im.DB.Model(&NetworkMember{}).Where(
+		"network_name = ? AND user_name = ? AND role = ?", network, username, NetworkRoleOwner,
+	).Count(&count).Error
+	return count > 0, err
+}
+
+// MigrateNetworkMembership is used to move network access stored in the
+// legacy User.IPFSNetworkNames, HostedNetwork.Users and HostedNetwork.Owners
+// arrays into the NetworkMember table. Owners are given the owner role even
+// if they are also listed as users. The arrays are emptied once migrated so
+// that memberships removed afterwards are not restored.
+func (im *HostedNetworkManager) MigrateNetworkMembership() error {
+	var networks []HostedNetwork
+	if err := im.DB.Where(
+		"array_length(owners, 1) > 0 OR array_length(users, 1) > 0",
+	).Find(&networks).Error; err != nil {
+		return err
+	}
+	for _, n := range networks {
+		if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+			if err := migrateNetworkMembers(tx, n.Name, n.Owners, n.Users); err != nil {
+				return err
+			}
+			return tx.Model(&n).UpdateColumns(map[string]interface{}{
+				"owners": gorm.Expr("'{}'"),
+				"users":  gorm.Expr("'{}'"),
+			}).Error
+		}); err != nil {
+			return err
+		}
+	}
+	var users []User
+	if err := im.DB.Where(
+		"array_length(ipfs_network_names, 1) > 0",
+	).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+			for _, network := range u.IPFSNetworkNames {
+				if err := migrateNetworkMembers(tx, network, nil, []string{u.UserName}); err != nil {
+					return err
+				}
+			}
+			return tx.Model(&u).UpdateColumn(
+				"ipfs_network_names", gorm.Expr("'{}'"),
+			).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addNetworkMember creates a membership, attributing it to the actor attached to db
+func addNetworkMember(db *gorm.DB, network, username, role string) (*NetworkMember, error) {
+	if role != NetworkRoleOwner && role != NetworkRoleUser {
+		return nil, errors.New("unsupported network role")
+	}
+	var count int
+	if err := db.Model(&NetworkMember{}).Where(
+		"network_name = ? AND user_name = ?", network, username,
+	).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("network already configured for user")
+	}
+	member := &NetworkMember{
+		UserName:    username,
+		NetworkName: network,
+		Role:        role,
+		GrantedBy:   ActorFrom(db),
+	}
+	if err := withTransaction(db, func(tx *gorm.DB) error {
+		if err := tx.Create(member).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserNetworkAdded, AuditSubjectUser, username,
+			nil, map[string]interface{}{"network_name": network, "role": role},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// migrateNetworkMembers creates memberships that don't exist yet, upgrading
+// existing users to owners where needed
+func migrateNetworkMembers(db *gorm.DB, network string, owners, users []string) error {
+	for _, username := range owners {
+		if err := migrateNetworkMember(db, network, username, NetworkRoleOwner); err != nil {
+			return err
+		}
+	}
+	for _, username := range users {
+		if err := migrateNetworkMember(db, network, username, NetworkRoleUser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateNetworkMember creates a single membership if it doesn't exist, upgrading
+// an existing user to an owner where needed
+func migrateNetworkMember(db *gorm.DB, network, username, role string) error {
+	member := &NetworkMember{}
+	err := db.Where("network_name = ? AND user_name = ?", network, username).First(member).Error
+	switch err {
+	case nil:
+		if role == NetworkRoleOwner && member.Role != NetworkRoleOwner {
+			return db.Model(member).Update("role", NetworkRoleOwner).Error
+		}
+		return nil
+	case gorm.ErrRecordNotFound:
+		return db.Create(&NetworkMember{
+			UserName:    username,
+			NetworkName: network,
+			Role:        role,
+			GrantedBy:   SystemActor,
+		}).Error
+	default:
+		return err
+	}
+}
@@ -0,0 +1,133 @@
+package models
+
+import "testing"
+
+func TestHostedNetworkManager_NetworkMembers(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(WithActor(db, "memberadmin"))
+	if _, err := hm.CreateHostedPrivateNetwork(
+		"membernetwork", testSwarmKey, nil,
+		NetworkAccessOptions{Owner: "memberowner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("membernetwork")
+	if _, err := hm.AddNetworkMember("membernetwork", "memberuser", "notarealrole"); err == nil {
+		t.Fatal("error expected")
+	}
+	member, err := hm.AddNetworkMember("membernetwork", "memberuser", NetworkRoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member.GrantedBy != "memberadmin" {
+		t.Fatalf("unexpected granter %s", member.GrantedBy)
+	}
+	if _, err := hm.AddNetworkMember("membernetwork", "memberuser", NetworkRoleOwner); err == nil {
+		t.Fatal("error expected")
+	}
+	if owner, err := hm.CheckIfUserIsNetworkOwner("membernetwork", "memberowner"); err != nil {
+		t.Fatal(err)
+	} else if !owner {
+		t.Fatal("memberowner should own network")
+	}
+	if owner, err := hm.CheckIfUserIsNetworkOwner("membernetwork", "memberuser"); err != nil {
+		t.Fatal(err)
+	} else if owner {
+		t.Fatal("memberuser should not own network")
+	}
+	// memberships are recorded against the network's name, so it can't change
+	if err := hm.UpdateNetworkByName("membernetwork", map[string]interface{}{
+		"name": "renamednetwork",
+	}); err == nil || err.Error() != ErrNetworkRenamed {
+		t.Fatalf("expected rename error, got %v", err)
+	}
+	network, err := hm.GetNetworkByName("membernetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.Name = "renamednetwork"
+	if err := hm.SaveNetwork(network); err == nil || err.Error() != ErrNetworkRenamed {
+		t.Fatalf("expected rename error, got %v", err)
+	}
+	if err := hm.RemoveNetworkMember("membernetwork", "memberuser"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.RemoveNetworkMember("membernetwork", "memberuser"); err == nil {
+		t.Fatal("error expected")
+	}
+	// deleting the network removes its memberships
+	if err := hm.Delete("membernetwork"); err != nil {
+		t.Fatal(err)
+	}
+	if members, err := hm.GetNetworkMembers("membernetwork"); err != nil {
+		t.Fatal(err)
+	} else if len(members) != 0 {
+		t.Fatal("memberships should be removed with network")
+	}
+}
+
+func TestHostedNetworkManager_MigrateNetworkMembership(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(PasswordHistory{})
+	var (
+		hm = NewHostedNetworkManager(db)
+		um = NewUserManager(db)
+	)
+	user, err := um.NewUserAccount("migratemember", "password123", "migratemember@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "migratemember").Delete(&Usage{})
+	defer db.Unscoped().Where("network_name IN (?)", []string{"migratenet1", "migratenet2"}).Delete(&NetworkMember{})
+	if err := db.Model(user).Update("ipfs_network_names", []string{"migratenet1", "migratenet2"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.SaveNetwork(&HostedNetwork{
+		Name:   "migratenet1",
+		Owners: []string{"migratemember"},
+		Users:  []string{"migratemember", "migrateother"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("migratenet1")
+	// running twice must not duplicate or downgrade memberships
+	for i := 0; i < 2; i++ {
+		if err := hm.MigrateNetworkMembership(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if owner, err := hm.CheckIfUserIsNetworkOwner("migratenet1", "migratemember"); err != nil {
+		t.Fatal(err)
+	} else if !owner {
+		t.Fatal("owner role should be migrated")
+	}
+	if members, err := hm.GetNetworkMembers("migratenet1"); err != nil {
+		t.Fatal(err)
+	} else if len(members) != 2 {
+		t.Fatalf("expected 2 members, got %v", len(members))
+	}
+	networks, err := um.GetPrivateIPFSNetworksForUser("migratemember")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatalf("expected 2 networks, got %v", len(networks))
+	}
+	// removed memberships stay removed on the next migration
+	if err := um.RemoveIPFSNetworkForUser("migratemember", "migratenet2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.MigrateNetworkMembership(); err != nil {
+		t.Fatal(err)
+	}
+	if access, err := um.CheckIfUserHasAccessToNetwork("migratemember", "migratenet2"); err != nil {
+		t.Fatal(err)
+	} else if access {
+		t.Fatal("removed membership should not be restored")
+	}
+}
@@ -0,0 +1,304 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// NodeStatus is the health of a single node of a hosted network
+type NodeStatus string
+
+// String returns the value of NodeStatus as a string
+func (s NodeStatus) String() string {
+	return string(s)
+}
+
+var (
+	// NodeProvisioning indicates a node is being deployed
+	NodeProvisioning NodeStatus = "provisioning"
+	// NodeHealthy indicates a node is running and reachable by its siblings
+	NodeHealthy NodeStatus = "healthy"
+	// NodeUnhealthy indicates a node is running but failing health checks
+	NodeUnhealthy NodeStatus = "unhealthy"
+	// NodeStopped indicates a node has been shut down
+	NodeStopped NodeStatus = "stopped"
+)
+
+const (
+	// ErrNodeNotFound is an error triggered when a network has no node with the given peer ID
+	ErrNodeNotFound = "network node not found"
+)
+
+// NetworkNode is a single replica of a hosted network
+type NetworkNode struct {
+	gorm.Model
+	NetworkName string `gorm:"type:varchar(255);index"`
+	PeerID      string `gorm:"type:varchar(255);unique"`
+	// SwarmAddr is the address of the node's swarm port, without the peer ID
+	SwarmAddr string `gorm:"type:varchar(255)"`
+	// Host is where the node is placed, such as a machine or zone name
+	Host              string     `gorm:"type:varchar(255)"`
+	Status            NodeStatus `gorm:"type:varchar(255)"`
+	ResourcesCPUs     int
+	ResourcesDiskGB   int
+	ResourcesMemoryGB int
+	// BootstrapPeerAddresses are the siblings the node bootstraps onto,
+	// derived from the healthy nodes of the network when it was added
+	BootstrapPeerAddresses pq.StringArray `gorm:"type:text[]"`
+	LastSeenAt             *time.Time
+}
+
+// NodeStatusChange records a node moving to a new status, so that each node
+// can be metered from its own history
+type NodeStatusChange struct {
+	gorm.Model
+	NetworkName string     `gorm:"type:varchar(255);index"`
+	PeerID      string     `gorm:"type:varchar(255);index"`
+	Status      NodeStatus `gorm:"type:varchar(255)"`
+}
+
+// NetworkNodeOptions describes a node being added to a network
+type NetworkNodeOptions struct {
+	PeerID    string
+	SwarmAddr string
+	Host      string
+	Resources NetworkResources
+}
+
+// AddNetworkNode is used to register a new node for a network. The node
+// bootstraps onto every healthy node of the network that has a swarm address,
+// and its resources are counted against the quotas of the network owners.
+// Peer IDs of removed nodes can't be reused, since their history is kept for
+// billing.
+func (im *HostedNetworkManager) AddNetworkNode(network string, opts NetworkNodeOptions) (*NetworkNode, error) {
+	pnet, err := im.GetNetworkByName(network)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := utils.GenerateMultiAddrFromString("/ipfs/" + opts.PeerID); err != nil {
+		return nil, errors.New("invalid node peer id")
+	}
+	if opts.SwarmAddr != "" {
+		if _, err := utils.GenerateMultiAddrFromString(opts.SwarmAddr); err != nil {
+			return nil, err
+		}
+	}
+	if err := opts.Resources.Validate(); err != nil {
+		return nil, err
+	}
+	var count int
+	if err := im.DB.Unscoped().Model(&NetworkNode{}).Where("peer_id = ?", opts.PeerID).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, errors.New("node with peer id already exists")
+	}
+	peers, err := im.GetNodeBootstrapPeers(network, opts.PeerID)
+	if err != nil {
+		return nil, err
+	}
+	node := &NetworkNode{
+		NetworkName:            network,
+		PeerID:                 opts.PeerID,
+		SwarmAddr:              opts.SwarmAddr,
+		Host:                   opts.Host,
+		Status:                 NodeProvisioning,
+		ResourcesCPUs:          opts.Resources.CPUs,
+		ResourcesDiskGB:        opts.Resources.DiskGB,
+		ResourcesMemoryGB:      opts.Resources.MemoryGB,
+		BootstrapPeerAddresses: peers,
+	}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		// serialize node changes so that quotas are checked against the
+		// nodes the network has when this one is added
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").First(&HostedNetwork{}, pnet.ID).Error; err != nil {
+			return err
+		}
+		var live int
+		if err := tx.Model(&NetworkNode{}).Where("network_name = ?", network).Count(&live).Error; err != nil {
+			return err
+		}
+		// the first node replaces the resources allocated to the network itself
+		growth := opts.Resources
+		if live == 0 {
+			growth = growth.minus(networkResources(pnet))
+		}
+		if err := NewHostedNetworkManager(tx).checkGrowthQuotas(network, growth); err != nil {
+			return err
+		}
+		if err := tx.Create(node).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(&NodeStatusChange{
+			Model:       gorm.Model{CreatedAt: node.CreatedAt},
+			NetworkName: network,
+			PeerID:      node.PeerID,
+			Status:      node.Status,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkNodeAdded, AuditSubjectNetwork, network, nil, map[string]interface{}{
+			"peer_id":    node.PeerID,
+			"swarm_addr": node.SwarmAddr,
+			"host":       node.Host,
+		})
+	}); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// RemoveNetworkNode is used to remove a node from a network. The node is
+// soft deleted, so that it is still metered up until it was removed.
+func (im *HostedNetworkManager) RemoveNetworkNode(network, peerID string) error {
+	node, err := im.GetNetworkNode(network, peerID)
+	if err != nil {
+		return err
+	}
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Delete(node).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkNodeRemoved, AuditSubjectNetwork, network, map[string]interface{}{
+			"peer_id":    node.PeerID,
+			"swarm_addr": node.SwarmAddr,
+			"host":       node.Host,
+		}, nil)
+	})
+}
+
+// GetNetworkNode is used to retrieve a node of a network by its peer ID
+func (im *HostedNetworkManager) GetNetworkNode(network, peerID string) (*NetworkNode, error) {
+	node := &NetworkNode{}
+	if err := im.DB.Where(
+		"network_name = ? AND peer_id = ?", network, peerID,
+	).First(node).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, errors.New(ErrNodeNotFound)
+		}
+		return nil, err
+	}
+	return node, nil
+}
+
+// GetNetworkNodes is used to return every node of a network, oldest first
+func (im *HostedNetworkManager) GetNetworkNodes(network string) ([]NetworkNode, error) {
+	var nodes []NetworkNode
+	if err := im.DB.Where("network_name = ?", network).Order(
+		"created_at asc, id asc",
+	).Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// UpdateNetworkNodeStatus is used to record the latest health of a node
+func (im *HostedNetworkManager) UpdateNetworkNodeStatus(network, peerID string, status NodeStatus) error {
+	switch status {
+	case NodeProvisioning, NodeHealthy, NodeUnhealthy, NodeStopped:
+	default:
+		return errors.New("unsupported node status")
+	}
+	node, err := im.GetNetworkNode(network, peerID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(node).UpdateColumns(map[string]interface{}{
+			"status":       status,
+			"last_seen_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		// health checks are frequent, so only changes are kept as history
+		if node.Status == status {
+			return nil
+		}
+		return tx.Create(&NodeStatusChange{
+			Model:       gorm.Model{CreatedAt: now},
+			NetworkName: network,
+			PeerID:      peerID,
+			Status:      status,
+		}).Error
+	})
+}
+
+// GetNodeUptime is used to calculate how long a node was running between two
+// times, from its status history. Time spent unhealthy counts as uptime,
+// since the node's resources are still allocated, while time before the node
+// was added or after it was removed does not.
+func (im *HostedNetworkManager) GetNodeUptime(node *NetworkNode, since, until time.Time) (time.Duration, error) {
+	if until.Before(since) {
+		return 0, errors.New("until must not be before since")
+	}
+	if node.CreatedAt.After(since) {
+		since = node.CreatedAt
+	}
+	if node.DeletedAt != nil && node.DeletedAt.Before(until) {
+		until = *node.DeletedAt
+	}
+	if !until.After(since) {
+		return 0, nil
+	}
+	var history []NodeStatusChange
+	if err := im.DB.Where("peer_id = ?", node.PeerID).Order(
+		"created_at asc, id asc",
+	).Find(&history).Error; err != nil {
+		return 0, err
+	}
+	if len(history) == 0 {
+		// nodes added before status history was kept
+		history = []NodeStatusChange{{Model: gorm.Model{CreatedAt: node.CreatedAt}, Status: node.Status}}
+	}
+	var (
+		uptime time.Duration
+		up     bool
+		cursor = since
+	)
+	for _, c := range history {
+		if !c.CreatedAt.After(since) {
+			// establishes the status at the start of the window
+			up = nodeStatusIsUp(c.Status)
+			continue
+		}
+		if !c.CreatedAt.Before(until) {
+			break
+		}
+		if up {
+			uptime += c.CreatedAt.Sub(cursor)
+		}
+		cursor = c.CreatedAt
+		up = nodeStatusIsUp(c.Status)
+	}
+	if up {
+		uptime += until.Sub(cursor)
+	}
+	return uptime, nil
+}
+
+// GetNodeBootstrapPeers is used to return the bootstrap addresses of the
+// healthy nodes of a network, excluding the node with the given peer ID
+func (im *HostedNetworkManager) GetNodeBootstrapPeers(network, excludePeerID string) ([]string, error) {
+	var nodes []NetworkNode
+	if err := im.DB.Where(
+		"network_name = ? AND status = ? AND peer_id <> ? AND swarm_addr <> ''",
+		network, NodeHealthy, excludePeerID,
+	).Order("created_at asc, id asc").Find(&nodes).Error; err != nil {
+		return nil, err
+	}
+	peers := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		peers = append(peers, n.SwarmAddr+"/ipfs/"+n.PeerID)
+	}
+	return peers, nil
+}
+
+// nodeStatusIsUp returns whether a node in the given status has its resources in use
+func nodeStatusIsUp(s NodeStatus) bool {
+	return s == NodeHealthy || s == NodeUnhealthy
+}
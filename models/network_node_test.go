@@ -0,0 +1,160 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestHostedNetworkManager_NetworkNodes(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(db)
+	if _, err := hm.CreateHostedPrivateNetwork(
+		"nodenetwork", testSwarmKey, nil,
+		NetworkAccessOptions{Owner: "nodeowner"},
+	); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("nodenetwork")
+	var (
+		peer1 = "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT"
+		peer2 = "QmPvnFXWAz1eSghXD6JKpHxaGjbVo4VhBXY2wdBxKPbne5"
+		peer3 = "QmSy7Zbf4KDdpwrRj2xs1Kx8vw4z6dcWrXuYQWjz1kn5fe"
+	)
+	if _, err := hm.AddNetworkNode("notarealnetwork", NetworkNodeOptions{PeerID: peer1}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{PeerID: "notapeerid"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{
+		PeerID:    peer1,
+		Resources: NetworkResources{CPUs: -1},
+	}); err == nil {
+		t.Fatal("error expected")
+	}
+	node1, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{
+		PeerID:    peer1,
+		SwarmAddr: "/ip4/10.0.0.1/tcp/4001",
+		Host:      "host-a",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node1.BootstrapPeerAddresses) != 0 {
+		t.Fatal("first node should have no bootstrap peers")
+	}
+	if _, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{PeerID: peer1}); err == nil {
+		t.Fatal("error expected")
+	}
+	// nodes which aren't healthy are not used as bootstrap peers
+	node2, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{
+		PeerID:    peer2,
+		SwarmAddr: "/ip4/10.0.0.2/tcp/4001",
+		Host:      "host-b",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node2.BootstrapPeerAddresses) != 0 {
+		t.Fatal("provisioning nodes should not be bootstrap peers")
+	}
+	if err := hm.UpdateNetworkNodeStatus("nodenetwork", peer1, NodeHealthy); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.UpdateNetworkNodeStatus("nodenetwork", peer2, "notarealstatus"); err == nil {
+		t.Fatal("error expected")
+	}
+	node3, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{PeerID: peer3, Host: "host-c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node3.BootstrapPeerAddresses) != 1 ||
+		node3.BootstrapPeerAddresses[0] != "/ip4/10.0.0.1/tcp/4001/ipfs/"+peer1 {
+		t.Fatalf("unexpected bootstrap peers %v", node3.BootstrapPeerAddresses)
+	}
+	if err := hm.RemoveNetworkNode("nodenetwork", peer2); err != nil {
+		t.Fatal(err)
+	}
+	if err := hm.RemoveNetworkNode("nodenetwork", peer2); err == nil || err.Error() != ErrNodeNotFound {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	// removed nodes are kept for billing, so their peer ids can't be reused
+	if _, err := hm.AddNetworkNode("nodenetwork", NetworkNodeOptions{PeerID: peer2}); err == nil {
+		t.Fatal("error expected")
+	}
+	nodes, err := hm.GetNetworkNodes("nodenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || nodes[0].PeerID != peer1 || nodes[1].PeerID != peer3 {
+		t.Fatalf("unexpected nodes %+v", nodes)
+	}
+	// deleting the network removes its nodes
+	if err := hm.Delete("nodenetwork"); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := hm.GetNetworkNodes("nodenetwork"); err != nil {
+		t.Fatal(err)
+	} else if len(nodes) != 0 {
+		t.Fatal("nodes should be removed with network")
+	}
+}
+
+func TestHostedNetworkManager_GetNodeUptime(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var (
+		hm      = NewHostedNetworkManager(db)
+		start   = time.Now().Add(-10 * time.Hour)
+		removed = start.Add(8 * time.Hour)
+		node    = &NetworkNode{
+			Model:       gorm.Model{CreatedAt: start, DeletedAt: &removed},
+			NetworkName: "uptimenodenetwork",
+			PeerID:      "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT",
+		}
+	)
+	defer db.Unscoped().Where("peer_id = ?", node.PeerID).Delete(&NodeStatusChange{})
+	for _, change := range []struct {
+		at     time.Duration
+		status NodeStatus
+	}{
+		{0, NodeProvisioning},
+		{time.Hour, NodeHealthy},
+		{3 * time.Hour, NodeUnhealthy},
+		{4 * time.Hour, NodeStopped},
+		{6 * time.Hour, NodeHealthy},
+	} {
+		if err := db.Create(&NodeStatusChange{
+			Model:       gorm.Model{CreatedAt: start.Add(change.at)},
+			NetworkName: node.NetworkName,
+			PeerID:      node.PeerID,
+			Status:      change.status,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name         string
+		since, until time.Duration
+		want         time.Duration
+	}{
+		{"whole history", -time.Hour, 10 * time.Hour, 5 * time.Hour},
+		{"starts healthy", 2 * time.Hour, 5 * time.Hour, 2 * time.Hour},
+		{"while stopped", 4 * time.Hour, 6 * time.Hour, 0},
+		{"after removal", 8 * time.Hour, 10 * time.Hour, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hm.GetNodeUptime(node, start.Add(tt.since), start.Add(tt.until))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected uptime %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
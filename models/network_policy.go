@@ -0,0 +1,235 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// MaxRateLimitPerSecond is the highest request rate a network policy may allow
+var MaxRateLimitPerSecond = 10000
+
+// NetworkAccessPolicy controls how a hosted network's API and gateway are
+// exposed through the Nexus delegator
+type NetworkAccessPolicy struct {
+	// AllowedOrigins are used to set Allowed-Origin headers on API requests,
+	// "*" allows any origin
+	AllowedOrigins []string
+	// AllowedCIDRs restricts requests to the given address ranges, any
+	// address is allowed when empty
+	AllowedCIDRs []string
+	// DeniedCIDRs rejects requests from the given address ranges, taking
+	// precedence over AllowedCIDRs
+	DeniedCIDRs []string
+	// RateLimitPerSecond is the number of requests allowed per second and
+	// RateLimitBurst the number allowed at once, 0 means unlimited
+	RateLimitPerSecond int
+	RateLimitBurst     int
+	// GatewayPublic toggles whether the gateway is exposed through Nexus
+	GatewayPublic bool
+	// GatewayAllowedPaths are the path prefixes the gateway serves, every
+	// path is served when empty
+	GatewayAllowedPaths []string
+}
+
+// Validate is used to check that an access policy can be loaded by the delegator
+func (p NetworkAccessPolicy) Validate() error {
+	_, err := p.normalize()
+	return err
+}
+
+// normalize validates an access policy, returning a copy with its address
+// ranges in canonical form
+func (p NetworkAccessPolicy) normalize() (NetworkAccessPolicy, error) {
+	seen := make(map[string]bool, len(p.AllowedOrigins))
+	for _, origin := range p.AllowedOrigins {
+		if err := validateOrigin(origin); err != nil {
+			return p, err
+		}
+		if seen[origin] {
+			return p, fmt.Errorf("origin '%s' is given more than once", origin)
+		}
+		seen[origin] = true
+	}
+	allowed, err := normalizeCIDRs(p.AllowedCIDRs)
+	if err != nil {
+		return p, err
+	}
+	denied, err := normalizeCIDRs(p.DeniedCIDRs)
+	if err != nil {
+		return p, err
+	}
+	for _, cidr := range denied {
+		for _, other := range allowed {
+			if cidr == other {
+				return p, fmt.Errorf("address range '%s' is both allowed and denied", cidr)
+			}
+		}
+	}
+	p.AllowedCIDRs, p.DeniedCIDRs = allowed, denied
+	switch {
+	case p.RateLimitPerSecond < 0 || p.RateLimitBurst < 0:
+		return p, errors.New("rate limits must not be negative")
+	case p.RateLimitPerSecond > MaxRateLimitPerSecond:
+		return p, fmt.Errorf("rate limit may not exceed %v requests per second", MaxRateLimitPerSecond)
+	case p.RateLimitBurst > 0 && p.RateLimitPerSecond == 0:
+		return p, errors.New("rate limit burst requires a rate limit")
+	}
+	for _, path := range p.GatewayAllowedPaths {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t\n?#") {
+			return p, fmt.Errorf("gateway path '%s' must be an absolute path prefix", path)
+		}
+		for _, segment := range strings.Split(path, "/") {
+			if segment == "." || segment == ".." {
+				return p, fmt.Errorf("gateway path '%s' must not contain relative segments", path)
+			}
+		}
+	}
+	return p, nil
+}
+
+// GetAccessPolicy is used to retrieve the access policy of a network
+func (im *HostedNetworkManager) GetAccessPolicy(network string) (*NetworkAccessPolicy, error) {
+	pnet, err := im.GetNetworkByName(network)
+	if err != nil {
+		return nil, err
+	}
+	policy := networkAccessPolicy(pnet)
+	return &policy, nil
+}
+
+// SetAccessPolicy is used to validate and replace the access policy of a network
+func (im *HostedNetworkManager) SetAccessPolicy(network string, policy NetworkAccessPolicy) (*NetworkAccessPolicy, error) {
+	policy, err := policy.normalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		pnet := &HostedNetwork{}
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"name = ?", network,
+		).First(pnet).Error; err != nil {
+			return err
+		}
+		before := networkAccessPolicy(pnet)
+		if err := tx.Model(pnet).UpdateColumns(accessPolicyColumns(policy)).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkUpdated, AuditSubjectNetwork, network,
+			map[string]interface{}{"access_policy": before},
+			map[string]interface{}{"access_policy": policy},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// MigrateNetworkAccessPolicies is used to copy the single allowed origin of
+// networks created before access policies into their list of allowed origins
+func (im *HostedNetworkManager) MigrateNetworkAccessPolicies() error {
+	return im.DB.Model(&HostedNetwork{}).Where(
+		"api_allowed_origin <> '' AND (api_allowed_origins IS NULL OR api_allowed_origins = '{}')",
+	).UpdateColumn("api_allowed_origins", gorm.Expr("ARRAY[api_allowed_origin]")).Error
+}
+
+// networkAccessPolicy returns the access policy stored on a network, falling
+// back to the legacy allowed origin for networks which haven't been migrated
+func networkAccessPolicy(n *HostedNetwork) NetworkAccessPolicy {
+	origins := []string(n.APIAllowedOrigins)
+	if len(origins) == 0 && n.APIAllowedOrigin != "" {
+		origins = []string{n.APIAllowedOrigin}
+	}
+	return NetworkAccessPolicy{
+		AllowedOrigins:      origins,
+		AllowedCIDRs:        n.AllowedCIDRs,
+		DeniedCIDRs:         n.DeniedCIDRs,
+		RateLimitPerSecond:  n.RateLimitPerSecond,
+		RateLimitBurst:      n.RateLimitBurst,
+		GatewayPublic:       n.GatewayPublic,
+		GatewayAllowedPaths: n.GatewayAllowedPaths,
+	}
+}
+
+// applyAccessPolicy stores an access policy on a network in place
+func applyAccessPolicy(n *HostedNetwork, p NetworkAccessPolicy) {
+	// older delegators only read the first allowed origin
+	n.APIAllowedOrigin = ""
+	if len(p.AllowedOrigins) > 0 {
+		n.APIAllowedOrigin = p.AllowedOrigins[0]
+	}
+	n.APIAllowedOrigins = append(pq.StringArray{}, p.AllowedOrigins...)
+	n.AllowedCIDRs = append(pq.StringArray{}, p.AllowedCIDRs...)
+	n.DeniedCIDRs = append(pq.StringArray{}, p.DeniedCIDRs...)
+	n.RateLimitPerSecond = p.RateLimitPerSecond
+	n.RateLimitBurst = p.RateLimitBurst
+	n.GatewayPublic = p.GatewayPublic
+	n.GatewayAllowedPaths = append(pq.StringArray{}, p.GatewayAllowedPaths...)
+}
+
+// accessPolicyColumns returns the columns an access policy is stored in
+func accessPolicyColumns(p NetworkAccessPolicy) map[string]interface{} {
+	n := &HostedNetwork{}
+	applyAccessPolicy(n, p)
+	return map[string]interface{}{
+		"api_allowed_origins":   n.APIAllowedOrigins,
+		"api_allowed_origin":    n.APIAllowedOrigin,
+		"allowed_cidrs":         n.AllowedCIDRs,
+		"denied_cidrs":          n.DeniedCIDRs,
+		"rate_limit_per_second": n.RateLimitPerSecond,
+		"rate_limit_burst":      n.RateLimitBurst,
+		"gateway_public":        n.GatewayPublic,
+		"gateway_allowed_paths": n.GatewayAllowedPaths,
+	}
+}
+
+// isAccessPolicyAttr returns whether an update attribute is part of a
+// network's access policy
+func isAccessPolicyAttr(attr string) bool {
+	switch attr {
+	case "api_allowed_origin", "api_allowed_origins", "allowed_cidrs", "denied_cidrs",
+		"rate_limit_per_second", "rate_limit_burst", "gateway_public", "gateway_allowed_paths",
+		"APIAllowedOrigin", "APIAllowedOrigins", "AllowedCIDRs", "DeniedCIDRs",
+		"RateLimitPerSecond", "RateLimitBurst", "GatewayPublic", "GatewayAllowedPaths":
+		return true
+	}
+	return false
+}
+
+// validateOrigin checks that an origin is "*" or a scheme and host without a path
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		(u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("origin '%s' must be '*' or a http(s) scheme and host", origin)
+	}
+	return nil
+}
+
+// normalizeCIDRs validates address ranges, returning them in canonical form
+func normalizeCIDRs(cidrs []string) ([]string, error) {
+	var (
+		normalized = make([]string, 0, len(cidrs))
+		seen       = make(map[string]bool, len(cidrs))
+	)
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address range '%s'", cidr)
+		}
+		if seen[ipnet.String()] {
+			return nil, fmt.Errorf("address range '%s' is given more than once", cidr)
+		}
+		seen[ipnet.String()] = true
+		normalized = append(normalized, ipnet.String())
+	}
+	return normalized, nil
+}
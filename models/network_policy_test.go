@@ -0,0 +1,134 @@
+package models
+
+import "testing"
+
+func TestNetworkAccessPolicy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  NetworkAccessPolicy
+		wantErr bool
+	}{
+		{"none", NetworkAccessPolicy{}, false},
+		{"valid", NetworkAccessPolicy{
+			AllowedOrigins:      []string{"https://example.org", "http://localhost:8080"},
+			AllowedCIDRs:        []string{"10.0.0.0/8", "2001:db8::/32"},
+			DeniedCIDRs:         []string{"10.0.0.1/32"},
+			RateLimitPerSecond:  10,
+			RateLimitBurst:      20,
+			GatewayPublic:       true,
+			GatewayAllowedPaths: []string{"/ipfs/", "/ipns/"},
+		}, false},
+		{"any origin", NetworkAccessPolicy{AllowedOrigins: []string{"*"}}, false},
+		{"origin with path", NetworkAccessPolicy{AllowedOrigins: []string{"https://example.org/app"}}, true},
+		{"origin without scheme", NetworkAccessPolicy{AllowedOrigins: []string{"example.org"}}, true},
+		{"duplicate origin", NetworkAccessPolicy{AllowedOrigins: []string{"https://example.org", "https://example.org"}}, true},
+		{"bad cidr", NetworkAccessPolicy{AllowedCIDRs: []string{"10.0.0.1"}}, true},
+		{"allowed and denied", NetworkAccessPolicy{
+			AllowedCIDRs: []string{"192.168.1.0/24"},
+			DeniedCIDRs:  []string{"192.168.1.7/24"},
+		}, true},
+		{"negative rate limit", NetworkAccessPolicy{RateLimitPerSecond: -1}, true},
+		{"absurd rate limit", NetworkAccessPolicy{RateLimitPerSecond: 1000000}, true},
+		{"burst without rate limit", NetworkAccessPolicy{RateLimitBurst: 5}, true},
+		{"relative path", NetworkAccessPolicy{GatewayAllowedPaths: []string{"ipfs/"}}, true},
+		{"path traversal", NetworkAccessPolicy{GatewayAllowedPaths: []string{"/ipfs/../admin"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostedNetworkManager_AccessPolicy(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(db)
+	if _, err := hm.CreateHostedPrivateNetwork("policynetwork", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:            "policyowner",
+		APIAllowedOrigin: "not an origin",
+	}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.CreateHostedPrivateNetwork("policynetwork", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:            "policyowner",
+		APIAllowedOrigin: "https://example.org",
+		PublicGateway:    true,
+		Policy: NetworkAccessPolicy{
+			AllowedOrigins: []string{"https://app.example.org"},
+			AllowedCIDRs:   []string{"10.1.2.3/16"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("policynetwork")
+	details, err := hm.GetAPIDetails("policynetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.AllowedOrigin != "https://example.org" || len(details.AllowedOrigins) != 2 {
+		t.Fatalf("unexpected origins %+v", details)
+	}
+	if !details.GatewayPublic || len(details.AllowedCIDRs) != 1 || details.AllowedCIDRs[0] != "10.1.0.0/16" {
+		t.Fatalf("unexpected policy %+v", details.NetworkAccessPolicy)
+	}
+	if _, err := hm.SetAccessPolicy("policynetwork", NetworkAccessPolicy{RateLimitBurst: 10}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.UpdateNetworkByName("policynetwork", map[string]interface{}{
+		"gateway_public": false,
+	}); err == nil {
+		t.Fatal("access policies should not be updated without validation")
+	}
+	if _, err := hm.SetAccessPolicy("policynetwork", NetworkAccessPolicy{
+		AllowedOrigins:      []string{"*"},
+		DeniedCIDRs:         []string{"10.1.0.0/16"},
+		RateLimitPerSecond:  5,
+		RateLimitBurst:      10,
+		GatewayAllowedPaths: []string{"/ipfs/"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	policy, err := hm.GetAccessPolicy("policynetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.GatewayPublic || len(policy.AllowedCIDRs) != 0 || policy.RateLimitPerSecond != 5 ||
+		len(policy.GatewayAllowedPaths) != 1 {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+	network, err := hm.GetNetworkByName("policynetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.APIAllowedOrigin != "*" {
+		t.Fatalf("legacy origin should be the first allowed origin, got %s", network.APIAllowedOrigin)
+	}
+}
+
+func TestHostedNetworkManager_MigrateNetworkAccessPolicies(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(db)
+	network := &HostedNetwork{Name: "legacypolicynetwork", APIAllowedOrigin: "https://example.org"}
+	if err := db.Create(network).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Unscoped().Delete(network)
+	if err := hm.MigrateNetworkAccessPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	// running the migration again must not change anything
+	if err := hm.MigrateNetworkAccessPolicies(); err != nil {
+		t.Fatal(err)
+	}
+	network, err := hm.GetNetworkByName("legacypolicynetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(network.APIAllowedOrigins) != 1 || network.APIAllowedOrigins[0] != "https://example.org" {
+		t.Fatalf("unexpected origins %v", network.APIAllowedOrigins)
+	}
+}
@@ -0,0 +1,439 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// QuotaUser indicates a resource quota applies to networks owned by a single user
+	QuotaUser = "user"
+	// QuotaOrganization indicates a resource quota applies to networks owned by every member of an organization
+	QuotaOrganization = "organization"
+
+	// ErrResourceQuotaExceeded is an error triggered when creating a network would exceed a resource quota
+	ErrResourceQuotaExceeded = "network resource quota exceeded"
+
+	// resourceUsageColumns selects the totals scanned into a ResourceUsage.
+	// Networks with registered nodes are allocated the resources of those
+	// nodes, other networks the resources of their single implicit node.
+	resourceUsageColumns = "count(*), " +
+		"coalesce(sum(coalesce(node_totals.cpus, hosted_networks.resources_cpus)), 0), " +
+		"coalesce(sum(coalesce(node_totals.disk_gb, hosted_networks.resources_disk_gb)), 0), " +
+		"coalesce(sum(coalesce(node_totals.memory_gb, hosted_networks.resources_memory_gb)), 0)"
+
+	// nodeTotalsJoin joins the resources of the nodes registered to each network
+	nodeTotalsJoin = "LEFT JOIN (SELECT network_name, sum(resources_cpus) AS cpus, " +
+		"sum(resources_disk_gb) AS disk_gb, sum(resources_memory_gb) AS memory_gb " +
+		"FROM network_nodes WHERE deleted_at IS NULL GROUP BY network_name) AS node_totals " +
+		"ON node_totals.network_name = hosted_networks.name"
+)
+
+// NetworkResources are the resources allocated to a hosted network node
+type NetworkResources struct {
+	CPUs     int
+	DiskGB   int
+	MemoryGB int
+}
+
+// MaxNetworkResources is the most that may be allocated to a single network,
+// anything larger is assumed to be a mistake
+var MaxNetworkResources = NetworkResources{
+	CPUs:     64,
+	DiskGB:   16384,
+	MemoryGB: 512,
+}
+
+// Validate is used to reject negative or unreasonably large resources
+func (r NetworkResources) Validate() error {
+	for _, v := range []struct {
+		name       string
+		value, max int
+	}{
+		{"cpus", r.CPUs, MaxNetworkResources.CPUs},
+		{"disk", r.DiskGB, MaxNetworkResources.DiskGB},
+		{"memory", r.MemoryGB, MaxNetworkResources.MemoryGB},
+	} {
+		if v.value < 0 {
+			return fmt.Errorf("network %s must not be negative", v.name)
+		}
+		if v.value > v.max {
+			return fmt.Errorf("network %s must not exceed %v", v.name, v.max)
+		}
+	}
+	return nil
+}
+
+// ResourceUsage is the total resources allocated to a group of networks
+type ResourceUsage struct {
+	Networks int
+	NetworkResources
+}
+
+// ResourceQuota limits the networks and resources that may be allocated to
+// the networks owned by a user, or by the members of an organization. A limit
+// of zero means that resource is not limited.
+type ResourceQuota struct {
+	gorm.Model
+	OwnerType   string `gorm:"type:varchar(255);unique_index:idx_resource_quota_owner"`
+	Owner       string `gorm:"type:varchar(255);unique_index:idx_resource_quota_owner"`
+	MaxNetworks int
+	MaxCPUs     int
+	MaxDiskGB   int
+	MaxMemoryGB int
+}
+
+// allows returns whether usage is within the quota
+func (q *ResourceQuota) allows(u ResourceUsage) bool {
+	for _, v := range []struct{ used, max int }{
+		{u.Networks, q.MaxNetworks},
+		{u.CPUs, q.MaxCPUs},
+		{u.DiskGB, q.MaxDiskGB},
+		{u.MemoryGB, q.MaxMemoryGB},
+	} {
+		if v.max > 0 && v.used > v.max {
+			return false
+		}
+	}
+	return true
+}
+
+// SetResourceQuota is used to set the network resource quota of a user or organization
+func (im *HostedNetworkManager) SetResourceQuota(ownerType, owner string, quota ResourceQuota) (*ResourceQuota, error) {
+	if ownerType != QuotaUser && ownerType != QuotaOrganization {
+		return nil, errors.New("unsupported quota owner type")
+	}
+	if quota.MaxNetworks < 0 || quota.MaxCPUs < 0 || quota.MaxDiskGB < 0 || quota.MaxMemoryGB < 0 {
+		return nil, errors.New("quota limits must not be negative")
+	}
+	existing := &ResourceQuota{}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"owner_type = ? AND owner = ?", ownerType, owner,
+		).First(existing).Error
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return err
+		}
+		var before map[string]interface{}
+		if err == nil {
+			before = existing.auditSnapshot()
+		}
+		existing.OwnerType = ownerType
+		existing.Owner = owner
+		existing.MaxNetworks = quota.MaxNetworks
+		existing.MaxCPUs = quota.MaxCPUs
+		existing.MaxDiskGB = quota.MaxDiskGB
+		existing.MaxMemoryGB = quota.MaxMemoryGB
+		if err := tx.Save(existing).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditResourceQuotaChanged, ownerType, owner,
+			before, existing.auditSnapshot(),
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return existing, nil
+}
+
+// GetResourceQuota is used to retrieve the network resource quota of a user or organization
+func (im *HostedNetworkManager) GetResourceQuota(ownerType, owner string) (*ResourceQuota, error) {
+	quota := &ResourceQuota{}
+	if err := im.DB.Where(
+		"owner_type = ? AND owner = ?", ownerType, owner,
+	).First(quota).Error; err != nil {
+		return nil, err
+	}
+	return quota, nil
+}
+
+// RemoveResourceQuota is used to remove the network resource quota of a user
+// or organization, lifting all limits
+func (im *HostedNetworkManager) RemoveResourceQuota(ownerType, owner string) error {
+	quota, err := im.GetResourceQuota(ownerType, owner)
+	if err != nil {
+		return err
+	}
+	return withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(quota).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditResourceQuotaChanged, ownerType, owner, quota.auditSnapshot(), nil)
+	})
+}
+
+// GetAllocatedResources is used to total the resources allocated to networks
+// in any of the given states, or to every network if no states are given
+func (im *HostedNetworkManager) GetAllocatedResources(states ...NetworkState) (ResourceUsage, error) {
+	db := allocatedNetworks(im.DB)
+	if len(states) > 0 {
+		db = db.Where("hosted_networks.state IN (?)", states)
+	}
+	return scanResourceUsage(db)
+}
+
+// GetAllocatedResourcesByOwner is used to total the resources allocated to
+// networks in any of the given states, or to every network if no states are
+// given, grouped by the owners of each network
+func (im *HostedNetworkManager) GetAllocatedResourcesByOwner(states ...NetworkState) (map[string]ResourceUsage, error) {
+	db := allocatedNetworks(im.DB).Joins(
+		"JOIN network_members ON network_members.network_name = hosted_networks.name AND network_members.role = ?",
+		NetworkRoleOwner,
+	)
+	if len(states) > 0 {
+		db = db.Where("hosted_networks.state IN (?)", states)
+	}
+	rows, err := db.Select(
+		"network_members.user_name, " + resourceUsageColumns,
+	).Group("network_members.user_name").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make(map[string]ResourceUsage)
+	for rows.Next() {
+		var (
+			owner string
+			u     ResourceUsage
+		)
+		if err := rows.Scan(&owner, &u.Networks, &u.CPUs, &u.DiskGB, &u.MemoryGB); err != nil {
+			return nil, err
+		}
+		usage[owner] = u
+	}
+	return usage, rows.Err()
+}
+
+// GetAllocatedResourcesByState is used to total the resources allocated to
+// networks grouped by their lifecycle state
+func (im *HostedNetworkManager) GetAllocatedResourcesByState() (map[NetworkState]ResourceUsage, error) {
+	rows, err := allocatedNetworks(im.DB).Select(
+		"coalesce(hosted_networks.state, ''), " + resourceUsageColumns,
+	).Group("coalesce(hosted_networks.state, '')").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make(map[NetworkState]ResourceUsage)
+	for rows.Next() {
+		var (
+			state string
+			u     ResourceUsage
+		)
+		if err := rows.Scan(&state, &u.Networks, &u.CPUs, &u.DiskGB, &u.MemoryGB); err != nil {
+			return nil, err
+		}
+		usage[NetworkState(state)] = u
+	}
+	return usage, rows.Err()
+}
+
+// GetOwnerResourceUsage is used to total the resources allocated to every
+// network owned by a user
+func (im *HostedNetworkManager) GetOwnerResourceUsage(username string) (ResourceUsage, error) {
+	return scanResourceUsage(allocatedNetworks(im.DB).Where(
+		"hosted_networks.name IN (?)", im.DB.Model(&NetworkMember{}).Select("network_name").Where(
+			"user_name = ? AND role = ?", username, NetworkRoleOwner,
+		).SubQuery(),
+	))
+}
+
+// GetOrganizationResourceUsage is used to total the resources allocated to
+// every network owned by the owner or a member of an organization
+func (im *HostedNetworkManager) GetOrganizationResourceUsage(org string) (ResourceUsage, error) {
+	return scanResourceUsage(allocatedNetworks(im.DB).Where(
+		"hosted_networks.name IN (?)", im.DB.Model(&NetworkMember{}).Select("network_name").Where(
+			"role = ? AND (user_name IN (?) OR user_name IN (?))", NetworkRoleOwner,
+			im.DB.Model(&User{}).Select("user_name").Where("organization = ?", org).SubQuery(),
+			im.DB.Model(&Organization{}).Select("account_owner").Where("name = ?", org).SubQuery(),
+		).SubQuery(),
+	))
+}
+
+// ResizeNetwork is used to change the resources allocated to a network,
+// checking that any growth is within the quotas of each of its owners
+func (im *HostedNetworkManager) ResizeNetwork(name string, r NetworkResources) (*HostedNetwork, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	pnet := &HostedNetwork{}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+			"name = ?", name,
+		).First(pnet).Error; err != nil {
+			return err
+		}
+		before := networkResources(pnet)
+		if err := NewHostedNetworkManager(tx).checkResizeQuotas(name, before, r); err != nil {
+			return err
+		}
+		if err := tx.Model(pnet).UpdateColumns(map[string]interface{}{
+			"resources_cpus":      r.CPUs,
+			"resources_disk_gb":   r.DiskGB,
+			"resources_memory_gb": r.MemoryGB,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkUpdated, AuditSubjectNetwork, name,
+			before.auditSnapshot(), r.auditSnapshot(),
+		)
+	}); err != nil {
+		return nil, err
+	}
+	if err := im.decryptNetwork(pnet); err != nil {
+		return nil, err
+	}
+	return pnet, nil
+}
+
+// checkResizeQuotas returns an error if growing a network from one set of
+// resources to another would exceed the quota of any of its owners. The
+// resources of a network with registered nodes aren't allocated, so resizing
+// it is never rejected.
+func (im *HostedNetworkManager) checkResizeQuotas(name string, from, to NetworkResources) error {
+	var nodes int
+	if err := im.DB.Model(&NetworkNode{}).Where("network_name = ?", name).Count(&nodes).Error; err != nil {
+		return err
+	}
+	if nodes > 0 {
+		return nil
+	}
+	return im.checkGrowthQuotas(name, to.minus(from))
+}
+
+// checkGrowthQuotas returns an error if growing a network by the given
+// resources would exceed the quota of any of its owners. Networks that only
+// shrink are never rejected, even if their owners are over quota.
+func (im *HostedNetworkManager) checkGrowthQuotas(name string, growth NetworkResources) error {
+	if growth.CPUs <= 0 && growth.DiskGB <= 0 && growth.MemoryGB <= 0 {
+		return nil
+	}
+	var owners []string
+	if err := im.DB.Model(&NetworkMember{}).Where(
+		"network_name = ? AND role = ?", name, NetworkRoleOwner,
+	).Pluck("user_name", &owners).Error; err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		if err := im.checkResourceQuotas(owner, 0, growth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkResourceQuotas returns an error if giving the owner the given number
+// of extra networks and resources would exceed the quota of the owner, or of
+// any organization the owner belongs to
+func (im *HostedNetworkManager) checkResourceQuotas(owner string, networks int, r NetworkResources) error {
+	check := func(ownerType, name string, usage func(string) (ResourceUsage, error)) error {
+		quota, err := im.GetResourceQuota(ownerType, name)
+		if err == gorm.ErrRecordNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		u, err := usage(name)
+		if err != nil {
+			return err
+		}
+		u.Networks += networks
+		u.CPUs += r.CPUs
+		u.DiskGB += r.DiskGB
+		u.MemoryGB += r.MemoryGB
+		if !quota.allows(u) {
+			return errors.New(ErrResourceQuotaExceeded)
+		}
+		return nil
+	}
+	if err := check(QuotaUser, owner, im.GetOwnerResourceUsage); err != nil {
+		return err
+	}
+	orgs, err := ownerOrganizations(im.DB, owner)
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		if err := check(QuotaOrganization, org, im.GetOrganizationResourceUsage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownerOrganizations returns the organizations a user is a member or owner of
+func ownerOrganizations(db *gorm.DB, username string) ([]string, error) {
+	var orgs []string
+	if err := db.Model(&Organization{}).Where(
+		"account_owner = ?", username,
+	).Pluck("name", &orgs).Error; err != nil {
+		return nil, err
+	}
+	var member []string
+	if err := db.Model(&User{}).Where(
+		"user_name = ? AND organization <> ''", username,
+	).Pluck("organization", &member).Error; err != nil {
+		return nil, err
+	}
+	for _, org := range member {
+		var owned bool
+		for _, o := range orgs {
+			owned = owned || o == org
+		}
+		if !owned {
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs, nil
+}
+
+// auditSnapshot returns the audited fields of a quota
+func (q *ResourceQuota) auditSnapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"max_networks":  q.MaxNetworks,
+		"max_cpus":      q.MaxCPUs,
+		"max_disk_gb":   q.MaxDiskGB,
+		"max_memory_gb": q.MaxMemoryGB,
+	}
+}
+
+// auditSnapshot returns the audited fields of network resources
+func (r NetworkResources) auditSnapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"resources_cpus":      r.CPUs,
+		"resources_disk_gb":   r.DiskGB,
+		"resources_memory_gb": r.MemoryGB,
+	}
+}
+
+// minus returns the difference between two sets of resources
+func (r NetworkResources) minus(o NetworkResources) NetworkResources {
+	return NetworkResources{
+		CPUs:     r.CPUs - o.CPUs,
+		DiskGB:   r.DiskGB - o.DiskGB,
+		MemoryGB: r.MemoryGB - o.MemoryGB,
+	}
+}
+
+// allocatedNetworks selects hosted networks along with the resources of their nodes
+func allocatedNetworks(db *gorm.DB) *gorm.DB {
+	return db.Table("hosted_networks").Joins(nodeTotalsJoin)
+}
+
+// networkResources returns the resources allocated to a network
+func networkResources(n *HostedNetwork) NetworkResources {
+	return NetworkResources{
+		CPUs:     n.ResourcesCPUs,
+		DiskGB:   n.ResourcesDiskGB,
+		MemoryGB: n.ResourcesMemoryGB,
+	}
+}
+
+// scanResourceUsage totals the resources of the networks selected by db
+func scanResourceUsage(db *gorm.DB) (ResourceUsage, error) {
+	var u ResourceUsage
+	err := db.Select(resourceUsageColumns).Row().Scan(&u.Networks, &u.CPUs, &u.DiskGB, &u.MemoryGB)
+	return u, err
+}
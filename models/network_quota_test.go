@@ -0,0 +1,186 @@
+package models
+
+import "testing"
+
+func TestNetworkResources_Validate(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources NetworkResources
+		wantErr   bool
+	}{
+		{"none", NetworkResources{}, false},
+		{"valid", NetworkResources{CPUs: 2, DiskGB: 100, MemoryGB: 4}, false},
+		{"negative cpus", NetworkResources{CPUs: -1}, true},
+		{"negative disk", NetworkResources{DiskGB: -10}, true},
+		{"absurd memory", NetworkResources{MemoryGB: 1000000}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.resources.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostedNetworkManager_ResourceQuotas(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(Organization{})
+	db.AutoMigrate(ResourceQuota{})
+	var (
+		hm = NewHostedNetworkManager(db)
+		um = NewUserManager(db)
+		om = NewOrgManager(db)
+	)
+	owner, err := um.NewUserAccount("quotaowner", "password123", "quotaowner@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(owner)
+	org, err := om.NewOrganization("quotaorg", "quotaowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer om.DB.Unscoped().Delete(org)
+	member, err := om.RegisterOrgUser("quotaorg", "quotamember", "password123", "quotamember@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(member)
+	for _, name := range []string{"quotaowner", "quotamember"} {
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&Usage{})
+	}
+	if _, err := hm.SetResourceQuota(QuotaUser, "quotamember", ResourceQuota{MaxNetworks: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.RemoveResourceQuota(QuotaUser, "quotamember")
+	if _, err := hm.SetResourceQuota(QuotaOrganization, "quotaorg", ResourceQuota{MaxCPUs: 4}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.RemoveResourceQuota(QuotaOrganization, "quotaorg")
+	if _, err := hm.SetResourceQuota("notarealtype", "quotaorg", ResourceQuota{}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.CreateHostedPrivateNetwork("quotanet1", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "quotamember",
+		Resources: NetworkResources{CPUs: -1},
+	}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.CreateHostedPrivateNetwork("quotanet1", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "quotamember",
+		Resources: NetworkResources{CPUs: 2, DiskGB: 10, MemoryGB: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("quotanet1")
+	// the member may only own a single network
+	if _, err := hm.CreateHostedPrivateNetwork("quotanet2", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "quotamember",
+		Resources: NetworkResources{CPUs: 1},
+	}); err == nil || err.Error() != ErrResourceQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	// the organization may only use 4 cpus across all of its members
+	if _, err := hm.CreateHostedPrivateNetwork("quotanet2", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "quotaowner",
+		Resources: NetworkResources{CPUs: 3},
+	}); err == nil || err.Error() != ErrResourceQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	if _, err := hm.CreateHostedPrivateNetwork("quotanet2", testSwarmKey, nil, NetworkAccessOptions{
+		Owner:     "quotaowner",
+		Resources: NetworkResources{CPUs: 2, DiskGB: 20, MemoryGB: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("quotanet2")
+	if usage, err := hm.GetOrganizationResourceUsage("quotaorg"); err != nil {
+		t.Fatal(err)
+	} else if usage.Networks != 2 || usage.CPUs != 4 || usage.DiskGB != 30 || usage.MemoryGB != 6 {
+		t.Fatalf("unexpected organization usage %+v", usage)
+	}
+	// growing a network is subject to the same quotas as creating one
+	if err := hm.UpdateNetworkByName("quotanet1", map[string]interface{}{"resources_cpus": 4}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.ResizeNetwork("quotanet1", NetworkResources{CPUs: 3, DiskGB: 10, MemoryGB: 2}); err == nil ||
+		err.Error() != ErrResourceQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	grown, err := hm.GetNetworkByName("quotanet1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grown.ResourcesCPUs = 3
+	if err := hm.SaveNetwork(grown); err == nil || err.Error() != ErrResourceQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	if resized, err := hm.ResizeNetwork("quotanet1", NetworkResources{CPUs: 1, DiskGB: 10, MemoryGB: 2}); err != nil {
+		t.Fatal(err)
+	} else if resized.ResourcesCPUs != 1 {
+		t.Fatalf("unexpected resized network %+v", resized)
+	}
+	if _, err := hm.ResizeNetwork("quotanet1", NetworkResources{CPUs: 2, DiskGB: 10, MemoryGB: 2}); err != nil {
+		t.Fatal(err)
+	}
+	// registered nodes replace the resources of the network itself
+	if _, err := hm.AddNetworkNode("quotanet2", NetworkNodeOptions{
+		PeerID:    "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT",
+		Resources: NetworkResources{CPUs: 3},
+	}); err == nil || err.Error() != ErrResourceQuotaExceeded {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	if _, err := hm.AddNetworkNode("quotanet2", NetworkNodeOptions{
+		PeerID:    "QmXivHtDyAe8nS7cbQiS7ri9haUM2wGvbinjKws3a4EstT",
+		Resources: NetworkResources{CPUs: 1, DiskGB: 20, MemoryGB: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hm.AddNetworkNode("quotanet2", NetworkNodeOptions{
+		PeerID:    "QmPvnFXWAz1eSghXD6JKpHxaGjbVo4VhBXY2wdBxKPbne5",
+		Resources: NetworkResources{CPUs: 1, DiskGB: 20, MemoryGB: 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if usage, err := hm.GetOwnerResourceUsage("quotaowner"); err != nil {
+		t.Fatal(err)
+	} else if usage.Networks != 1 || usage.CPUs != 2 || usage.DiskGB != 40 || usage.MemoryGB != 8 {
+		t.Fatalf("unexpected owner usage %+v", usage)
+	}
+	byOwner, err := hm.GetAllocatedResourcesByOwner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byOwner["quotaowner"].CPUs != 2 || byOwner["quotamember"].CPUs != 2 {
+		t.Fatalf("unexpected usage by owner %+v", byOwner)
+	}
+	// only online networks are counted once a state is given
+	before, err := hm.GetAllocatedResources(NetworkOnline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, state := range []NetworkState{NetworkProvisioning, NetworkOnline} {
+		if _, err := hm.TransitionNetwork("quotanet2", state, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := hm.GetAllocatedResources(NetworkOnline)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Networks-before.Networks != 1 || after.MemoryGB-before.MemoryGB != 8 {
+		t.Fatalf("unexpected online usage before %+v after %+v", before, after)
+	}
+	byState, err := hm.GetAllocatedResourcesByState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byState[NetworkOnline].Networks < 1 || byState[NetworkRequested].Networks < 1 {
+		t.Fatalf("unexpected usage by state %+v", byState)
+	}
+}
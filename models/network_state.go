@@ -0,0 +1,276 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// NetworkState is a step in the lifecycle of a hosted network
+type NetworkState string
+
+// String returns the value of NetworkState as a string
+func (s NetworkState) String() string {
+	return string(s)
+}
+
+var (
+	// NetworkRequested indicates a network has been created but not yet deployed
+	NetworkRequested NetworkState = "requested"
+	// NetworkProvisioning indicates a network's infrastructure is being deployed
+	NetworkProvisioning NetworkState = "provisioning"
+	// NetworkOnline indicates a network is running normally
+	NetworkOnline NetworkState = "online"
+	// NetworkDegraded indicates a network is running but unhealthy
+	NetworkDegraded NetworkState = "degraded"
+	// NetworkStopped indicates a network has been shut down, and may be started again
+	NetworkStopped NetworkState = "stopped"
+	// NetworkDisabled indicates a network has been shut down by an administrator
+	NetworkDisabled NetworkState = "disabled"
+	// NetworkDestroying indicates a network's infrastructure is being torn down
+	NetworkDestroying NetworkState = "destroying"
+)
+
+// ErrNetworkStateNotTransitioned is an error triggered when changing the
+// lifecycle state of a network other than with TransitionNetwork
+const ErrNetworkStateNotTransitioned = "network state must be changed with TransitionNetwork"
+
+// networkTransitions lists the states a network may move to from each state
+var networkTransitions = map[NetworkState][]NetworkState{
+	NetworkRequested:    {NetworkProvisioning, NetworkDisabled, NetworkDestroying},
+	NetworkProvisioning: {NetworkOnline, NetworkDegraded, NetworkStopped, NetworkDisabled, NetworkDestroying},
+	NetworkOnline:       {NetworkDegraded, NetworkStopped, NetworkDisabled, NetworkDestroying},
+	NetworkDegraded:     {NetworkOnline, NetworkStopped, NetworkDisabled, NetworkDestroying},
+	NetworkStopped:      {NetworkProvisioning, NetworkDisabled, NetworkDestroying},
+	NetworkDisabled:     {NetworkStopped, NetworkProvisioning, NetworkDestroying},
+	NetworkDestroying:   {},
+}
+
+// NetworkStateTransition is a record of a hosted network changing state.
+// The CreatedAt of each transition is when the network entered ToState.
+type NetworkStateTransition struct {
+	gorm.Model
+	NetworkName string       `gorm:"type:varchar(255);index"`
+	FromState   NetworkState `gorm:"type:varchar(255)"`
+	ToState     NetworkState `gorm:"type:varchar(255)"`
+	Reason      string       `gorm:"type:text"`
+	ChangedBy   string       `gorm:"type:varchar(255)"`
+}
+
+// TransitionNetwork is used to move a network to a new lifecycle state,
+// recording why in the network's state history. The legacy Activated and
+// Disabled fields are kept in step with the new state.
+func (im *HostedNetworkManager) TransitionNetwork(name string, to NetworkState, reason string) (*HostedNetwork, error) {
+	if _, ok := networkTransitions[to]; !ok {
+		return nil, errors.New("unsupported network state")
+	}
+	pnet, err := im.GetNetworkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if !canTransitionNetwork(pnet.State, to) {
+		return nil, fmt.Errorf("network cannot move from %s to %s", pnet.State, to)
+	}
+	var (
+		from = pnet.State
+		// postgres stores times to the microsecond, the returned network
+		// must match what is stored for it to be saved again
+		now = time.Now().Truncate(time.Microsecond)
+	)
+	pnet.State = to
+	switch to {
+	case NetworkOnline, NetworkDegraded:
+		if pnet.Activated == nil {
+			pnet.Activated = &now
+		}
+		pnet.Disabled = false
+	case NetworkDisabled:
+		pnet.Activated = nil
+		pnet.Disabled = true
+	default:
+		pnet.Activated = nil
+		pnet.Disabled = false
+	}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		// only move the network if nobody else has moved it in the meantime
+		check := tx.Model(&HostedNetwork{}).Where(
+			"id = ? AND state = ?", pnet.ID, from,
+		).UpdateColumns(map[string]interface{}{
+			"state":     pnet.State,
+			"activated": pnet.Activated,
+			"disabled":  pnet.Disabled,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		if check.RowsAffected == 0 {
+			return fmt.Errorf("network is no longer %s", from)
+		}
+		return recordNetworkTransition(tx, name, from, to, reason, now)
+	}); err != nil {
+		return nil, err
+	}
+	return pnet, nil
+}
+
+// FindNetworksByState is used to find every network in any of the given states
+func (im *HostedNetworkManager) FindNetworksByState(states ...NetworkState) ([]*HostedNetwork, error) {
+	var networks = []*HostedNetwork{}
+	if len(states) == 0 {
+		return networks, nil
+	}
+	if err := im.DB.Where("state IN (?)", states).Order("name asc").Find(&networks).Error; err != nil {
+		return nil, err
+	}
+	for _, n := range networks {
+		if err := im.decryptNetwork(n); err != nil {
+			return nil, err
+		}
+	}
+	return networks, nil
+}
+
+// GetNetworkStateHistory is used to return every state change of a network, oldest first
+func (im *HostedNetworkManager) GetNetworkStateHistory(name string) ([]NetworkStateTransition, error) {
+	var history []NetworkStateTransition
+	if err := im.DB.Where("network_name = ?", name).Order(
+		"created_at asc, id asc",
+	).Find(&history).Error; err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// GetNetworkUptime is used to calculate how long a network was running
+// between two times, from its state history. Time spent degraded counts as
+// uptime, since the network is still serving requests.
+func (im *HostedNetworkManager) GetNetworkUptime(name string, since, until time.Time) (time.Duration, error) {
+	if until.Before(since) {
+		return 0, errors.New("until must not be before since")
+	}
+	history, err := im.GetNetworkStateHistory(name)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		uptime time.Duration
+		up     bool
+		cursor = since
+	)
+	for _, t := range history {
+		if !t.CreatedAt.After(since) {
+			// establishes the state at the start of the window
+			up = networkStateIsUp(t.ToState)
+			continue
+		}
+		if !t.CreatedAt.Before(until) {
+			break
+		}
+		if up {
+			uptime += t.CreatedAt.Sub(cursor)
+		}
+		cursor = t.CreatedAt
+		up = networkStateIsUp(t.ToState)
+	}
+	if up {
+		uptime += until.Sub(cursor)
+	}
+	return uptime, nil
+}
+
+// MigrateNetworkStates is used to assign a lifecycle state to networks
+// created before states existed, based on their Activated and Disabled
+// fields. Active networks are recorded as coming online when they were
+// activated, so that uptime is calculated from then.
+func (im *HostedNetworkManager) MigrateNetworkStates() error {
+	var networks []HostedNetwork
+	if err := im.DB.Where("state IS NULL OR state = ''").Find(&networks).Error; err != nil {
+		return err
+	}
+	for _, n := range networks {
+		var (
+			state = NetworkStopped
+			at    = time.Now()
+		)
+		switch {
+		case n.Disabled:
+			state = NetworkDisabled
+		case n.Activated != nil:
+			state = NetworkOnline
+			at = *n.Activated
+		}
+		if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+			if err := tx.Model(&n).UpdateColumn("state", state).Error; err != nil {
+				return err
+			}
+			return tx.Create(&NetworkStateTransition{
+				Model:       gorm.Model{CreatedAt: at},
+				NetworkName: n.Name,
+				ToState:     state,
+				Reason:      "migrated from activation status",
+				ChangedBy:   SystemActor,
+			}).Error
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordNetworkTransition stores a state change and its audit event
+func recordNetworkTransition(db *gorm.DB, name string, from, to NetworkState, reason string, at time.Time) error {
+	if err := db.Create(&NetworkStateTransition{
+		Model:       gorm.Model{CreatedAt: at},
+		NetworkName: name,
+		FromState:   from,
+		ToState:     to,
+		Reason:      reason,
+		ChangedBy:   ActorFrom(db),
+	}).Error; err != nil {
+		return err
+	}
+	return recordAudit(db, AuditNetworkStateChanged, AuditSubjectNetwork, name,
+		map[string]interface{}{"state": from},
+		map[string]interface{}{"state": to, "reason": reason},
+	)
+}
+
+// canTransitionNetwork returns whether a network may move between two states
+func canTransitionNetwork(from, to NetworkState) bool {
+	for _, s := range networkTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// networkStateIsUp returns whether a network in the given state is serving requests
+func networkStateIsUp(s NetworkState) bool {
+	return s == NetworkOnline || s == NetworkDegraded
+}
+
+// isNetworkStateAttr returns whether a network attribute is part of its lifecycle state
+func isNetworkStateAttr(attr string) bool {
+	switch attr {
+	case "state", "activated", "disabled", "State", "Activated", "Disabled":
+		return true
+	}
+	return false
+}
+
+// sameNetworkState returns whether two copies of a network are in the same lifecycle state
+func sameNetworkState(a, b *HostedNetwork) bool {
+	return a.State == b.State && a.Disabled == b.Disabled && sameTime(a.Activated, b.Activated)
+}
+
+// sameTime returns whether two optional times are both unset or equal to
+// the precision they are stored with
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Truncate(time.Microsecond).Equal(b.Truncate(time.Microsecond))
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+func TestHostedNetworkManager_TransitionNetwork(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(WithActor(db, "stateadmin"))
+	network, err := hm.CreateHostedPrivateNetwork(
+		"statenetwork", testSwarmKey, nil,
+		NetworkAccessOptions{Owner: "stateowner"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("statenetwork")
+	if network.State != NetworkRequested {
+		t.Fatalf("unexpected initial state %s", network.State)
+	}
+	if _, err := hm.TransitionNetwork("statenetwork", NetworkOnline, "skipped provisioning"); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.TransitionNetwork("statenetwork", "notarealstate", ""); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.TransitionNetwork("statenetwork", NetworkProvisioning, "deploying"); err != nil {
+		t.Fatal(err)
+	}
+	network, err = hm.TransitionNetwork("statenetwork", NetworkOnline, "deployed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.Activated == nil {
+		t.Fatal("online network should be activated")
+	}
+	// the lifecycle state may only be changed through transitions
+	if err := hm.UpdateNetworkByName("statenetwork", map[string]interface{}{
+		"disabled": true,
+	}); err == nil || err.Error() != ErrNetworkStateNotTransitioned {
+		t.Fatalf("expected state error, got %v", err)
+	}
+	// the network returned by a transition can be saved as it is
+	if err := hm.SaveNetwork(network); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := hm.GetNetworkByName("statenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped.State = NetworkStopped
+	if err := hm.SaveNetwork(stopped); err == nil || err.Error() != ErrNetworkStateNotTransitioned {
+		t.Fatalf("expected state error, got %v", err)
+	}
+	if networks, err := hm.FindNetworksByState(NetworkOnline, NetworkDegraded); err != nil {
+		t.Fatal(err)
+	} else if len(networks) != 1 || networks[0].Name != "statenetwork" {
+		t.Fatal("failed to find online network")
+	}
+	network, err = hm.TransitionNetwork("statenetwork", NetworkDisabled, "abuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.Activated != nil || !network.Disabled {
+		t.Fatal("disabled network should be offline and disabled")
+	}
+	if offline, err := hm.GetOfflineNetworks(true); err != nil {
+		t.Fatal(err)
+	} else if len(offline) != 1 {
+		t.Fatal("disabled network should be offline")
+	}
+	history, err := hm.GetNetworkStateHistory("statenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []NetworkState{NetworkRequested, NetworkProvisioning, NetworkOnline, NetworkDisabled}
+	if len(history) != len(want) {
+		t.Fatalf("expected %v transitions, got %v", len(want), len(history))
+	}
+	for i, transition := range history {
+		if transition.ToState != want[i] {
+			t.Fatalf("transition %v: expected %s, got %s", i, want[i], transition.ToState)
+		}
+		if transition.ChangedBy != "stateadmin" {
+			t.Fatalf("unexpected actor %s", transition.ChangedBy)
+		}
+	}
+}
+
+func TestHostedNetworkManager_GetNetworkUptime(t *testing.T) {
+	db := newTestDB(t, &HostedNetwork{})
+	defer db.Close()
+	db.AutoMigrate(NetworkStateTransition{})
+	var (
+		hm    = NewHostedNetworkManager(db)
+		start = time.Now().Add(-10 * time.Hour)
+	)
+	defer db.Unscoped().Where("network_name = ?", "uptimenetwork").Delete(&NetworkStateTransition{})
+	for _, transition := range []struct {
+		at    time.Duration
+		state NetworkState
+	}{
+		{0, NetworkProvisioning},
+		{time.Hour, NetworkOnline},
+		{3 * time.Hour, NetworkDegraded},
+		{4 * time.Hour, NetworkStopped},
+		{6 * time.Hour, NetworkProvisioning},
+		{7 * time.Hour, NetworkOnline},
+	} {
+		if err := db.Create(&NetworkStateTransition{
+			Model:       gorm.Model{CreatedAt: start.Add(transition.at)},
+			NetworkName: "uptimenetwork",
+			ToState:     transition.state,
+		}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name         string
+		since, until time.Duration
+		want         time.Duration
+	}{
+		{"whole history", 0, 9 * time.Hour, 5 * time.Hour},
+		{"starts online", 2 * time.Hour, 5 * time.Hour, 2 * time.Hour},
+		{"while stopped", 4 * time.Hour, 6 * time.Hour, 0},
+		{"before history", -time.Hour, time.Hour, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hm.GetNetworkUptime("uptimenetwork", start.Add(tt.since), start.Add(tt.until))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected uptime %v, got %v", tt.want, got)
+			}
+		})
+	}
+	if _, err := hm.GetNetworkUptime("uptimenetwork", start, start.Add(-time.Hour)); err == nil {
+		t.Fatal("error expected")
+	}
+}
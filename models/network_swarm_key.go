@@ -0,0 +1,135 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+// ErrSwarmKeyNotRotated is an error triggered when changing the swarm key of
+// a network other than with RotateSwarmKey
+const ErrSwarmKeyNotRotated = "swarm keys must be changed with RotateSwarmKey"
+
+// SwarmKeyRotation is a record of the swarm key of a network being replaced.
+// Keys are identified by fingerprint so the history never holds a key.
+type SwarmKeyRotation struct {
+	gorm.Model
+	NetworkName         string `gorm:"type:varchar(255);index"`
+	Fingerprint         string `gorm:"type:varchar(255)"`
+	PreviousFingerprint string `gorm:"type:varchar(255)"`
+	ActivatesAt         time.Time
+	RotatedBy           string `gorm:"type:varchar(255)"`
+}
+
+// RotateSwarmKey is used to replace the swarm key of a network, returning
+// the new key. Nodes keep using the previous key until activateAt, so that
+// every node can be given the new key before any switches to it. If swarmKey
+// is empty a new key is generated, and a zero activateAt activates it
+// immediately. A network may only have one rotation pending at a time.
+func (im *HostedNetworkManager) RotateSwarmKey(network, swarmKey string, activateAt time.Time) (string, error) {
+	if swarmKey == "" {
+		generated, err := utils.GenerateSwarmKey()
+		if err != nil {
+			return "", err
+		}
+		swarmKey = generated
+	}
+	key, err := utils.ParseSwarmKey(swarmKey)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if activateAt.IsZero() {
+		activateAt = now
+	}
+	pnet, err := im.GetNetworkByName(network)
+	if err != nil {
+		return "", err
+	}
+	if swarmKeyRotationPending(pnet, now) {
+		return "", errors.New("swarm key rotation is already pending")
+	}
+	// compare the keys themselves, since the same key may be formatted differently
+	previousFingerprint := swarmKeyFingerprint(pnet.SwarmKey)
+	if previousFingerprint == utils.SwarmKeyFingerprint(key) {
+		return "", errors.New("new swarm key must differ from the current key")
+	}
+	encryptedKey, err := encryptSecret(im.DB, swarmKey)
+	if err != nil {
+		return "", err
+	}
+	encryptedPrevious, err := encryptSecret(im.DB, pnet.SwarmKey)
+	if err != nil {
+		return "", err
+	}
+	rotation := &SwarmKeyRotation{
+		NetworkName:         network,
+		Fingerprint:         utils.SwarmKeyFingerprint(key),
+		PreviousFingerprint: previousFingerprint,
+		ActivatesAt:         activateAt,
+		RotatedBy:           ActorFrom(im.DB),
+	}
+	if err := withTransaction(im.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(pnet).UpdateColumns(map[string]interface{}{
+			"swarm_key":              encryptedKey,
+			"previous_swarm_key":     encryptedPrevious,
+			"swarm_key_activates_at": activateAt,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(rotation).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditNetworkSwarmKeyRotated, AuditSubjectNetwork, network,
+			map[string]interface{}{"fingerprint": rotation.PreviousFingerprint},
+			map[string]interface{}{"fingerprint": rotation.Fingerprint, "activates_at": activateAt},
+		)
+	}); err != nil {
+		return "", err
+	}
+	return swarmKey, nil
+}
+
+// GetSwarmKeyRotations is used to return the swarm key rotations of a network, oldest first
+func (im *HostedNetworkManager) GetSwarmKeyRotations(network string) ([]SwarmKeyRotation, error) {
+	var rotations []SwarmKeyRotation
+	if err := im.DB.Where("network_name = ?", network).Order(
+		"created_at asc, id asc",
+	).Find(&rotations).Error; err != nil {
+		return nil, err
+	}
+	return rotations, nil
+}
+
+// swarmKeyRotationPending returns whether a network's nodes should still be
+// using the previous swarm key
+func swarmKeyRotationPending(n *HostedNetwork, now time.Time) bool {
+	return n.PreviousSwarmKey != "" &&
+		n.SwarmKeyActivatesAt != nil &&
+		now.Before(*n.SwarmKeyActivatesAt)
+}
+
+// isSwarmKeyAttr returns whether a network attribute is part of its swarm key rotation
+func isSwarmKeyAttr(attr string) bool {
+	switch attr {
+	case "swarm_key", "previous_swarm_key", "swarm_key_activates_at",
+		"SwarmKey", "PreviousSwarmKey", "SwarmKeyActivatesAt":
+		return true
+	}
+	return false
+}
+
+// swarmKeyFingerprint fingerprints the contents of a swarm.key file, falling
+// back to the raw contents for keys stored before they were validated
+func swarmKeyFingerprint(contents string) string {
+	if contents == "" {
+		return ""
+	}
+	key, err := utils.ParseSwarmKey(contents)
+	if err != nil {
+		key = []byte(contents)
+	}
+	return utils.SwarmKeyFingerprint(key)
+}
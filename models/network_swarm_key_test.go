@@ -0,0 +1,99 @@
+package models
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+func TestHostedNetworkManager_RotateSwarmKey(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var hm = NewHostedNetworkManager(WithActor(db, "rotateadmin"))
+	if _, err := hm.CreateHostedPrivateNetwork(
+		"rotatenetwork", "such swarm much protec", nil,
+		NetworkAccessOptions{Owner: "rotateowner"},
+	); err == nil {
+		t.Fatal("invalid swarm keys should be rejected")
+	}
+	// a swarm key is generated when none is given
+	network, err := hm.CreateHostedPrivateNetwork(
+		"rotatenetwork", "", nil,
+		NetworkAccessOptions{Owner: "rotateowner"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("rotatenetwork")
+	original := network.SwarmKey
+	if _, err := utils.ParseSwarmKey(original); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hm.RotateSwarmKey("rotatenetwork", "notaswarmkey", time.Time{}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := hm.RotateSwarmKey("rotatenetwork", original, time.Time{}); err == nil {
+		t.Fatal("error expected")
+	}
+	// the same key in another encoding is still the current key
+	reencodedKey, err := utils.ParseSwarmKey(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reencoded := utils.SwarmKeyHeader + "\n/base64/\n" + base64.StdEncoding.EncodeToString(reencodedKey) + "\n"
+	if _, err := hm.RotateSwarmKey("rotatenetwork", reencoded, time.Time{}); err == nil {
+		t.Fatal("error expected")
+	}
+	activateAt := time.Now().Add(time.Hour)
+	next, err := hm.RotateSwarmKey("rotatenetwork", "", activateAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nodes keep using the previous key until the new one activates
+	details, err := hm.GetSwarmDetails("rotatenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Key != original || details.NextKey != next || details.NextKeyActivatesAt == nil {
+		t.Fatal("previous key should be in use until activation")
+	}
+	if _, err := hm.RotateSwarmKey("rotatenetwork", "", time.Time{}); err == nil {
+		t.Fatal("only one rotation may be pending")
+	}
+	// pretend the activation time has passed
+	if err := db.Model(&HostedNetwork{}).Where("name = ?", "rotatenetwork").UpdateColumn(
+		"swarm_key_activates_at", time.Now().Add(-time.Minute),
+	).Error; err != nil {
+		t.Fatal(err)
+	}
+	details, err = hm.GetSwarmDetails("rotatenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Key != next || details.NextKey != "" {
+		t.Fatal("new key should be in use after activation")
+	}
+	if _, err := hm.RotateSwarmKey("rotatenetwork", "", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	rotations, err := hm.GetSwarmKeyRotations("rotatenetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotations) != 2 {
+		t.Fatalf("expected 2 rotations, got %v", len(rotations))
+	}
+	key, err := utils.ParseSwarmKey(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotations[0].Fingerprint != utils.SwarmKeyFingerprint(key) ||
+		rotations[1].PreviousFingerprint != rotations[0].Fingerprint {
+		t.Fatal("rotation history should chain key fingerprints")
+	}
+	if rotations[0].RotatedBy != "rotateadmin" {
+		t.Fatalf("unexpected actor %s", rotations[0].RotatedBy)
+	}
+}
@@ -37,7 +37,14 @@ func (om *OrgManager) NewOrganization(name, owner string) (*Organization, error)
 		Name:         name,
 		AccountOwner: owner,
 	}
-	if err := om.DB.Create(org).Error; err != nil {
+	if err := withTransaction(om.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditOrgCreated, AuditSubjectOrganization, name,
+			nil, map[string]interface{}{"account_owner": owner},
+		)
+	}); err != nil {
 		return nil, err
 	}
 	return org, nil
@@ -50,43 +57,52 @@ func (om *OrgManager) RegisterOrgUser(
 	password,
 	email string,
 ) (*User, error) {
-	// create the user account
-	user, err := NewUserManager(om.DB).NewUserAccount(
-		username,
-		password,
-		email,
-	)
-	if err != nil {
-		return nil, err
-	}
-	// update user model associated organization
-	user.Organization = orgName
-	// save updated user model
-	if err := om.DB.Model(user).Update(
-		"organization", user.Organization,
-	).Error; err != nil {
-		return nil, err
-	}
-	// update their tier to white-labeled
-	// which will enable organizational based billing
-	if err := NewUsageManager(om.DB).UpdateTier(
-		username,
-		WhiteLabeled,
-	); err != nil {
-		return nil, err
-	}
-	// find organization model
-	org, err := om.FindByName(orgName)
-	if err != nil {
-		return nil, err
-	}
-	// update organization registered users
-	org.RegisteredUsers = append(org.RegisteredUsers, username)
-	// save updated org model model
-	if err := om.DB.Model(org).Update(
-		"registered_users",
-		org.RegisteredUsers,
-	).Error; err != nil {
+	var user *User
+	if err := withTransaction(om.DB, func(tx *gorm.DB) error {
+		var err error
+		// create the user account
+		user, err = NewUserManager(tx).NewUserAccount(
+			username,
+			password,
+			email,
+		)
+		if err != nil {
+			return err
+		}
+		// update user model associated organization
+		user.Organization = orgName
+		// save updated user model
+		if err := tx.Model(user).Update(
+			"organization", user.Organization,
+		).Error; err != nil {
+			return err
+		}
+		// update their tier to white-labeled
+		// which will enable organizational based billing
+		if err := NewUsageManager(tx).UpdateTier(
+			username,
+			WhiteLabeled,
+		); err != nil {
+			return err
+		}
+		// find organization model
+		org, err := NewOrgManager(tx).FindByName(orgName)
+		if err != nil {
+			return err
+		}
+		// update organization registered users
+		org.RegisteredUsers = append(org.RegisteredUsers, username)
+		// save updated org model model
+		if err := tx.Model(org).Update(
+			"registered_users",
+			org.RegisteredUsers,
+		).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditOrgUserRegistered, AuditSubjectOrganization, orgName,
+			nil, map[string]interface{}{"user_name": username},
+		)
+	}); err != nil {
 		return nil, err
 	}
 	return user, nil
@@ -122,21 +138,20 @@ func (om *OrgManager) IncreaseAmountOwed(name string, amount float64) error {
 	if org.AmountOwed+amount < org.AmountOwed {
 		return errors.New("account balance overflow error")
 	}
-	// craete database tx handler
-	tx := om.DB.Begin()
+	before := org.AmountOwed
 	org.AmountOwed = org.AmountOwed + amount
 	// update model account_balance field transacationally
 	// rolling back all pending-transactinos if we detect an error
-	if check := tx.Model(org).
-		Update(
-			"amount_owed",
-			org.AmountOwed,
-		); check.Error != nil {
-		tx.Rollback()
-		return err
-	}
-	// commit the transaction, returning an error (if any)
-	return tx.Commit().Error
+	return withTransaction(om.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(org).
+			Update(
+				"amount_owed",
+				org.AmountOwed,
+			); check.Error != nil {
+			return check.Error
+		}
+		return om.auditAmountOwed(tx, name, before, org.AmountOwed)
+	})
 }
 
 // DecreaseAmountOwed decreases the amount owed by this account
@@ -148,20 +163,28 @@ func (om *OrgManager) DecreaseAmountOwed(name string, amount float64) error {
 	if org.AmountOwed-amount > org.AmountOwed {
 		return errors.New("account balance overflow error")
 	}
-	tx := om.DB.Begin()
+	before := org.AmountOwed
 	org.AmountOwed = org.AmountOwed - amount
 	// update model account_balance field transacationally
 	// rolling back all pending-transactinos if we detect an error
-	if check := tx.Model(org).
-		Update(
-			"amount_owed",
-			org.AmountOwed,
-		); check.Error != nil {
-		tx.Rollback()
-		return err
-	}
-	// commit the transaction, returning an error (if any)
-	return tx.Commit().Error
+	return withTransaction(om.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(org).
+			Update(
+				"amount_owed",
+				org.AmountOwed,
+			); check.Error != nil {
+			return check.Error
+		}
+		return om.auditAmountOwed(tx, name, before, org.AmountOwed)
+	})
+}
+
+// auditAmountOwed records a change to the amount owed by an organization
+func (om *OrgManager) auditAmountOwed(tx *gorm.DB, name string, before, after float64) error {
+	return recordAudit(tx, AuditOrgAmountOwedChanged, AuditSubjectOrganization, name,
+		map[string]interface{}{"amount_owed": before},
+		map[string]interface{}{"amount_owed": after},
+	)
 }
 
 // GetTotalStorageUsed returns the total storage in bytes consumed
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordAlgorithm is an algorithm used to hash passwords
+type PasswordAlgorithm string
+
+var (
+	// PasswordBcrypt hashes passwords with bcrypt, stored hex encoded
+	PasswordBcrypt PasswordAlgorithm = "bcrypt"
+	// PasswordArgon2id hashes passwords with argon2id, stored in the PHC string format
+	PasswordArgon2id PasswordAlgorithm = "argon2id"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// PasswordHashOptions configures how new password hashes are generated.
+// Stored hashes that don't match these options are upgraded on sign-in.
+type PasswordHashOptions struct {
+	Algorithm     PasswordAlgorithm
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32 // in KiB
+	Argon2Threads uint8
+}
+
+// DefaultPasswordHashOptions hashes passwords with bcrypt at the default cost
+var DefaultPasswordHashOptions = PasswordHashOptions{
+	Algorithm:     PasswordBcrypt,
+	BcryptCost:    bcrypt.DefaultCost,
+	Argon2Time:    1,
+	Argon2Memory:  64 * 1024,
+	Argon2Threads: 4,
+}
+
+// PasswordPolicy configures which passwords users are allowed to choose
+type PasswordPolicy struct {
+	MinLength int
+	// CommonPasswords is a set of lowercased passwords that are rejected,
+	// typically loaded with LoadCommonPasswords
+	CommonPasswords map[string]bool
+	// HistorySize is the number of previous passwords that can't be reused
+	HistorySize int
+}
+
+// DefaultPasswordPolicy requires passwords of at least 8 characters
+var DefaultPasswordPolicy = PasswordPolicy{MinLength: 8}
+
+// LoadCommonPasswords is used to load a newline separated list of common
+// or breached passwords from a local file, for use in a PasswordPolicy
+func LoadCommonPasswords(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	passwords := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			passwords[strings.ToLower(line)] = true
+		}
+	}
+	return passwords, scanner.Err()
+}
+
+// Validate is used to check a password against the length and common password
+// rules of the policy. Reuse is checked separately as it requires the database.
+func (p PasswordPolicy) Validate(password string) error {
+	if len(password) < p.MinLength {
+		return fmt.Errorf("password must be at least %v characters long", p.MinLength)
+	}
+	if p.CommonPasswords[strings.ToLower(password)] {
+		return errors.New("password is too common, please choose another")
+	}
+	return nil
+}
+
+// PasswordHistory is a previously used password hash of a user
+type PasswordHistory struct {
+	gorm.Model
+	UserName       string `gorm:"type:varchar(255);index"`
+	HashedPassword string `gorm:"type:varchar(255)"`
+}
+
+// withDefaults returns the options with unset costs filled in from
+// DefaultPasswordHashOptions
+func (opts PasswordHashOptions) withDefaults() PasswordHashOptions {
+	if opts.BcryptCost == 0 {
+		opts.BcryptCost = DefaultPasswordHashOptions.BcryptCost
+	}
+	if opts.Argon2Time == 0 {
+		opts.Argon2Time = DefaultPasswordHashOptions.Argon2Time
+	}
+	if opts.Argon2Memory == 0 {
+		opts.Argon2Memory = DefaultPasswordHashOptions.Argon2Memory
+	}
+	if opts.Argon2Threads == 0 {
+		opts.Argon2Threads = DefaultPasswordHashOptions.Argon2Threads
+	}
+	return opts
+}
+
+// hashPassword is used to hash a password according to the given options
+func hashPassword(opts PasswordHashOptions, password string) (string, error) {
+	opts = opts.withDefaults()
+	switch opts.Algorithm {
+	case PasswordArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, opts.Argon2Time, opts.Argon2Memory, opts.Argon2Threads, 32)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2idPrefix, argon2.Version, opts.Argon2Memory, opts.Argon2Time, opts.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	case PasswordBcrypt, "":
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), opts.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hashed), nil
+	default:
+		return "", errors.New("unsupported password algorithm")
+	}
+}
+
+// comparePassword is used to check a password against a stored hash of any supported algorithm
+func comparePassword(hashed, password string) (bool, error) {
+	if strings.HasPrefix(hashed, argon2idPrefix) {
+		params, salt, key, err := decodeArgon2id(hashed)
+		if err != nil {
+			return false, err
+		}
+		other := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(key)))
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+	decoded, err := hex.DecodeString(hashed)
+	if err != nil {
+		return false, err
+	}
+	if err := bcrypt.CompareHashAndPassword(decoded, []byte(password)); err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// needsRehash is used to check whether a stored hash was generated with
+// different options than those currently configured
+func needsRehash(opts PasswordHashOptions, hashed string) bool {
+	opts = opts.withDefaults()
+	if strings.HasPrefix(hashed, argon2idPrefix) {
+		if opts.Algorithm != PasswordArgon2id {
+			return true
+		}
+		params, _, _, err := decodeArgon2id(hashed)
+		return err != nil ||
+			params.Argon2Time != opts.Argon2Time ||
+			params.Argon2Memory != opts.Argon2Memory ||
+			params.Argon2Threads != opts.Argon2Threads
+	}
+	if opts.Algorithm != PasswordBcrypt && opts.Algorithm != "" {
+		return true
+	}
+	decoded, err := hex.DecodeString(hashed)
+	if err != nil {
+		return true
+	}
+	cost, err := bcrypt.Cost(decoded)
+	return err != nil || cost != opts.BcryptCost
+}
+
+// decodeArgon2id parses an argon2id hash in the PHC string format
+func decodeArgon2id(hashed string) (PasswordHashOptions, []byte, []byte, error) {
+	var (
+		opts    = PasswordHashOptions{Algorithm: PasswordArgon2id}
+		version int
+	)
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return opts, nil, nil, errors.New("invalid argon2id hash")
+	}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return opts, nil, nil, err
+	}
+	if version != argon2.Version {
+		return opts, nil, nil, errors.New("unsupported argon2 version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d",
+		&opts.Argon2Memory, &opts.Argon2Time, &opts.Argon2Threads); err != nil {
+		return opts, nil, nil, err
+	}
+	if opts.Argon2Time == 0 || opts.Argon2Threads == 0 {
+		return opts, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return opts, nil, nil, err
+	}
+	return opts, salt, key, nil
+}
@@ -0,0 +1,98 @@
+package models
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashing(t *testing.T) {
+	var (
+		bcryptOpts = PasswordHashOptions{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost}
+		argonOpts  = PasswordHashOptions{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	)
+	tests := []struct {
+		name          string
+		opts          PasswordHashOptions
+		upgrade       PasswordHashOptions
+		wantUpgrade   bool
+		wantHashError bool
+	}{
+		{"Bcrypt", bcryptOpts, bcryptOpts, false, false},
+		{"Bcrypt-Cost", bcryptOpts, PasswordHashOptions{Algorithm: PasswordBcrypt, BcryptCost: bcrypt.MinCost + 1}, true, false},
+		{"Bcrypt-To-Argon2id", bcryptOpts, argonOpts, true, false},
+		{"Argon2id", argonOpts, argonOpts, false, false},
+		{"Argon2id-Params", argonOpts, PasswordHashOptions{Algorithm: PasswordArgon2id, Argon2Time: 2, Argon2Memory: 1024, Argon2Threads: 1}, true, false},
+		{"Argon2id-To-Bcrypt", argonOpts, bcryptOpts, true, false},
+		{"Argon2id-Defaults", PasswordHashOptions{Algorithm: PasswordArgon2id}, PasswordHashOptions{Algorithm: PasswordArgon2id}, false, false},
+		{"Unsupported", PasswordHashOptions{Algorithm: "md5"}, bcryptOpts, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashed, err := hashPassword(tt.opts, "password123")
+			if (err != nil) != tt.wantHashError {
+				t.Fatalf("hashPassword() err = %v, wantErr %v", err, tt.wantHashError)
+			}
+			if tt.wantHashError {
+				return
+			}
+			if valid, err := comparePassword(hashed, "password123"); err != nil {
+				t.Fatal(err)
+			} else if !valid {
+				t.Fatal("password should match")
+			}
+			if valid, err := comparePassword(hashed, "password1234"); err != nil {
+				t.Fatal(err)
+			} else if valid {
+				t.Fatal("password should not match")
+			}
+			if upgrade := needsRehash(tt.upgrade, hashed); upgrade != tt.wantUpgrade {
+				t.Fatalf("needsRehash() = %v, want %v", upgrade, tt.wantUpgrade)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "password-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "common.txt")
+	if err := ioutil.WriteFile(path, []byte("password123\n\nQwertyuiop\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	common, err := LoadCommonPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(common) != 2 {
+		t.Fatalf("expected 2 common passwords, got %v", len(common))
+	}
+	policy := PasswordPolicy{MinLength: 8, CommonPasswords: common}
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"Valid", "correct horse battery staple", false},
+		{"Empty", "", true},
+		{"Short", "short", true},
+		{"Common", "password123", true},
+		{"Common-Case", "qwertyUIOP", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := policy.Validate(tt.password); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() err = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := LoadCommonPasswords(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Fatal("error expected")
+	}
+}
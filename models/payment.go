@@ -84,8 +84,20 @@ func (pm *PaymentManager) NewPayment(number int64, depositAddress string, txHash
 		ChargeAmount:   chargeAmount,
 	}
 
-	if check := pm.DB.Create(&p); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(pm.DB, func(tx *gorm.DB) error {
+		if check := tx.Create(&p); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditPaymentCreated, AuditSubjectUser, username, nil, map[string]interface{}{
+			"number":        number,
+			"tx_hash":       txHash,
+			"blockchain":    blockchain,
+			"type":          paymentType,
+			"usd_value":     usdValue,
+			"charge_amount": chargeAmount,
+		})
+	}); err != nil {
+		return nil, err
 	}
 
 	return &p, nil
@@ -98,8 +110,15 @@ func (pm *PaymentManager) ConfirmPayment(txHash string) (*Payments, error) {
 		return nil, err
 	}
 	p.Confirmed = true
-	if check := pm.DB.Model(p).Update("confirmed", p.Confirmed); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(pm.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(p).Update("confirmed", p.Confirmed); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditPaymentConfirmed, AuditSubjectUser, p.UserName,
+			nil, map[string]interface{}{"number": p.Number, "tx_hash": p.TxHash},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return p, nil
 }
@@ -119,9 +138,18 @@ func (pm *PaymentManager) UpdatePaymentTxHash(username, txHash string, number in
 	if err != nil {
 		return nil, err
 	}
+	before := payment.TxHash
 	payment.TxHash = txHash
-	if check := pm.DB.Model(payment).Update("tx_hash", payment.TxHash); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(pm.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(payment).Update("tx_hash", payment.TxHash); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditPaymentTxHashChanged, AuditSubjectUser, username,
+			map[string]interface{}{"number": number, "tx_hash": before},
+			map[string]interface{}{"number": number, "tx_hash": txHash},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return payment, nil
 }
@@ -34,9 +34,18 @@ func (rm *RecordManager) UpdateLatestIPFSHash(username, recordName, ipfsHash str
 	if err != nil {
 		return nil, err
 	}
+	before := r.LatestIPFSHash
 	r.LatestIPFSHash = ipfsHash
-	if check := rm.DB.Model(r).Update("latest_ip_fs_hash", r.LatestIPFSHash); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(r).Update("latest_ip_fs_hash", r.LatestIPFSHash); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditRecordUpdated, AuditSubjectRecord, recordName,
+			map[string]interface{}{"user_name": username, "latest_ipfs_hash": before},
+			map[string]interface{}{"user_name": username, "latest_ipfs_hash": ipfsHash},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return r, nil
 }
@@ -64,8 +73,17 @@ func (rm *RecordManager) AddRecord(username, recordName, recordKeyName, zoneName
 	if len(metadata) > 0 {
 		r.MetaData = rm.stringifyMetaData(metadata)
 	}
-	if check := rm.DB.Create(&r); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if check := tx.Create(&r); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditRecordCreated, AuditSubjectRecord, recordName, nil, map[string]interface{}{
+			"user_name":       username,
+			"record_key_name": recordKeyName,
+			"zone_name":       zoneName,
+		})
+	}); err != nil {
+		return nil, err
 	}
 	return &r, nil
 }
@@ -0,0 +1,366 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/lib/pq"
+)
+
+// Permission is an action that may be granted to users through a role
+type Permission string
+
+// String returns the value of Permission as a string
+func (p Permission) String() string {
+	return string(p)
+}
+
+var (
+	// PermManageUsers allows managing user accounts
+	PermManageUsers Permission = "manage-users"
+	// PermManageNetworks allows managing hosted private networks
+	PermManageNetworks Permission = "manage-networks"
+	// PermViewBilling allows viewing billing details of any account
+	PermViewBilling Permission = "view-billing"
+	// PermIssueRefunds allows issuing refunds and credits
+	PermIssueRefunds Permission = "issue-refunds"
+
+	// AllPermissions is every permission known to the system
+	AllPermissions = []Permission{
+		PermManageUsers,
+		PermManageNetworks,
+		PermViewBilling,
+		PermIssueRefunds,
+	}
+)
+
+const (
+	// AdminRole is the name of the role holding every permission,
+	// which replaces the legacy User.AdminAccess flag
+	AdminRole = "admin"
+	// SystemActor is recorded as the actor for changes not made by a user
+	SystemActor = "system"
+)
+
+// Role is a named set of permissions
+type Role struct {
+	gorm.Model
+	Name        string         `gorm:"type:varchar(255);unique"`
+	Description string         `gorm:"type:varchar(255)"`
+	Permissions pq.StringArray `gorm:"type:text[]"`
+}
+
+// HasPermission returns whether the role grants the given permission
+func (r *Role) HasPermission(perm Permission) bool {
+	for _, p := range r.Permissions {
+		if p == perm.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// UserRole assigns a role to a user. Assignments are never removed, instead
+// they are marked as revoked so that there is a record of who granted what.
+type UserRole struct {
+	gorm.Model
+	UserName  string `gorm:"type:varchar(255);index"`
+	RoleName  string `gorm:"type:varchar(255)"`
+	GrantedBy string `gorm:"type:varchar(255)"`
+	RevokedBy string `gorm:"type:varchar(255)"`
+	RevokedAt *time.Time
+}
+
+// RoleManager is used to manipulate roles and their assignments
+type RoleManager struct {
+	DB *gorm.DB
+}
+
+// NewRoleManager is used to generate our role manager helper
+func NewRoleManager(db *gorm.DB) *RoleManager {
+	return &RoleManager{DB: db}
+}
+
+// NewRole is used to create a new role
+func (rm *RoleManager) NewRole(name, description string, perms []Permission) (*Role, error) {
+	if err := validatePermissions(perms); err != nil {
+		return nil, err
+	}
+	if _, err := rm.FindRoleByName(name); err == nil {
+		return nil, errors.New("role already exists")
+	}
+	role := &Role{
+		Name:        name,
+		Description: description,
+		Permissions: permissionsToArray(perms),
+	}
+	if err := withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(role).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditRoleCreated, AuditSubjectRole, name,
+			nil, map[string]interface{}{"permissions": role.Permissions},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// FindRoleByName is used to find a role by its name
+func (rm *RoleManager) FindRoleByName(name string) (*Role, error) {
+	role := &Role{}
+	if err := rm.DB.Where("name = ?", name).First(role).Error; err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// GetRoles is used to return all roles
+func (rm *RoleManager) GetRoles() ([]Role, error) {
+	var roles []Role
+	if err := rm.DB.Order("name asc").Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// UpdateRolePermissions is used to replace the permissions granted by a role
+func (rm *RoleManager) UpdateRolePermissions(name string, perms []Permission) (*Role, error) {
+	if err := validatePermissions(perms); err != nil {
+		return nil, err
+	}
+	role, err := rm.FindRoleByName(name)
+	if err != nil {
+		return nil, err
+	}
+	before := role.Permissions
+	role.Permissions = permissionsToArray(perms)
+	if err := withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(role).Update("permissions", role.Permissions).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditRoleUpdated, AuditSubjectRole, name,
+			map[string]interface{}{"permissions": before},
+			map[string]interface{}{"permissions": role.Permissions},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+// DeleteRole is used to remove a role, revoking it from every user it is assigned to
+func (rm *RoleManager) DeleteRole(name, actor string) error {
+	role, err := rm.FindRoleByName(name)
+	if err != nil {
+		return err
+	}
+	return withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(&UserRole{}).Where(
+			"role_name = ? AND revoked_at IS NULL", name,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at": time.Now(),
+			"revoked_by": actor,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(role).Error; err != nil {
+			return err
+		}
+		if name == AdminRole {
+			if err := clearAdminAccess(tx, nil); err != nil {
+				return err
+			}
+		}
+		return recordAudit(tx, AuditRoleDeleted, AuditSubjectRole, name,
+			map[string]interface{}{"permissions": role.Permissions}, nil,
+		)
+	})
+}
+
+// AssignRole is used to grant a role to a user
+func (rm *RoleManager) AssignRole(username, roleName, grantedBy string) (*UserRole, error) {
+	if _, err := rm.FindRoleByName(roleName); err != nil {
+		return nil, err
+	}
+	if has, err := rm.HasRole(username, roleName); err != nil {
+		return nil, err
+	} else if has {
+		return nil, errors.New("user already has role")
+	}
+	assignment := &UserRole{
+		UserName:  username,
+		RoleName:  roleName,
+		GrantedBy: grantedBy,
+	}
+	if err := withTransaction(rm.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(assignment).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditRoleAssigned, AuditSubjectUser, username,
+			nil, map[string]interface{}{"role": roleName, "granted_by": grantedBy},
+		)
+	}); err != nil {
+		return nil, err
+	}
+	return assignment, nil
+}
+
+// RevokeRole is used to remove a role from a user
+func (rm *RoleManager) RevokeRole(username, roleName, revokedBy string) error {
+	return withTransaction(rm.DB, func(tx *gorm.DB) error {
+		check := tx.Model(&UserRole{}).Where(
+			"user_name = ? AND role_name = ? AND revoked_at IS NULL", username, roleName,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at": time.Now(),
+			"revoked_by": revokedBy,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		if check.RowsAffected == 0 {
+			return errors.New("user does not have role")
+		}
+		if roleName == AdminRole {
+			if err := clearAdminAccess(tx, []string{username}); err != nil {
+				return err
+			}
+		}
+		return recordAudit(tx, AuditRoleRevoked, AuditSubjectUser, username,
+			map[string]interface{}{"role": roleName, "revoked_by": revokedBy}, nil,
+		)
+	})
+}
+
+// HasRole is used to check if a user currently has a role
+func (rm *RoleManager) HasRole(username, roleName string) (bool, error) {
+	var count int
+	err := rm.DB.Model(&UserRole{}).Where(
+		"user_name = ? AND role_name = ? AND revoked_at IS NULL", username, roleName,
+	).Count(&count).Error
+	return count > 0, err
+}
+
+// GetRolesForUser is used to return the roles currently assigned to a user
+func (rm *RoleManager) GetRolesForUser(username string) ([]Role, error) {
+	var roles []Role
+	if err := rm.DB.Table("roles").Select("roles.*").Joins(
+		"JOIN user_roles ON user_roles.role_name = roles.name",
+	).Where(
+		"user_roles.user_name = ? AND user_roles.revoked_at IS NULL AND user_roles.deleted_at IS NULL", username,
+	).Find(&roles).Error; err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+// GetRoleHistoryForUser is used to return every role assignment a user has
+// ever had, including revoked assignments, most recent first
+func (rm *RoleManager) GetRoleHistoryForUser(username string) ([]UserRole, error) {
+	var assignments []UserRole
+	if err := rm.DB.Where("user_name = ?", username).Order(
+		"created_at desc",
+	).Find(&assignments).Error; err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+// GetUsersWithRole is used to return the names of all users currently assigned a role
+func (rm *RoleManager) GetUsersWithRole(roleName string) ([]string, error) {
+	var users []string
+	err := rm.DB.Model(&UserRole{}).Where(
+		"role_name = ? AND revoked_at IS NULL", roleName,
+	).Pluck("user_name", &users).Error
+	return users, err
+}
+
+// HasPermission is used to check if any of a user's roles grant a permission
+func (rm *RoleManager) HasPermission(username string, perm Permission) (bool, error) {
+	roles, err := rm.GetRolesForUser(username)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if role.HasPermission(perm) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MigrateAdminAccess is used to create the admin role if it doesn't exist, and
+// assign it to every user with the legacy User.AdminAccess flag set. Migrated
+// flags are cleared so that users are only migrated once, and an admin role
+// revoked afterwards is not assigned again.
+func (rm *RoleManager) MigrateAdminAccess() error {
+	if err := rm.ensureAdminRole(); err != nil {
+		return err
+	}
+	var admins []string
+	if err := rm.DB.Model(&User{}).Where(
+		"admin_access = ?", true,
+	).Pluck("user_name", &admins).Error; err != nil {
+		return err
+	}
+	for _, username := range admins {
+		if has, err := rm.HasRole(username, AdminRole); err != nil {
+			return err
+		} else if !has {
+			if _, err := rm.AssignRole(username, AdminRole, SystemActor); err != nil {
+				return err
+			}
+		}
+		if err := clearAdminAccess(rm.DB, []string{username}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureAdminRole creates the admin role if it doesn't exist
+func (rm *RoleManager) ensureAdminRole() error {
+	_, err := rm.FindRoleByName(AdminRole)
+	if err == gorm.ErrRecordNotFound {
+		_, err = rm.NewRole(AdminRole, "full administrative access", AllPermissions)
+	}
+	return err
+}
+
+// clearAdminAccess clears the legacy User.AdminAccess flag of the given
+// users, or of every user if usernames is nil
+func clearAdminAccess(db *gorm.DB, usernames []string) error {
+	query := db.Model(&User{}).Where("admin_access = ?", true)
+	if usernames != nil {
+		query = query.Where("user_name IN (?)", usernames)
+	}
+	return query.UpdateColumn("admin_access", false).Error
+}
+
+// validatePermissions checks that every permission is known to the system
+func validatePermissions(perms []Permission) error {
+	for _, p := range perms {
+		known := false
+		for _, other := range AllPermissions {
+			if p == other {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown permission '%s'", p)
+		}
+	}
+	return nil
+}
+
+func permissionsToArray(perms []Permission) pq.StringArray {
+	arr := make(pq.StringArray, 0, len(perms))
+	for _, p := range perms {
+		arr = append(arr, p.String())
+	}
+	return arr
+}
@@ -0,0 +1,148 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestRoleManager(t *testing.T) {
+	db := newTestDB(t, &Role{})
+	defer db.Close()
+	db.AutoMigrate(UserRole{})
+	var rm = NewRoleManager(db)
+	role, err := rm.NewRole("billing", "billing support staff", []Permission{PermViewBilling})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.DB.Unscoped().Delete(role)
+	defer rm.DB.Unscoped().Where("user_name = ?", "roleuser").Delete(&UserRole{})
+	if _, err := rm.NewRole("billing", "duplicate", nil); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := rm.NewRole("unknownperms", "unknown permissions", []Permission{"launch-missiles"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := rm.AssignRole("roleuser", "notarealrole", "adminuser"); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := rm.AssignRole("roleuser", "billing", "adminuser"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.AssignRole("roleuser", "billing", "adminuser"); err == nil {
+		t.Fatal("error expected")
+	}
+	type args struct {
+		perm Permission
+	}
+	tests := []struct {
+		name string
+		args args
+		want bool
+	}{
+		{"ViewBilling", args{PermViewBilling}, true},
+		{"IssueRefunds", args{PermIssueRefunds}, false},
+		{"ManageUsers", args{PermManageUsers}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if has, err := rm.HasPermission("roleuser", tt.args.perm); err != nil {
+				t.Fatal(err)
+			} else if has != tt.want {
+				t.Fatalf("HasPermission() = %v, want %v", has, tt.want)
+			}
+		})
+	}
+	if _, err := rm.UpdateRolePermissions("billing", []Permission{PermViewBilling, "launch-missiles"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := rm.UpdateRolePermissions("billing", []Permission{PermViewBilling, PermIssueRefunds}); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := rm.HasPermission("roleuser", PermIssueRefunds); err != nil {
+		t.Fatal(err)
+	} else if !has {
+		t.Fatal("updated permission should be granted")
+	}
+	if err := rm.RevokeRole("roleuser", "billing", "adminuser"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.RevokeRole("roleuser", "billing", "adminuser"); err == nil {
+		t.Fatal("error expected")
+	}
+	if has, err := rm.HasPermission("roleuser", PermViewBilling); err != nil {
+		t.Fatal(err)
+	} else if has {
+		t.Fatal("revoked role should not grant permissions")
+	}
+	history, err := rm.GetRoleHistoryForUser("roleuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].GrantedBy != "adminuser" || history[0].RevokedBy != "adminuser" {
+		t.Fatal("failed to record role assignment history")
+	}
+}
+
+func TestRoleManager_MigrateAdminAccess(t *testing.T) {
+	db := newTestDB(t, &Role{})
+	defer db.Close()
+	db.AutoMigrate(UserRole{})
+	db.AutoMigrate(User{})
+	var (
+		rm = NewRoleManager(db)
+		um = NewUserManager(db)
+	)
+	user, err := um.NewUserAccount("legacyadmin", "password123", "legacyadmin@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer rm.DB.Unscoped().Where("user_name = ?", "legacyadmin").Delete(&UserRole{})
+	if err := um.DB.Model(user).Update("admin_access", true).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.MigrateAdminAccess(); err != nil {
+		t.Fatal(err)
+	}
+	// migrations must be safe to run repeatedly
+	if err := rm.MigrateAdminAccess(); err != nil {
+		t.Fatal(err)
+	}
+	for _, perm := range AllPermissions {
+		if has, err := um.HasPermission("legacyadmin", perm); err != nil {
+			t.Fatal(err)
+		} else if !has {
+			t.Fatalf("admin should have permission %s", perm)
+		}
+	}
+	if migrated, err := um.FindByUserName("legacyadmin"); err != nil {
+		t.Fatal(err)
+	} else if migrated.AdminAccess {
+		t.Fatal("legacy admin flag should be cleared once migrated")
+	}
+	// an admin revoked through roles must stay revoked when migrations run again
+	if err := rm.RevokeRole("legacyadmin", AdminRole, "adminuser"); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.MigrateAdminAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if has, err := rm.HasRole("legacyadmin", AdminRole); err != nil {
+		t.Fatal(err)
+	} else if has {
+		t.Fatal("revoked admin should not be assigned the admin role again")
+	}
+	// toggling twice should grant and then remove admin access entirely
+	for _, want := range []bool{true, false} {
+		if _, err := um.ToggleAdmin("legacyadmin"); err != nil {
+			t.Fatal(err)
+		}
+		if isAdmin, err := um.CheckIfAdmin("legacyadmin"); err != nil {
+			t.Fatal(err)
+		} else if isAdmin != want {
+			t.Fatalf("CheckIfAdmin() = %v, want %v", isAdmin, want)
+		}
+	}
+	if _, err := um.ToggleAdmin("notarealuser"); err == nil {
+		t.Fatal("error expected")
+	}
+}
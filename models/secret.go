@@ -0,0 +1,227 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// keyringKey is the gorm setting used to carry the keyring for secret columns
+	keyringKey = "temporal:keyring"
+	// secretPrefix marks a column value as encrypted, followed by the key ID
+	secretPrefix = "enc:"
+
+	// ErrNoKeyring is an error triggered when storing a secret, or reading
+	// an encrypted one, without a keyring
+	ErrNoKeyring = "no keyring configured for secrets"
+)
+
+// Keyring holds the envelope keys used to encrypt secret columns at rest.
+// Encrypted values are stored as "enc:<key id>:<ciphertext>" so that values
+// written under an older key can still be read once the primary key changes.
+type Keyring struct {
+	// Keys are the envelope keys by ID, each must be 16, 24 or 32 bytes
+	Keys map[string][]byte
+	// Primary is the ID of the key used to encrypt new values
+	Primary string
+}
+
+// Validate is used to check that the keyring can encrypt values
+func (k *Keyring) Validate() error {
+	if _, ok := k.Keys[k.Primary]; !ok {
+		return errors.New("primary key is not in keyring")
+	}
+	for id, key := range k.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return fmt.Errorf("invalid key id '%s'", id)
+		}
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return fmt.Errorf("key '%s' must be 16, 24 or 32 bytes", id)
+		}
+	}
+	return nil
+}
+
+// Encrypt is used to encrypt a value with the primary key. Empty values are
+// left empty.
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	key, ok := k.Keys[k.Primary]
+	if !ok {
+		return "", errors.New("primary key is not in keyring")
+	}
+	encrypted, err := utils.EncryptSecret(key, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + k.Primary + ":" + encrypted, nil
+}
+
+// Decrypt is used to decrypt a value encrypted with any key in the keyring.
+// Values that were never encrypted are returned as is.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	id, ciphertext, encrypted := parseSecret(value)
+	if !encrypted {
+		return value, nil
+	}
+	key, ok := k.Keys[id]
+	if !ok {
+		return "", fmt.Errorf("key '%s' is not in keyring", id)
+	}
+	return utils.DecryptSecret(key, ciphertext)
+}
+
+// WithKeyring returns a database handle whose managers encrypt secret
+// columns with the given keyring, or without one if k is nil. Without a
+// keyring secrets can't be stored, and only secrets stored in plaintext
+// before a keyring was configured can be read.
+//
+//	db = models.WithKeyring(db, &models.Keyring{Keys: keys, Primary: "2019-06"})
+func WithKeyring(db *gorm.DB, k *Keyring) *gorm.DB {
+	return db.Set(keyringKey, k)
+}
+
+// KeyringFrom returns the keyring attached to a database handle with
+// WithKeyring, or nil if there is none
+func KeyringFrom(db *gorm.DB) *Keyring {
+	if k, ok := db.Get(keyringKey); ok {
+		if kr, ok := k.(*Keyring); ok {
+			return kr
+		}
+	}
+	return nil
+}
+
+// RotateSecrets is used to re-encrypt every secret column, hosted network keys
+// and two-factor secrets, with the primary key of the keyring attached to db.
+// It returns the number of rows updated.
+func RotateSecrets(db *gorm.DB) (int, error) {
+	networks, err := NewHostedNetworkManager(db).RotateNetworkSecrets()
+	if err != nil {
+		return 0, err
+	}
+	users, err := NewUserManager(db).RotateTOTPSecrets()
+	if err != nil {
+		return networks, err
+	}
+	return networks + users, nil
+}
+
+// encryptSecret encrypts a value with the keyring attached to db. Secrets are
+// never stored in plaintext, so this fails if there is no keyring.
+func encryptSecret(db *gorm.DB, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	kr := KeyringFrom(db)
+	if kr == nil {
+		return "", errors.New(ErrNoKeyring)
+	}
+	return kr.Encrypt(plaintext)
+}
+
+// decryptSecret decrypts a value with the keyring attached to db, passing
+// plaintext values through
+func decryptSecret(db *gorm.DB, value string) (string, error) {
+	kr := KeyringFrom(db)
+	if kr == nil {
+		if _, _, encrypted := parseSecret(value); encrypted {
+			return "", errors.New(ErrNoKeyring)
+		}
+		return value, nil
+	}
+	return kr.Decrypt(value)
+}
+
+// parseSecret splits an encrypted value into its key ID and ciphertext
+func parseSecret(value string) (string, string, bool) {
+	if !strings.HasPrefix(value, secretPrefix) {
+		return "", "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, secretPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// reencryptSecretColumns encrypts the given columns of every row of a
+// model's table with the primary key of the keyring attached to db. When
+// plaintextOnly is set only values that have never been encrypted are
+// updated, otherwise values encrypted under other keys are rotated as well.
+// It returns the number of rows updated.
+func reencryptSecretColumns(db *gorm.DB, model interface{}, plaintextOnly bool, columns ...string) (int, error) {
+	kr := KeyringFrom(db)
+	if kr == nil {
+		return 0, errors.New(ErrNoKeyring)
+	}
+	table := db.NewScope(model).TableName()
+	rows, err := db.Table(table).Select(
+		"id, " + strings.Join(columns, ", "),
+	).Rows()
+	if err != nil {
+		return 0, err
+	}
+	updates := make(map[uint]map[string]interface{})
+	for rows.Next() {
+		var (
+			id     uint
+			values = make([]sql.NullString, len(columns))
+			dest   = []interface{}{&id}
+		)
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		for i, v := range values {
+			if !v.Valid || v.String == "" {
+				continue
+			}
+			keyID, _, encrypted := parseSecret(v.String)
+			if encrypted && (plaintextOnly || keyID == kr.Primary) {
+				continue
+			}
+			plaintext, err := kr.Decrypt(v.String)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			ciphertext, err := kr.Encrypt(plaintext)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if updates[id] == nil {
+				updates[id] = make(map[string]interface{})
+			}
+			updates[id][columns[i]] = ciphertext
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if err := withTransaction(db, func(tx *gorm.DB) error {
+		for id, attrs := range updates {
+			if err := tx.Table(table).Where("id = ?", id).UpdateColumns(attrs).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(updates), nil
+}
@@ -0,0 +1,133 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKeyring(primary string) *Keyring {
+	return &Keyring{
+		Keys: map[string][]byte{
+			"old": []byte("abcdefghijklmnopqrstuvwxyz012345"),
+			"new": []byte("zyxwvutsrqponmlkjihgfedcba543210"),
+		},
+		Primary: primary,
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	if err := testKeyring("old").Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := testKeyring("missing").Validate(); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := (&Keyring{Keys: map[string][]byte{"a:b": []byte("abcdefghijklmnop")}, Primary: "a:b"}).Validate(); err == nil {
+		t.Fatal("error expected")
+	}
+	encrypted, err := testKeyring("old").Encrypt("such secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, "enc:old:") {
+		t.Fatalf("unexpected encrypted value %s", encrypted)
+	}
+	// values encrypted under a previous primary key remain readable
+	if decrypted, err := testKeyring("new").Decrypt(encrypted); err != nil {
+		t.Fatal(err)
+	} else if decrypted != "such secret" {
+		t.Fatal("failed to decrypt secret")
+	}
+	if decrypted, err := testKeyring("new").Decrypt("plaintext"); err != nil {
+		t.Fatal(err)
+	} else if decrypted != "plaintext" {
+		t.Fatal("plaintext should be returned as is")
+	}
+	if _, err := (&Keyring{Keys: map[string][]byte{}}).Decrypt(encrypted); err == nil {
+		t.Fatal("error expected")
+	}
+	if empty, err := testKeyring("old").Encrypt(""); err != nil || empty != "" {
+		t.Fatal("empty values should not be encrypted")
+	}
+}
+
+func TestHostedNetworkManager_Secrets(t *testing.T) {
+	db := newNetworkTestDB(t)
+	defer db.Close()
+	var (
+		plain = NewHostedNetworkManager(WithKeyring(db, nil))
+		hm    = NewHostedNetworkManager(db)
+	)
+	// keys can't be stored without a keyring
+	if err := plain.SaveNetwork(&HostedNetwork{
+		Name:     "secretnetwork",
+		PeerKey:  "such peer key",
+		SwarmKey: "such swarm key",
+	}); err == nil || err.Error() != ErrNoKeyring {
+		t.Fatalf("expected keyring error, got %v", err)
+	}
+	// networks stored before a keyring was configured
+	if err := db.Create(&HostedNetwork{
+		Name:     "secretnetwork",
+		PeerKey:  "such peer key",
+		SwarmKey: "such swarm key",
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer hm.Delete("secretnetwork")
+	if err := hm.MigrateNetworkSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	stored := &HostedNetwork{}
+	if err := db.Where("name = ?", "secretnetwork").First(stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.PeerKey, "enc:old:") || !strings.HasPrefix(stored.SwarmKey, "enc:old:") {
+		t.Fatal("keys should be encrypted at rest")
+	}
+	details, err := hm.GetSwarmDetails("secretnetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details.Key != "such swarm key" {
+		t.Fatal("failed to decrypt swarm key")
+	}
+	// reading encrypted keys requires the keyring
+	if _, err := plain.GetNetworkByName("secretnetwork"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := hm.UpdateNetworkByName("secretnetwork", map[string]interface{}{
+		"swarm_key": "new swarm key",
+	}); err == nil || err.Error() != ErrSwarmKeyNotRotated {
+		t.Fatalf("expected swarm key error, got %v", err)
+	}
+	swarmKey, err := hm.RotateSwarmKey("secretnetwork", "", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// rotating moves every key onto the new primary key
+	rotated := NewHostedNetworkManager(WithKeyring(db, testKeyring("new")))
+	if count, err := rotated.RotateNetworkSecrets(); err != nil {
+		t.Fatal(err)
+	} else if count == 0 {
+		t.Fatal("expected network to be rotated")
+	}
+	stored = &HostedNetwork{}
+	if err := db.Where("name = ?", "secretnetwork").First(stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.PeerKey, "enc:new:") || !strings.HasPrefix(stored.SwarmKey, "enc:new:") {
+		t.Fatal("keys should be encrypted with the new key")
+	}
+	network, err := NewHostedNetworkManager(WithKeyring(db, &Keyring{
+		Keys:    map[string][]byte{"new": testKeyring("new").Keys["new"]},
+		Primary: "new",
+	})).GetNetworkByName("secretnetwork")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network.PeerKey != "such peer key" || network.SwarmKey != swarmKey {
+		t.Fatal("failed to decrypt rotated keys")
+	}
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrRefreshTokenReused is an error triggered when a refresh token that has
+	// already been rotated is presented again. This indicates the token has likely
+	// been stolen, so every session descended from the same sign-in is revoked.
+	ErrRefreshTokenReused = "refresh token has already been used, all related sessions have been revoked"
+	// ErrSessionExpired is an error triggered when attempting to use an expired session
+	ErrSessionExpired = "session has expired"
+	// ErrSessionRevoked is an error triggered when attempting to use a revoked session
+	ErrSessionRevoked = "session has been revoked"
+
+	// DefaultSessionLifetime is how long a session remains valid if no lifetime is specified
+	DefaultSessionLifetime = time.Hour * 24 * 30
+
+	// SessionRevokedRotated indicates a session was replaced by refreshing it
+	SessionRevokedRotated = "rotated"
+	// SessionRevokedReuse indicates a session was revoked due to refresh token reuse
+	SessionRevokedReuse = "reuse detected"
+	// SessionRevokedLogout indicates a session was revoked by the user logging out
+	SessionRevokedLogout = "logout"
+	// SessionRevokedLogoutAll indicates a session was revoked by logging out of all devices
+	SessionRevokedLogoutAll = "logout all"
+)
+
+// Session is a login session for a user, identified by a refresh token.
+// Only the hash of the refresh token is stored.
+type Session struct {
+	gorm.Model
+	UserName         string `gorm:"type:varchar(255);index"`
+	RefreshTokenHash string `gorm:"type:varchar(255);unique"`
+	// FamilyID is shared by every session produced by rotating the
+	// refresh token of a single sign-in, and is used for reuse detection
+	FamilyID  string `gorm:"type:varchar(255);index"`
+	Device    string `gorm:"type:varchar(255)"`
+	UserAgent string `gorm:"type:text"`
+	IPAddress string `gorm:"type:varchar(255)"`
+	ExpiresAt time.Time
+	// LastUsedAt is the last time the refresh token was used
+	LastUsedAt    *time.Time
+	RevokedAt     *time.Time
+	RevokedReason string `gorm:"type:varchar(255)"`
+	// ReplacedByID is the ID of the session created when this one was rotated
+	ReplacedByID uint
+}
+
+// Active returns whether or not the session can still be used
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// SessionManager is used to manipulate login sessions
+type SessionManager struct {
+	DB *gorm.DB
+}
+
+// NewSessionManager is used to generate our session manager helper
+func NewSessionManager(db *gorm.DB) *SessionManager {
+	return &SessionManager{DB: db}
+}
+
+// SessionOptions is used to record metadata about the client of a session
+type SessionOptions struct {
+	Device    string
+	UserAgent string
+	IPAddress string
+	// Lifetime defaults to DefaultSessionLifetime if unset
+	Lifetime time.Duration
+}
+
+// NewSession is used to create a new session for a user, returning the
+// session along with the plaintext refresh token to give to the client
+func (sm *SessionManager) NewSession(username string, opts SessionOptions) (*Session, string, error) {
+	familyID, err := utils.GenerateSecureToken(16)
+	if err != nil {
+		return nil, "", err
+	}
+	return sm.newSession(sm.DB, username, familyID, opts)
+}
+
+// FindByRefreshToken is used to find a session by its plaintext refresh token
+func (sm *SessionManager) FindByRefreshToken(token string) (*Session, error) {
+	session := &Session{}
+	if err := sm.DB.Where(
+		"refresh_token_hash = ?", utils.HashToken(token),
+	).First(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// RotateRefreshToken is used to exchange a refresh token for a new session
+// and refresh token. The old session is revoked. Presenting a refresh token
+// that has already been rotated revokes every session in its family.
+func (sm *SessionManager) RotateRefreshToken(token string, opts SessionOptions) (*Session, string, error) {
+	old, err := sm.FindByRefreshToken(token)
+	if err != nil {
+		return nil, "", err
+	}
+	if old.RevokedAt != nil {
+		if old.RevokedReason == SessionRevokedRotated {
+			if err := sm.revokeFamily(old.FamilyID); err != nil {
+				return nil, "", err
+			}
+			return nil, "", errors.New(ErrRefreshTokenReused)
+		}
+		return nil, "", errors.New(ErrSessionRevoked)
+	}
+	now := time.Now()
+	if !now.Before(old.ExpiresAt) {
+		return nil, "", errors.New(ErrSessionExpired)
+	}
+	// carry over client metadata if the caller didn't provide new values
+	if opts.Device == "" {
+		opts.Device = old.Device
+	}
+	if opts.UserAgent == "" {
+		opts.UserAgent = old.UserAgent
+	}
+	if opts.IPAddress == "" {
+		opts.IPAddress = old.IPAddress
+	}
+	var (
+		session  *Session
+		newToken string
+	)
+	err = withTransaction(sm.DB, func(tx *gorm.DB) error {
+		var err error
+		if session, newToken, err = sm.newSession(tx, old.UserName, old.FamilyID, opts); err != nil {
+			return err
+		}
+		// only revoke the old session if nobody else has rotated it in the meantime
+		check := tx.Model(&Session{}).Where(
+			"id = ? AND revoked_at IS NULL", old.ID,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at":     now,
+			"revoked_reason": SessionRevokedRotated,
+			"replaced_by_id": session.ID,
+			"last_used_at":   now,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		if check.RowsAffected == 0 {
+			return errors.New(ErrRefreshTokenReused)
+		}
+		return nil
+	})
+	if err != nil {
+		if err.Error() == ErrRefreshTokenReused {
+			if err := sm.revokeFamily(old.FamilyID); err != nil {
+				return nil, "", err
+			}
+		}
+		return nil, "", err
+	}
+	return session, newToken, nil
+}
+
+// FindSessionsByUser is used to find all active sessions for a user
+func (sm *SessionManager) FindSessionsByUser(username string) ([]Session, error) {
+	var sessions []Session
+	if err := sm.DB.Where(
+		"user_name = ? AND revoked_at IS NULL AND expires_at > ?", username, time.Now(),
+	).Order("created_at desc").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession is used to revoke a session using its refresh token, such as on logout
+func (sm *SessionManager) RevokeSession(token string) error {
+	session, err := sm.FindByRefreshToken(token)
+	if err != nil {
+		return err
+	}
+	if session.RevokedAt != nil {
+		return errors.New(ErrSessionRevoked)
+	}
+	return sm.DB.Model(session).UpdateColumns(map[string]interface{}{
+		"revoked_at":     time.Now(),
+		"revoked_reason": SessionRevokedLogout,
+	}).Error
+}
+
+// RevokeAllSessionsForUser is used to revoke every active session of a user,
+// returning the number of sessions revoked
+func (sm *SessionManager) RevokeAllSessionsForUser(username string) (int64, error) {
+	var revoked int64
+	if err := withTransaction(sm.DB, func(tx *gorm.DB) error {
+		check := tx.Model(&Session{}).Where(
+			"user_name = ? AND revoked_at IS NULL", username,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at":     time.Now(),
+			"revoked_reason": SessionRevokedLogoutAll,
+		})
+		if check.Error != nil {
+			return check.Error
+		}
+		revoked = check.RowsAffected
+		if revoked == 0 {
+			return nil
+		}
+		return recordAudit(tx, AuditUserSessionsRevoked, AuditSubjectUser, username,
+			nil, map[string]interface{}{"sessions": revoked},
+		)
+	}); err != nil {
+		return 0, err
+	}
+	return revoked, nil
+}
+
+// PurgeExpiredSessions is used to permanently remove sessions that expired
+// before the given time, returning the number of sessions removed. It is
+// intended to be run periodically by a cleanup job.
+func (sm *SessionManager) PurgeExpiredSessions(before time.Time) (int64, error) {
+	check := sm.DB.Unscoped().Where("expires_at < ?", before).Delete(&Session{})
+	return check.RowsAffected, check.Error
+}
+
+func (sm *SessionManager) newSession(db *gorm.DB, username, familyID string, opts SessionOptions) (*Session, string, error) {
+	token, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	if opts.Lifetime == 0 {
+		opts.Lifetime = DefaultSessionLifetime
+	}
+	session := &Session{
+		UserName:         username,
+		RefreshTokenHash: utils.HashToken(token),
+		FamilyID:         familyID,
+		Device:           opts.Device,
+		UserAgent:        opts.UserAgent,
+		IPAddress:        opts.IPAddress,
+		ExpiresAt:        time.Now().Add(opts.Lifetime),
+	}
+	if err := db.Create(session).Error; err != nil {
+		return nil, "", err
+	}
+	return session, token, nil
+}
+
+func (sm *SessionManager) revokeFamily(familyID string) error {
+	return sm.DB.Model(&Session{}).Where(
+		"family_id = ? AND revoked_at IS NULL", familyID,
+	).UpdateColumns(map[string]interface{}{
+		"revoked_at":     time.Now(),
+		"revoked_reason": SessionRevokedReuse,
+	}).Error
+}
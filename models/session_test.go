@@ -0,0 +1,100 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionManager_Rotation(t *testing.T) {
+	db := newTestDB(t, &Session{})
+	defer db.Close()
+	var sm = NewSessionManager(db)
+	session, token, err := sm.NewSession("sessionuser", SessionOptions{
+		Device:    "laptop",
+		UserAgent: "go-test",
+		IPAddress: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sm.DB.Unscoped().Where("family_id = ?", session.FamilyID).Delete(&Session{})
+	if session.RefreshTokenHash == token {
+		t.Fatal("refresh token should not be stored in plaintext")
+	}
+	if found, err := sm.FindByRefreshToken(token); err != nil {
+		t.Fatal(err)
+	} else if found.ID != session.ID {
+		t.Fatal("failed to find correct session")
+	}
+	// rotate the refresh token
+	rotated, newToken, err := sm.RotateRefreshToken(token, SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.FamilyID != session.FamilyID {
+		t.Fatal("rotated session should belong to the same family")
+	}
+	if rotated.Device != "laptop" {
+		t.Fatal("failed to carry over session metadata")
+	}
+	// reuse of the old token should revoke the whole family
+	if _, _, err := sm.RotateRefreshToken(token, SessionOptions{}); err == nil {
+		t.Fatal("error expected")
+	} else if err.Error() != ErrRefreshTokenReused {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, _, err := sm.RotateRefreshToken(newToken, SessionOptions{}); err == nil {
+		t.Fatal("error expected")
+	}
+	sessions, err := sm.FindSessionsByUser("sessionuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 0 {
+		t.Fatal("all sessions should be revoked")
+	}
+}
+
+func TestSessionManager_Revoke(t *testing.T) {
+	db := newTestDB(t, &Session{})
+	defer db.Close()
+	var sm = NewSessionManager(db)
+	defer sm.DB.Unscoped().Where("user_name = ?", "sessionuser2").Delete(&Session{})
+	_, token1, err := sm.NewSession("sessionuser2", SessionOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.NewSession("sessionuser2", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := sm.NewSession("sessionuser2", SessionOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RevokeSession(token1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.RevokeSession(token1); err == nil {
+		t.Fatal("error expected")
+	}
+	sessions, err := sm.FindSessionsByUser("sessionuser2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", len(sessions))
+	}
+	if count, err := sm.RevokeAllSessionsForUser("sessionuser2"); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected 2 sessions revoked, got %v", count)
+	}
+	// expired sessions should be purged
+	if _, _, err := sm.NewSession("sessionuser2", SessionOptions{Lifetime: -time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := sm.PurgeExpiredSessions(time.Now()); err != nil {
+		t.Fatal(err)
+	} else if count < 1 {
+		t.Fatal("failed to purge expired session")
+	}
+}
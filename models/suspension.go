@@ -0,0 +1,286 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SuspensionReason is the reason an account was suspended
+type SuspensionReason string
+
+// String returns the value of SuspensionReason as a string
+func (r SuspensionReason) String() string {
+	return string(r)
+}
+
+var (
+	// SuspendAbuse indicates an account was suspended for abusing the service
+	SuspendAbuse SuspensionReason = "abuse"
+	// SuspendNonPayment indicates an account was suspended for failing to pay
+	SuspendNonPayment SuspensionReason = "non-payment"
+	// SuspendUserRequest indicates an account was suspended at the request of its owner
+	SuspendUserRequest SuspensionReason = "user-request"
+)
+
+const (
+	// ErrAccountSuspended is an error triggered when suspending an account that is already suspended
+	ErrAccountSuspended = "account is already suspended"
+	// ErrAccountNotSuspended is an error triggered when reinstating an account that is not suspended
+	ErrAccountNotSuspended = "account is not suspended"
+)
+
+// AccountSuspension is a record of a single suspension of an account,
+// which is kept once the account is reinstated
+type AccountSuspension struct {
+	gorm.Model
+	UserName    string           `gorm:"type:varchar(255);index"`
+	Reason      SuspensionReason `gorm:"type:varchar(255)"`
+	Note        string           `gorm:"type:text"`
+	SuspendedBy string           `gorm:"type:varchar(255)"`
+	// ReinstateAt is when the account is automatically reinstated, nil if never
+	ReinstateAt  *time.Time
+	ReinstatedAt *time.Time
+	ReinstatedBy string `gorm:"type:varchar(255)"`
+	// CascadedFrom is the organization owner whose suspension caused this one, if any
+	CascadedFrom string `gorm:"type:varchar(255)"`
+}
+
+// SuspendOptions configures the suspension of an account
+type SuspendOptions struct {
+	Reason SuspensionReason
+	Note   string
+	// ReinstateAt is when the account is automatically reinstated,
+	// the zero value suspends the account until ReinstateAccount is called
+	ReinstateAt time.Time
+	// CascadeToOrg also suspends every member of organizations the user owns
+	CascadeToOrg bool
+}
+
+// SuspendAccount is used to disable an account, revoking all of its sessions.
+// The suspension is attributed to the actor attached to the manager's database.
+func (um *UserManager) SuspendAccount(username string, opts SuspendOptions) error {
+	switch opts.Reason {
+	case SuspendAbuse, SuspendNonPayment, SuspendUserRequest:
+	default:
+		return errors.New("unsupported suspension reason")
+	}
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	if !user.AccountEnabled {
+		return errors.New(ErrAccountSuspended)
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := suspendAccount(tx, user, opts, ""); err != nil {
+			return err
+		}
+		if !opts.CascadeToOrg {
+			return nil
+		}
+		var orgs []Organization
+		if err := tx.Where("account_owner = ?", username).Find(&orgs).Error; err != nil {
+			return err
+		}
+		for _, org := range orgs {
+			for _, member := range org.RegisteredUsers {
+				if member == username {
+					continue
+				}
+				memberUser := &User{}
+				if err := tx.Where("user_name = ?", member).First(memberUser).Error; err != nil {
+					return err
+				}
+				// members suspended for their own reasons keep that suspension
+				if !memberUser.AccountEnabled {
+					continue
+				}
+				if err := suspendAccount(tx, memberUser, opts, username); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// ReinstateAccount is used to re-enable a suspended account. Members of the
+// user's organizations that were suspended as a result of this account's
+// suspension are reinstated as well.
+func (um *UserManager) ReinstateAccount(username string) error {
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	if user.AccountEnabled {
+		return errors.New(ErrAccountNotSuspended)
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		return reinstateAccount(tx, user)
+	})
+}
+
+// ReinstateExpiredSuspensions is used to reinstate every account whose
+// suspension ended before the given time, returning the reinstated user names.
+// It is intended to be run periodically, although accounts are also
+// reinstated when they next sign in successfully.
+func (um *UserManager) ReinstateExpiredSuspensions(now time.Time) ([]string, error) {
+	var users []User
+	if err := um.DB.Where(
+		"account_enabled = ? AND suspension_reinstate_at <= ?", false, now,
+	).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	var reinstated []string
+	for i := range users {
+		var skipped bool
+		if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+			// members may have been reinstated along with their organization's owner
+			u := &User{}
+			if err := tx.Set("gorm:query_option", "FOR UPDATE").Where(
+				"id = ?", users[i].ID,
+			).First(u).Error; err != nil {
+				return err
+			}
+			if skipped = u.AccountEnabled; skipped {
+				return nil
+			}
+			return reinstateAccount(tx, u)
+		}); err != nil {
+			return reinstated, err
+		}
+		if !skipped {
+			reinstated = append(reinstated, users[i].UserName)
+		}
+	}
+	return reinstated, nil
+}
+
+// FindSuspendedAccounts is used to find all suspended accounts, optionally
+// restricted to those suspended for the given reason
+func (um *UserManager) FindSuspendedAccounts(reason SuspensionReason) ([]User, error) {
+	db := um.DB.Where("account_enabled = ?", false)
+	if reason != "" {
+		db = db.Where("suspension_reason = ?", reason)
+	}
+	var users []User
+	if err := db.Order("user_name asc").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// GetSuspensionHistory is used to return every suspension of an account, most recent first
+func (um *UserManager) GetSuspensionHistory(username string) ([]AccountSuspension, error) {
+	var suspensions []AccountSuspension
+	if err := um.DB.Where("user_name = ?", username).Order(
+		"created_at desc",
+	).Find(&suspensions).Error; err != nil {
+		return nil, err
+	}
+	return suspensions, nil
+}
+
+// accountEnabled returns whether an account is enabled, or its suspension has ended
+func accountEnabled(u *User, now time.Time) bool {
+	return u.AccountEnabled ||
+		(u.SuspensionReinstateAt != nil && !now.Before(*u.SuspensionReinstateAt))
+}
+
+// reinstateIfDue reinstates a suspended account whose suspension has ended,
+// returning whether the account is now enabled
+func (um *UserManager) reinstateIfDue(u *User, now time.Time) (bool, error) {
+	if u.AccountEnabled {
+		return true, nil
+	}
+	if !accountEnabled(u, now) {
+		return false, nil
+	}
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		return reinstateAccount(tx, u)
+	}); err != nil {
+		return false, err
+	}
+	u.AccountEnabled = true
+	return true, nil
+}
+
+// suspendAccount disables a single account within tx
+func suspendAccount(tx *gorm.DB, u *User, opts SuspendOptions, cascadedFrom string) error {
+	var reinstateAt *time.Time
+	if !opts.ReinstateAt.IsZero() {
+		reinstateAt = &opts.ReinstateAt
+	}
+	if err := tx.Create(&AccountSuspension{
+		UserName:     u.UserName,
+		Reason:       opts.Reason,
+		Note:         opts.Note,
+		SuspendedBy:  ActorFrom(tx),
+		ReinstateAt:  reinstateAt,
+		CascadedFrom: cascadedFrom,
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+		"account_enabled":         false,
+		"suspension_reason":       opts.Reason,
+		"suspension_reinstate_at": reinstateAt,
+	}).Error; err != nil {
+		return err
+	}
+	if _, err := NewSessionManager(tx).RevokeAllSessionsForUser(u.UserName); err != nil {
+		return err
+	}
+	return recordAudit(tx, AuditUserSuspended, AuditSubjectUser, u.UserName, nil, map[string]interface{}{
+		"reason":        opts.Reason,
+		"reinstate_at":  reinstateAt,
+		"cascaded_from": cascadedFrom,
+	})
+}
+
+// reinstateAccount re-enables a single account within tx, along with any
+// accounts whose suspension cascaded from it
+func reinstateAccount(tx *gorm.DB, u *User) error {
+	var (
+		actor = ActorFrom(tx)
+		now   = time.Now()
+	)
+	if err := tx.Model(&AccountSuspension{}).Where(
+		"user_name = ? AND reinstated_at IS NULL", u.UserName,
+	).UpdateColumns(map[string]interface{}{
+		"reinstated_at": now,
+		"reinstated_by": actor,
+	}).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+		"account_enabled":         true,
+		"suspension_reason":       "",
+		"suspension_reinstate_at": nil,
+	}).Error; err != nil {
+		return err
+	}
+	if err := recordAudit(tx, AuditUserReinstated, AuditSubjectUser, u.UserName,
+		map[string]interface{}{"reason": u.SuspensionReason}, nil,
+	); err != nil {
+		return err
+	}
+	var cascaded []string
+	if err := tx.Model(&AccountSuspension{}).Where(
+		"cascaded_from = ? AND reinstated_at IS NULL", u.UserName,
+	).Pluck("user_name", &cascaded).Error; err != nil {
+		return err
+	}
+	for _, member := range cascaded {
+		memberUser := &User{}
+		if err := tx.Where("user_name = ?", member).First(memberUser).Error; err != nil {
+			return err
+		}
+		if err := reinstateAccount(tx, memberUser); err != nil {
+			return err
+		}
+	}
+	return nil
+}
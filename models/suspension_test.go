@@ -0,0 +1,195 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserManager_Suspension(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(Session{})
+	db.AutoMigrate(LoginAttempt{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(AccountSuspension{})
+	var um = NewUserManager(WithActor(db, "adminuser"))
+	user, err := um.NewUserAccount("suspenduser", "password123", "suspenduser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "suspenduser").Delete(&Usage{})
+	defer um.DB.Unscoped().Where("user_name = ?", "suspenduser").Delete(&AccountSuspension{})
+	if err := um.SuspendAccount("suspenduser", SuspendOptions{Reason: "notarealreason"}); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := um.ReinstateAccount("suspenduser"); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := um.SuspendAccount("suspenduser", SuspendOptions{Reason: SuspendAbuse, Note: "spam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := um.SuspendAccount("suspenduser", SuspendOptions{Reason: SuspendAbuse}); err == nil {
+		t.Fatal("error expected")
+	}
+	if enabled, err := um.CheckIfUserAccountEnabled("suspenduser"); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("account should be suspended")
+	}
+	if valid, err := um.SignIn("suspenduser", "password123"); err == nil || valid {
+		t.Fatal("suspended account should not be able to sign in")
+	}
+	if users, err := um.FindSuspendedAccounts(SuspendAbuse); err != nil {
+		t.Fatal(err)
+	} else if !containsUser(users, "suspenduser") {
+		t.Fatal("suspended account should be found")
+	}
+	if users, err := um.FindSuspendedAccounts(SuspendNonPayment); err != nil {
+		t.Fatal(err)
+	} else if containsUser(users, "suspenduser") {
+		t.Fatal("account suspended for a different reason")
+	}
+	if err := um.ReinstateAccount("suspenduser"); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := um.SignIn("suspenduser", "password123"); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("reinstated account should be able to sign in")
+	}
+	// suspensions with a reinstate time end automatically
+	if err := um.SuspendAccount("suspenduser", SuspendOptions{
+		Reason:      SuspendNonPayment,
+		ReinstateAt: time.Now().Add(-time.Minute),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := um.CheckIfUserAccountEnabled("suspenduser"); err != nil {
+		t.Fatal(err)
+	} else if !enabled {
+		t.Fatal("account should be enabled once its suspension has ended")
+	}
+	// checking the account doesn't reinstate it
+	if users, err := um.FindSuspendedAccounts(SuspendNonPayment); err != nil {
+		t.Fatal(err)
+	} else if !containsUser(users, "suspenduser") {
+		t.Fatal("account should not be reinstated by checking it")
+	}
+	if _, err := um.ReinstateExpiredSuspensions(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if users, err := um.FindSuspendedAccounts(SuspendNonPayment); err != nil {
+		t.Fatal(err)
+	} else if containsUser(users, "suspenduser") {
+		t.Fatal("account should be reinstated")
+	}
+	history, err := um.GetSuspensionHistory("suspenduser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 {
+		t.Fatalf("expected 2 suspensions, got %v", len(history))
+	}
+	for _, s := range history {
+		if s.ReinstatedAt == nil {
+			t.Fatal("suspension should be reinstated")
+		}
+		if s.SuspendedBy != "adminuser" {
+			t.Fatalf("unexpected actor %s", s.SuspendedBy)
+		}
+	}
+}
+
+func TestUserManager_SuspendAccount_Cascade(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(Session{})
+	db.AutoMigrate(Organization{})
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(AccountSuspension{})
+	var (
+		um = NewUserManager(db)
+		om = NewOrgManager(db)
+	)
+	owner, err := um.NewUserAccount("suspendowner", "password123", "suspendowner@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(owner)
+	org, err := om.NewOrganization("suspendorg", "suspendowner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer om.DB.Unscoped().Delete(org)
+	member, err := om.RegisterOrgUser("suspendorg", "suspendmember", "password123", "suspendmember@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(member)
+	for _, name := range []string{"suspendowner", "suspendmember"} {
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&Usage{})
+		defer um.DB.Unscoped().Where("user_name = ?", name).Delete(&AccountSuspension{})
+	}
+	if err := um.SuspendAccount("suspendowner", SuspendOptions{
+		Reason:       SuspendNonPayment,
+		CascadeToOrg: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := um.CheckIfUserAccountEnabled("suspendmember"); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("member should be suspended")
+	}
+	if err := um.ReinstateAccount("suspendowner"); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := um.CheckIfUserAccountEnabled("suspendmember"); err != nil {
+		t.Fatal(err)
+	} else if !enabled {
+		t.Fatal("member should be reinstated")
+	}
+	// members reinstated along with the owner are only reinstated once
+	if err := um.SuspendAccount("suspendowner", SuspendOptions{
+		Reason:       SuspendNonPayment,
+		ReinstateAt:  time.Now().Add(-time.Minute),
+		CascadeToOrg: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	reinstated, err := um.ReinstateExpiredSuspensions(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range reinstated {
+		if seen[name] {
+			t.Fatalf("%s reinstated more than once", name)
+		}
+		seen[name] = true
+	}
+	if !seen["suspendowner"] {
+		t.Fatalf("unexpected reinstated accounts %v", reinstated)
+	}
+	history, err := um.GetSuspensionHistory("suspendmember")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range history {
+		if s.ReinstatedAt == nil {
+			t.Fatal("member suspension should be reinstated")
+		}
+	}
+}
+
+func containsUser(users []User, username string) bool {
+	for _, u := range users {
+		if u.UserName == username {
+			return true
+		}
+	}
+	return false
+}
@@ -7,6 +7,10 @@ import (
 	"github.com/lib/pq"
 )
 
+// ErrZoneKeyNotUsable is an error triggered when a user signs a zone with a
+// key they neither own nor have been granted KeyPermSignTNS on
+const ErrZoneKeyNotUsable = "user may not sign zones with key"
+
 // Zone is a TNS zone
 type Zone struct {
 	gorm.Model
@@ -37,6 +41,9 @@ func (zm *ZoneManager) NewZone(username, name, managerPK, zonePK, latestIPFSHash
 	if err == nil {
 		return nil, errors.New("zone already exists for user")
 	}
+	if err := zm.checkSigningKeys(username, managerPK, zonePK); err != nil {
+		return nil, err
+	}
 	zone = &Zone{
 		UserName:             username,
 		Name:                 name,
@@ -44,8 +51,18 @@ func (zm *ZoneManager) NewZone(username, name, managerPK, zonePK, latestIPFSHash
 		ZonePublicKeyName:    zonePK,
 		LatestIPFSHash:       latestIPFSHash,
 	}
-	if check := zm.DB.Create(zone); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(zm.DB, func(tx *gorm.DB) error {
+		if check := tx.Create(zone); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditZoneCreated, AuditSubjectZone, name, nil, map[string]interface{}{
+			"user_name":               username,
+			"manager_public_key_name": managerPK,
+			"zone_public_key_name":    zonePK,
+			"latest_ipfs_hash":        latestIPFSHash,
+		})
+	}); err != nil {
+		return nil, err
 	}
 	return zone, nil
 }
@@ -59,15 +76,28 @@ func (zm *ZoneManager) FindZoneByNameAndUser(name, username string) (*Zone, erro
 	return &z, nil
 }
 
-// UpdateLatestIPFSHashForZone is used to update the latest IPFS hash for a zone file
+// UpdateLatestIPFSHashForZone is used to update the latest IPFS hash for a
+// zone file, which the user must still be able to sign with the zone's keys
 func (zm *ZoneManager) UpdateLatestIPFSHashForZone(name, username, hash string) (*Zone, error) {
 	z, err := zm.FindZoneByNameAndUser(name, username)
 	if err != nil {
 		return nil, err
 	}
+	if err := zm.checkSigningKeys(username, z.ManagerPublicKeyName, z.ZonePublicKeyName); err != nil {
+		return nil, err
+	}
+	before := z.LatestIPFSHash
 	z.LatestIPFSHash = hash
-	if check := zm.DB.Model(&z).Update("latest_ip_fs_hash", z.LatestIPFSHash); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(zm.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(z).Update("latest_ip_fs_hash", z.LatestIPFSHash); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditZoneUpdated, AuditSubjectZone, name,
+			map[string]interface{}{"user_name": username, "latest_ipfs_hash": before},
+			map[string]interface{}{"user_name": username, "latest_ipfs_hash": hash},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return z, nil
 }
@@ -86,8 +116,15 @@ func (zm *ZoneManager) AddRecordForZone(zoneName, recordName, username string) (
 		return nil, errors.New("record already exists in zone")
 	}
 	z.RecordNames = append(z.RecordNames, recordName)
-	if check := zm.DB.Model(z).Update("record_names", z.RecordNames); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(zm.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(z).Update("record_names", z.RecordNames); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditZoneRecordAdded, AuditSubjectZone, zoneName,
+			nil, map[string]interface{}{"user_name": username, "record_name": recordName},
+		)
+	}); err != nil {
+		return nil, err
 	}
 	return z, nil
 }
@@ -108,3 +145,16 @@ func (zm *ZoneManager) CheckIfRecordExistsInZone(zoneName, recordName, username
 	}
 	return false, nil
 }
+
+// checkSigningKeys checks that a user may sign zones with each of the named keys
+func (zm *ZoneManager) checkSigningKeys(username string, keyNames ...string) error {
+	um := NewUserManager(zm.DB)
+	for _, keyName := range keyNames {
+		if can, err := um.CanUseKey(username, keyName, KeyPermSignTNS); err != nil {
+			return err
+		} else if !can {
+			return errors.New(ErrZoneKeyNotUsable)
+		}
+	}
+	return nil
+}
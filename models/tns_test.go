@@ -2,12 +2,18 @@ package models
 
 import (
 	"testing"
+
+	"github.com/jinzhu/gorm"
 )
 
 func TestZone(t *testing.T) {
 	db := newTestDB(t, &Zone{})
 	defer db.Close()
+	db.AutoMigrate(User{})
+	db.AutoMigrate(Usage{})
+	db.AutoMigrate(IPFSKey{})
 	var zm = NewZoneManager(db)
+	defer newZoneTestUser(t, db, "testuser", "testzonemanager", "testzonepublic")()
 	args := struct {
 		username           string
 		zoneName           string
@@ -55,3 +61,24 @@ func TestZone(t *testing.T) {
 		t.Fatal("bad record count recovered")
 	}
 }
+
+// newZoneTestUser creates a user owning the named keys, returning a function
+// that removes them
+func newZoneTestUser(t *testing.T, db *gorm.DB, username string, keyNames ...string) func() {
+	um := NewUserManager(db)
+	user, err := um.NewUserAccount(username, "password123", username+"@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keyName := range keyNames {
+		if _, err := um.NewIPFSKey(username, keyName, "", IPFSKeyOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return func() {
+		db.Unscoped().Delete(user)
+		db.Unscoped().Where("user_name = ?", username).Delete(&Usage{})
+		db.Unscoped().Where("user_name = ?", username).Delete(&IPFSKey{})
+		db.Unscoped().Where("subject = ?", username).Delete(&AuditEvent{})
+	}
+}
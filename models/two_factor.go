@@ -0,0 +1,313 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	// ErrSecondFactorRequired is an error triggered when a password has been
+	// verified, but the account requires a second factor to complete sign-in
+	ErrSecondFactorRequired = "second factor required to complete sign-in"
+	// ErrInvalidSecondFactor is an error triggered when an incorrect, expired or
+	// already used two-factor or recovery code is supplied
+	ErrInvalidSecondFactor = "invalid second factor provided"
+
+	// RecoveryCodeCount is the number of recovery codes issued to a user
+	RecoveryCodeCount = 10
+	// totpSkew is the number of time steps of clock drift we tolerate
+	totpSkew = 1
+)
+
+// SecondFactorRequiredError is returned by SignInWithOptions when a password
+// has been verified, but the account requires a second factor. Challenge must
+// be passed to SignInSecondFactor to complete the sign-in.
+type SecondFactorRequiredError struct {
+	Challenge string
+}
+
+// Error returns ErrSecondFactorRequired
+func (e *SecondFactorRequiredError) Error() string {
+	return ErrSecondFactorRequired
+}
+
+// RecoveryCode is a one-time code a user can use in place of a
+// two-factor authentication code. Only the hash of the code is stored.
+type RecoveryCode struct {
+	gorm.Model
+	UserName string `gorm:"type:varchar(255);index"`
+	CodeHash string `gorm:"type:varchar(255);unique"`
+	UsedAt   *time.Time
+}
+
+// EnrollTOTP is used to begin two-factor enrolment for a user, returning the
+// secret along with the provisioning URI for authenticator apps. The secret is
+// encrypted at rest, so a keyring must be configured. Enrolment is not active until
+// confirmed with ConfirmTOTP, and calling this again before then replaces the
+// pending secret.
+func (um *UserManager) EnrollTOTP(username, issuer string) (string, string, error) {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return "", "", err
+	}
+	if u.TOTPEnabled {
+		return "", "", errors.New("two-factor authentication is already enabled")
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	encrypted, err := encryptSecret(um.DB, secret)
+	if err != nil {
+		return "", "", err
+	}
+	if err := um.DB.Model(u).UpdateColumns(map[string]interface{}{
+		"totp_secret":    encrypted,
+		"totp_last_step": 0,
+	}).Error; err != nil {
+		return "", "", err
+	}
+	account := u.EmailAddress
+	if account == "" {
+		account = u.UserName
+	}
+	return secret, utils.TOTPProvisioningURI(issuer, account, secret), nil
+}
+
+// ConfirmTOTP is used to complete two-factor enrolment by verifying a code
+// generated from the pending secret. On success two-factor authentication is
+// enabled and a fresh set of recovery codes is returned.
+func (um *UserManager) ConfirmTOTP(username, code string) ([]string, error) {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTPEnabled {
+		return nil, errors.New("two-factor authentication is already enabled")
+	}
+	if u.TOTPSecret == "" {
+		return nil, errors.New("two-factor enrolment has not been started")
+	}
+	step, err := um.validateTOTP(u, code)
+	if err != nil {
+		return nil, err
+	}
+	var codes []string
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_last_step": step,
+		}).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, AuditUserTwoFactorEnabled, AuditSubjectUser, username, nil, nil); err != nil {
+			return err
+		}
+		codes, err = NewUserManager(tx).GenerateRecoveryCodes(username)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTOTP is used to check a two-factor code for a user. Each code can
+// only be used once, as can any code from an earlier time step.
+func (um *UserManager) VerifyTOTP(username, code string) error {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	if !u.TOTPEnabled {
+		return errors.New("two-factor authentication is not enabled")
+	}
+	step, err := um.validateTOTP(u, code)
+	if err != nil {
+		return err
+	}
+	// only accept the step if no code from this or a later step was used concurrently
+	check := um.DB.Model(&User{}).Where(
+		"id = ? AND totp_last_step < ?", u.ID, step,
+	).UpdateColumn("totp_last_step", step)
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return errors.New(ErrInvalidSecondFactor)
+	}
+	return nil
+}
+
+// UseRecoveryCode is used to verify and consume one of a user's recovery codes
+func (um *UserManager) UseRecoveryCode(username, code string) error {
+	check := um.DB.Model(&RecoveryCode{}).Where(
+		"user_name = ? AND code_hash = ? AND used_at IS NULL", username, utils.HashToken(code),
+	).UpdateColumn("used_at", time.Now())
+	if check.Error != nil {
+		return check.Error
+	}
+	if check.RowsAffected == 0 {
+		return errors.New(ErrInvalidSecondFactor)
+	}
+	return nil
+}
+
+// GenerateRecoveryCodes is used to issue a new set of recovery codes for a
+// user, replacing any existing codes
+func (um *UserManager) GenerateRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_name = ?", username).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		for i := range codes {
+			code, err := utils.GenerateSecureToken(8)
+			if err != nil {
+				return err
+			}
+			if err := tx.Create(&RecoveryCode{
+				UserName: username,
+				CodeHash: utils.HashToken(code),
+			}).Error; err != nil {
+				return err
+			}
+			codes[i] = code
+		}
+		return recordAudit(tx, AuditUserRecoveryCodesGenerated, AuditSubjectUser, username, nil, nil)
+	}); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// CheckIfTOTPEnabled is used to check if a user has two-factor authentication enabled
+func (um *UserManager) CheckIfTOTPEnabled(username string) (bool, error) {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	return u.TOTPEnabled, nil
+}
+
+// DisableTOTP is used to turn off two-factor authentication for a user,
+// removing their secret and recovery codes
+func (um *UserManager) DisableTOTP(username string) error {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+			"totp_secret":    "",
+			"totp_enabled":   false,
+			"totp_last_step": 0,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("user_name = ?", username).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserTwoFactorDisabled, AuditSubjectUser, username, nil, nil)
+	})
+}
+
+// SignInSecondFactor is used to complete a sign-in that failed with a
+// *SecondFactorRequiredError, accepting either a two-factor code or a
+// recovery code along with the error's challenge. A challenge is good for a
+// single attempt, so that codes can't be guessed without the password.
+// Failed codes count towards the manager's LockoutPolicy.
+func (um *UserManager) SignInSecondFactor(username, challenge, code string, opts SignInOptions) (bool, error) {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	var (
+		attempts = NewLoginAttemptManager(um.DB)
+		now      = time.Now()
+	)
+	if u.LockedUntil != nil && now.Before(*u.LockedUntil) {
+		if _, err := attempts.RecordAttempt(u.UserName, username, opts.IPAddress, LoginAccountLocked); err != nil {
+			return false, err
+		}
+		return false, errors.New(ErrAccountLocked)
+	}
+	if _, err := NewUserTokenManager(um.DB).ConsumeToken(u.UserName, TokenSignInChallenge, challenge); err != nil {
+		if _, err := attempts.RecordAttempt(u.UserName, username, opts.IPAddress, LoginInvalidSecondFactor); err != nil {
+			return false, err
+		}
+		return false, err
+	}
+	if err := um.VerifyTOTP(username, code); err != nil {
+		if err := um.UseRecoveryCode(username, code); err != nil {
+			if _, err := attempts.RecordAttempt(u.UserName, username, opts.IPAddress, LoginInvalidSecondFactor); err != nil {
+				return false, err
+			}
+			if err := um.lockIfNeeded(u, now); err != nil {
+				return false, err
+			}
+			return false, errors.New(ErrInvalidSecondFactor)
+		}
+	}
+	if _, err := attempts.RecordAttempt(u.UserName, username, opts.IPAddress, LoginSuccess); err != nil {
+		return false, err
+	}
+	if err := um.DB.Model(u).UpdateColumn("failed_logins_reset_at", now).Error; err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// validateTOTP checks a code against the user's secret, returning the matched time step
+func (um *UserManager) validateTOTP(u *User, code string) (int64, error) {
+	secret, err := decryptSecret(um.DB, u.TOTPSecret)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := utils.ValidateTOTPCode(secret, code, time.Now(), totpSkew)
+	if !ok || step <= u.TOTPLastStep {
+		return 0, errors.New(ErrInvalidSecondFactor)
+	}
+	return step, nil
+}
+
+// RotateTOTPSecrets is used to re-encrypt the two-factor secrets of every user
+// with the primary key of the configured keyring, after which older keys may be
+// removed from the keyring. It returns the number of users updated.
+func (um *UserManager) RotateTOTPSecrets() (int, error) {
+	// unrecognised secrets must not be mistaken for plaintext
+	if err := um.MigrateTOTPSecrets(); err != nil {
+		return 0, err
+	}
+	return reencryptSecretColumns(um.DB, &User{}, false, "totp_secret")
+}
+
+// MigrateTOTPSecrets is used to encrypt two-factor secrets stored before a
+// keyring was configured. It does nothing if there is no keyring.
+func (um *UserManager) MigrateTOTPSecrets() error {
+	if KeyringFrom(um.DB) == nil {
+		return nil
+	}
+	var users []User
+	if err := um.DB.Where(
+		"totp_secret <> '' AND totp_secret NOT LIKE ?", secretPrefix+"%",
+	).Find(&users).Error; err != nil {
+		return err
+	}
+	for _, u := range users {
+		if !utils.IsTOTPSecret(u.TOTPSecret) {
+			return fmt.Errorf("two-factor secret of user '%s' is not a recognised secret", u.UserName)
+		}
+		encrypted, err := encryptSecret(um.DB, u.TOTPSecret)
+		if err != nil {
+			return err
+		}
+		if err := um.DB.Model(&u).UpdateColumn("totp_secret", encrypted).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
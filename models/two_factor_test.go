@@ -0,0 +1,195 @@
+package models
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+func TestUserManager_TOTP(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(RecoveryCode{})
+	db.AutoMigrate(LoginAttempt{})
+	db.AutoMigrate(UserToken{})
+	var um = NewUserManager(WithKeyring(db, testKeyring("old")))
+	user, err := um.NewUserAccount("totpuser", "password123", "totpuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "totpuser").Delete(&RecoveryCode{})
+	defer um.DB.Unscoped().Where("user_name = ?", "totpuser").Delete(&LoginAttempt{})
+	defer um.DB.Unscoped().Where("user_name = ?", "totpuser").Delete(&UserToken{})
+	// signInChallenge verifies the password, returning the challenge for the second factor
+	signInChallenge := func() string {
+		valid, err := um.SignIn("totpuser", "password123")
+		required, ok := err.(*SecondFactorRequiredError)
+		if valid || !ok {
+			t.Fatalf("expected second factor to be required, got %v", err)
+		}
+		return required.Challenge
+	}
+	secret, uri, err := um.EnrollTOTP("totpuser", "Temporal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri == "" {
+		t.Fatal("provisioning uri should not be empty")
+	}
+	user, err = um.FindByUserName("totpuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(user.TOTPSecret, "enc:old:") {
+		t.Fatal("secret should be encrypted at rest")
+	}
+	if _, err := um.ConfirmTOTP("totpuser", "000000x"); err == nil {
+		t.Fatal("error expected")
+	}
+	// use the previous time step so that the current step remains usable
+	code, err := utils.GenerateTOTPCode(secret, utils.TOTPStep(time.Now())-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := um.ConfirmTOTP("totpuser", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RecoveryCodeCount {
+		t.Fatal("failed to generate recovery codes")
+	}
+	// password only sign-in should require a second factor, but still
+	// upgrade the password hash once the password has been verified
+	um.PasswordHashing = PasswordHashOptions{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	if valid, err := um.SignIn("totpuser", "password123"); err == nil || valid {
+		t.Fatal("error expected")
+	} else if err.Error() != ErrSecondFactorRequired {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if user, err := um.FindByUserName("totpuser"); err != nil {
+		t.Fatal(err)
+	} else if needsRehash(um.PasswordHashing, user.HashedPassword) {
+		t.Fatal("failed to upgrade password hash")
+	}
+	// a correct password is not a failed attempt
+	if failed, err := NewLoginAttemptManager(db).FindFailedAttempts("totpuser", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	} else if len(failed) != 0 {
+		t.Fatalf("expected no failed attempts, got %v", len(failed))
+	}
+	// codes can not be replayed
+	if err := um.VerifyTOTP("totpuser", code); err == nil {
+		t.Fatal("error expected")
+	}
+	code, err = utils.GenerateTOTPCode(secret, utils.TOTPStep(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second factor is not accepted without a verified password
+	if _, err := um.SignInSecondFactor("totpuser", "notachallenge", code, SignInOptions{}); err == nil ||
+		err.Error() != ErrInvalidToken {
+		t.Fatalf("expected challenge error, got %v", err)
+	}
+	challenge := signInChallenge()
+	if valid, err := um.SignInSecondFactor("totpuser", challenge, code, SignInOptions{}); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("sign in should succeed")
+	}
+	// challenges are single use
+	if _, err := um.SignInSecondFactor("totpuser", challenge, codes[0], SignInOptions{}); err == nil ||
+		err.Error() != ErrInvalidToken {
+		t.Fatalf("expected challenge error, got %v", err)
+	}
+	if _, err := um.SignInSecondFactor("totpuser", signInChallenge(), code, SignInOptions{}); err == nil {
+		t.Fatal("error expected")
+	}
+	// recovery codes are single use
+	if valid, err := um.SignInSecondFactor("totpuser", signInChallenge(), codes[0], SignInOptions{}); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("sign in should succeed")
+	}
+	if err := um.UseRecoveryCode("totpuser", codes[0]); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := um.DisableTOTP("totpuser"); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := um.CheckIfTOTPEnabled("totpuser"); err != nil {
+		t.Fatal(err)
+	} else if enabled {
+		t.Fatal("two-factor should be disabled")
+	}
+	if err := um.UseRecoveryCode("totpuser", codes[1]); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestUserManager_TOTPSecrets(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(HostedNetwork{})
+	var (
+		plain = NewUserManager(db)
+		um    = NewUserManager(WithKeyring(db, testKeyring("old")))
+	)
+	secrets := make(map[string]string)
+	for _, name := range []string{"totpplain", "totpother"} {
+		user, err := plain.NewUserAccount(name, "password123", name+"@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer plain.DB.Unscoped().Delete(user)
+		if secrets[name], err = utils.GenerateTOTPSecret(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// secrets can't be stored without a keyring
+	if _, _, err := plain.EnrollTOTP("totpplain", "Temporal"); err == nil || err.Error() != ErrNoKeyring {
+		t.Fatalf("expected keyring error, got %v", err)
+	}
+	// secrets stored before a keyring was configured, one of which is unrecognised
+	for name, stored := range map[string]string{"totpplain": secrets["totpplain"], "totpother": "notarealsecret"} {
+		if err := db.Model(&User{}).Where("user_name = ?", name).UpdateColumn("totp_secret", stored).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := plain.MigrateTOTPSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.RotateTOTPSecrets(); err == nil {
+		t.Fatal("error expected")
+	}
+	if err := db.Model(&User{}).Where(
+		"user_name = ?", "totpother",
+	).UpdateColumn("totp_secret", secrets["totpother"]).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := um.MigrateTOTPSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := WithKeyring(db, testKeyring("new"))
+	if count, err := RotateSecrets(rotated); err != nil {
+		t.Fatal(err)
+	} else if count < 2 {
+		t.Fatalf("expected secrets to be rotated, got %v", count)
+	}
+	for name, secret := range secrets {
+		user, err := um.FindByUserName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(user.TOTPSecret, "enc:new:") {
+			t.Fatalf("secret of %s should be encrypted with the new key", name)
+		}
+		if decrypted, err := decryptSecret(rotated, user.TOTPSecret); err != nil {
+			t.Fatal(err)
+		} else if decrypted != secret {
+			t.Fatalf("failed to decrypt secret of %s", name)
+		}
+	}
+}
@@ -88,8 +88,13 @@ func (um *UploadManager) NewUpload(contentHash, uploadType string, opts UploadOp
 		Size:               opts.Size,
 		Directory:          opts.Directory,
 	}
-	if check := um.DB.Create(&upload); check.Error != nil {
-		return nil, check.Error
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if check := tx.Create(&upload); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditUploadCreated, AuditSubjectUpload, contentHash, nil, upload.auditSnapshot())
+	}); err != nil {
+		return nil, err
 	}
 	return &upload, nil
 }
@@ -105,9 +110,15 @@ func (um *UploadManager) UpdateUpload(holdTimeInMonths int64, username, contentH
 	if newGcd.Unix() < oldGcd.Unix() {
 		return nil, errors.New(ErrShorterGCD)
 	}
+	before := upload.auditSnapshot()
 	upload.HoldTimeInMonths = holdTimeInMonths
 	upload.GarbageCollectDate = newGcd
-	if check := um.DB.Save(upload); check.Error != nil {
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if check := tx.Save(upload); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditUploadUpdated, AuditSubjectUpload, contentHash, before, upload.auditSnapshot())
+	}); err != nil {
 		return nil, err
 	}
 	return upload, nil
@@ -182,10 +193,16 @@ func (um *UploadManager) ExtendGarbageCollectionPeriod(username, hash, network s
 	if err != nil {
 		return err
 	}
+	before := upload.auditSnapshot()
 	// update garbage collection period
 	upload.GarbageCollectDate = upload.GarbageCollectDate.AddDate(0, holdTimeInMonths, 0)
 	// save the updated model
-	return um.DB.Model(upload).Update("garbage_collect_date", upload.GarbageCollectDate).Error
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(upload).Update("garbage_collect_date", upload.GarbageCollectDate).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUploadUpdated, AuditSubjectUpload, hash, before, upload.auditSnapshot())
+	})
 }
 
 // RemovePin allows removing a pin and refunding extra data costs
@@ -199,21 +216,42 @@ func (um *UploadManager) RemovePin(username, hash, network string) error {
 	if err != nil {
 		return err
 	}
-	// remove upload returning if this fails
-	if err := um.DB.Delete(upload).Error; err != nil {
-		return err
-	}
-	// will be greater than 0 if they are not free
-	// as only non-free users will need to have their credits refunded
-	if refundAmt > 0 {
-		// add credits to the user's balance
-		_, err = NewUserManager(um.DB).AddCredits(username, refundAmt)
-		if err != nil {
+	// the upload is only removed if the refund succeeds, and vice versa
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		// remove upload returning if this fails
+		if err := tx.Delete(upload).Error; err != nil {
+			return err
+		}
+		// will be greater than 0 if they are not free
+		// as only non-free users will need to have their credits refunded
+		if refundAmt > 0 {
+			// add credits to the user's balance
+			if _, err := NewUserManager(tx).AddCredits(username, refundAmt); err != nil {
+				return err
+			}
+		}
+		// reduce user's storage consumption
+		if err := NewUsageManager(tx).ReduceDataUsage(username, uint64(upload.Size)); err != nil {
 			return err
 		}
+		return recordAudit(tx, AuditUploadRemoved, AuditSubjectUpload, hash, upload.auditSnapshot(), map[string]interface{}{
+			"user_name":    username,
+			"network_name": network,
+			"refund":       refundAmt,
+		})
+	})
+}
+
+// auditSnapshot returns the audited fields of an upload
+func (u *Upload) auditSnapshot() map[string]interface{} {
+	return map[string]interface{}{
+		"user_name":            u.UserName,
+		"network_name":         u.NetworkName,
+		"type":                 u.Type,
+		"size":                 u.Size,
+		"hold_time_in_months":  u.HoldTimeInMonths,
+		"garbage_collect_date": u.GarbageCollectDate,
 	}
-	// reduce user's storage consumption
-	return NewUsageManager(um.DB).ReduceDataUsage(username, uint64(upload.Size))
 }
 
 // CalculateRefundCost returns the amount of credits to refund the user
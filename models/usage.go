@@ -29,6 +29,17 @@ func (d DataUsageTier) ZeroCreditRefunds() bool {
 	}
 }
 
+// RepublishesIPNS indicates whether the IPNS records of this tier are
+// automatically republished before they expire
+func (d DataUsageTier) RepublishesIPNS() bool {
+	switch d {
+	case Unverified, Free:
+		return false
+	default:
+		return true
+	}
+}
+
 // PricePerGB returns the price per gb of a usage tier
 func (d DataUsageTier) PricePerGB() float64 {
 	switch d {
@@ -147,7 +158,8 @@ type Usage struct {
 	MonthlyDataLimitBytes uint64 `gorm:"type:numeric;default:0"`
 	// keeps track of the current monthyl upload limit used
 	CurrentDataUsedBytes uint64 `gorm:"type:numeric;default:0"`
-	// keeps track of how many IPNS records the user has published
+	// keeps track of how many IPNS records the user has published, including
+	// republishes. Deleting a record doesn't reduce this count.
 	IPNSRecordsPublished int64 `gorm:"type:integer;default:0"`
 	// keeps track of how many ipns records the user is allowed to publish
 	IPNSRecordsAllowed int64 `gorm:"type:integer;default:0"`
@@ -156,6 +168,8 @@ type Usage struct {
 	// keeps track of the number of pubsub messages a user is allowed to send
 	PubSubMessagesAllowed int64 `gorm:"type:integer;default:0"`
 	// keeps track of how many keys the user has created
+	//
+	// Deprecated: key counts are derived from the IPFSKey table
 	KeysCreated int64 `gorm:"type:integer;default:0"`
 	// keeps track of how many keys the user is allowed to create
 	KeysAllowed int64 `gorm:"type:integer;default:0"`
@@ -185,7 +199,14 @@ func (bm *UsageManager) NewUsageEntry(username string, tier DataUsageTier) (*Usa
 	if err := bm.setTier(usage, tier); err != nil {
 		return nil, err
 	}
-	if err := bm.DB.Create(usage).Error; err != nil {
+	if err := withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(usage).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageCreated, AuditSubjectUser, username,
+			nil, map[string]interface{}{"tier": tier},
+		)
+	}); err != nil {
 		return nil, err
 	}
 	return usage, nil
@@ -240,7 +261,11 @@ func (bm *UsageManager) CanCreateKey(username string) error {
 	if err != nil {
 		return err
 	}
-	if b.KeysCreated >= b.KeysAllowed {
+	count, err := countIPFSKeys(bm.DB, username)
+	if err != nil {
+		return err
+	}
+	if count >= b.KeysAllowed {
 		return errors.New("too many keys created")
 	}
 	return nil
@@ -292,17 +317,21 @@ func (bm *UsageManager) ReduceDataUsage(username string, uploadSizeBytes uint64)
 }
 
 // ReduceKeyCount is used to reduce the number of keys a user has created
+//
+// Deprecated: key counts are derived from the IPFSKey table, removing a key
+// with UserManager.RemoveIPFSKeyForUser is enough
 func (bm *UsageManager) ReduceKeyCount(username string, count int64) error {
 	b, err := bm.FindByUserName(username)
 	if err != nil {
 		return err
 	}
+	before := b.KeysCreated
 	if b.KeysCreated < count {
 		b.KeysCreated = 0
 	} else {
 		b.KeysCreated = b.KeysCreated - count
 	}
-	return bm.DB.Model(b).Update("keys_created", b.KeysCreated).Error
+	return bm.updateKeyCount(b, before)
 }
 
 // UpdateTier is used to update the Usage tier associated with an account
@@ -311,16 +340,25 @@ func (bm *UsageManager) UpdateTier(username string, tier DataUsageTier) error {
 	if err != nil {
 		return err
 	}
+	before := b.Tier
 	if err := bm.setTier(b, tier); err != nil {
 		return err
 	}
-	return bm.DB.Model(b).UpdateColumns(map[string]interface{}{
-		"tier":                     b.Tier,
-		"keys_allowed":             b.KeysAllowed,
-		"pub_sub_messages_allowed": b.PubSubMessagesAllowed,
-		"ip_ns_records_allowed":    b.IPNSRecordsAllowed,
-		"monthly_data_limit_bytes": b.MonthlyDataLimitBytes},
-	).Error
+	return withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(b).UpdateColumns(map[string]interface{}{
+			"tier":                     b.Tier,
+			"keys_allowed":             b.KeysAllowed,
+			"pub_sub_messages_allowed": b.PubSubMessagesAllowed,
+			"ip_ns_records_allowed":    b.IPNSRecordsAllowed,
+			"monthly_data_limit_bytes": b.MonthlyDataLimitBytes},
+		).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageTierChanged, AuditSubjectUser, username,
+			map[string]interface{}{"tier": before},
+			map[string]interface{}{"tier": b.Tier},
+		)
+	})
 }
 
 // IncrementPubSubUsage is used to increment the pubsub publish counter
@@ -344,13 +382,17 @@ func (bm *UsageManager) IncrementIPNSUsage(username string, count int64) error {
 }
 
 // IncrementKeyCount is used to increment the key created counter
+//
+// Deprecated: key counts are derived from the IPFSKey table, adding a key
+// with UserManager.AddIPFSKeyForUser is enough
 func (bm *UsageManager) IncrementKeyCount(username string, count int64) error {
 	b, err := bm.FindByUserName(username)
 	if err != nil {
 		return err
 	}
+	before := b.KeysCreated
 	b.KeysCreated = b.KeysCreated + count
-	return bm.DB.Model(b).Update("keys_created", b.KeysCreated).Error
+	return bm.updateKeyCount(b, before)
 }
 
 // ResetCounts is used to reset monthly usage counts.
@@ -362,12 +404,21 @@ func (bm *UsageManager) ResetCounts(username string) error {
 	if err != nil {
 		return err
 	}
-	b.IPNSRecordsPublished = 0
-	b.PubSubMessagesSent = 0
-	return bm.DB.Model(b).UpdateColumns(map[string]interface{}{
+	before := map[string]interface{}{
 		"ip_ns_records_published": b.IPNSRecordsPublished,
 		"pub_sub_messages_sent":   b.PubSubMessagesSent,
-	}).Error
+	}
+	b.IPNSRecordsPublished = 0
+	b.PubSubMessagesSent = 0
+	return withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(b).UpdateColumns(map[string]interface{}{
+			"ip_ns_records_published": b.IPNSRecordsPublished,
+			"pub_sub_messages_sent":   b.PubSubMessagesSent,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageCountsReset, AuditSubjectUser, username, before, nil)
+	})
 }
 
 // ClaimENSName is used to claim the users ens name
@@ -383,10 +434,17 @@ func (bm *UsageManager) ClaimENSName(username string) error {
 		return errors.New("already claimed ens name")
 	}
 	b.ClaimedENSName = true
-	return bm.DB.Model(b).UpdateColumns(map[string]interface{}{
-		"claimed_ens_name": b.ClaimedENSName,
-	}).Error
-
+	return withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(b).UpdateColumns(map[string]interface{}{
+			"claimed_ens_name": b.ClaimedENSName,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageENSChanged, AuditSubjectUser, username,
+			map[string]interface{}{"claimed_ens_name": false},
+			map[string]interface{}{"claimed_ens_name": true},
+		)
+	})
 }
 
 // UnclaimENSName is used to unclaim a users ens name
@@ -399,9 +457,30 @@ func (bm *UsageManager) UnclaimENSName(username string) error {
 		return errors.New("name already unclaimed")
 	}
 	b.ClaimedENSName = false
-	return bm.DB.Model(b).UpdateColumns(map[string]interface{}{
-		"claimed_ens_name": b.ClaimedENSName,
-	}).Error
+	return withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(b).UpdateColumns(map[string]interface{}{
+			"claimed_ens_name": b.ClaimedENSName,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageENSChanged, AuditSubjectUser, username,
+			map[string]interface{}{"claimed_ens_name": true},
+			map[string]interface{}{"claimed_ens_name": false},
+		)
+	})
+}
+
+// updateKeyCount stores the number of keys a user has created, recording the change from before
+func (bm *UsageManager) updateKeyCount(b *Usage, before int64) error {
+	return withTransaction(bm.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(b).Update("keys_created", b.KeysCreated).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUsageKeyCountChanged, AuditSubjectUser, b.UserName,
+			map[string]interface{}{"keys_created": before},
+			map[string]interface{}{"keys_created": b.KeysCreated},
+		)
+	})
 }
 
 func (bm *UsageManager) setTier(usage *Usage, tier DataUsageTier) error {
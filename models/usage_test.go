@@ -10,6 +10,7 @@ import (
 func TestUsage(t *testing.T) {
 	db := newTestDB(t, &Usage{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
 	var bm = NewUsageManager(db)
 	type args struct {
 		username       string
@@ -142,6 +143,7 @@ func TestUsage(t *testing.T) {
 func TestUnverified(t *testing.T) {
 	db := newTestDB(t, &Usage{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
 	var bm = NewUsageManager(db)
 	b, err := bm.NewUsageEntry("testuserunverified", Unverified)
 	if err != nil {
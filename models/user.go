@@ -1,13 +1,12 @@
 package models
 
 import (
-	"encoding/hex"
 	"errors"
+	"time"
 
 	"github.com/RTradeLtd/database/v2/utils"
 	"github.com/jinzhu/gorm"
 	"github.com/lib/pq"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -23,7 +22,7 @@ type User struct {
 	AccountEnabled         bool    `gorm:"type:boolean"`
 	EmailEnabled           bool    `gorm:"type:boolean"`
 	EmailVerificationToken string  `gorm:"type:varchar(255)"`
-	AdminAccess            bool    `gorm:"type:boolean"`
+	AdminAccess            bool    `gorm:"type:boolean"` // Deprecated: only read by MigrateAdminAccess, see AdminRole
 	HashedPassword         string  `gorm:"type:varchar(255)"`
 	Free                   bool    `gorm:"type:boolean"`
 	Credits                float64 `gorm:"type:float;default:0"`
@@ -33,183 +32,222 @@ type User struct {
 	// organization based billing, not user-account billing
 	Organization string `gorm:"type:varchar(255)"`
 	// IPFSKeyNames is an array of IPFS key name this user has created
+	//
+	// Deprecated: keys are stored in the IPFSKey table, this is only read by MigrateIPFSKeyArrays
 	IPFSKeyNames pq.StringArray `gorm:"type:text[];column:ipfs_key_names"`
 	// IPFSKeyIDs is an array of public key hashes for IPFS keys this user has created
+	//
+	// Deprecated: keys are stored in the IPFSKey table, this is only read by MigrateIPFSKeyArrays
 	IPFSKeyIDs pq.StringArray `gorm:"type:text[];column:ipfs_key_ids"`
 	// IPFSNetworkNames is an array of private IPFS networks this user has access to
+	//
+	// Deprecated: network access is stored in the NetworkMember table, this is only read by MigrateNetworkMembership
 	IPFSNetworkNames pq.StringArray `gorm:"type:text[];column:ipfs_network_names"`
+	// LockedUntil is set when the account is locked due to repeated failed sign-ins
+	LockedUntil *time.Time
+	// FailedLoginsResetAt is the time after which failed sign-ins count towards a lockout
+	FailedLoginsResetAt *time.Time
+	// TOTPSecret is the encrypted two-factor authentication secret
+	TOTPSecret string `gorm:"type:text;column:totp_secret"`
+	// TOTPEnabled is set once the user has confirmed two-factor enrolment
+	TOTPEnabled bool `gorm:"type:boolean;column:totp_enabled"`
+	// TOTPLastStep is the last time step a code was accepted for, used to prevent replays
+	TOTPLastStep int64 `gorm:"type:bigint;column:totp_last_step"`
+	// PendingEmailAddress is the address the user has asked to change to,
+	// which only replaces EmailAddress once confirmed with ConfirmEmailChange
+	PendingEmailAddress string `gorm:"type:varchar(255)"`
+	// SuspensionReason is why the account is currently suspended, if it is
+	SuspensionReason SuspensionReason `gorm:"type:varchar(255)"`
+	// SuspensionReinstateAt is when a suspended account is automatically reinstated
+	SuspensionReinstateAt *time.Time
+}
+
+const (
+	// ErrAccountLocked is an error triggered when signing in to an account
+	// that is locked due to too many failed sign-in attempts
+	ErrAccountLocked = "account is temporarily locked due to too many failed sign-in attempts"
+)
+
+// LockoutPolicy configures when accounts are locked due to failed sign-ins
+type LockoutPolicy struct {
+	// MaxFailures is the number of failed sign-ins that triggers a lockout,
+	// a value of 0 disables lockouts
+	MaxFailures int
+	// Window is the period over which failed sign-ins are counted
+	Window time.Duration
+	// Cooldown is how long an account stays locked before it is automatically unlocked
+	Cooldown time.Duration
+}
+
+// DefaultLockoutPolicy locks an account for 15 minutes after 5 failed sign-ins within 15 minutes
+var DefaultLockoutPolicy = LockoutPolicy{
+	MaxFailures: 5,
+	Window:      time.Minute * 15,
+	Cooldown:    time.Minute * 15,
 }
 
 // UserManager is our helper to interact with our database
 type UserManager struct {
 	DB *gorm.DB
+	// Lockout configures account lockout after repeated failed sign-ins
+	Lockout LockoutPolicy
+	// PasswordPolicy restricts which passwords users may choose
+	PasswordPolicy PasswordPolicy
+	// PasswordHashing configures how passwords are hashed, existing
+	// hashes are upgraded to these options on successful sign-in
+	PasswordHashing PasswordHashOptions
 }
 
 // NewUserManager is used to generate our user manager helper
 func NewUserManager(db *gorm.DB) *UserManager {
-	um := UserManager{DB: db}
+	um := UserManager{
+		DB:              db,
+		Lockout:         DefaultLockoutPolicy,
+		PasswordPolicy:  DefaultPasswordPolicy,
+		PasswordHashing: DefaultPasswordHashOptions,
+	}
 	return &um
 }
 
 // GetPrivateIPFSNetworksForUser is used to get a list of allowed private ipfs networks for a user
 func (um *UserManager) GetPrivateIPFSNetworksForUser(username string) ([]string, error) {
-	u, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
+		return nil, err
+	}
+	var networks []string
+	if err := um.DB.Model(&NetworkMember{}).Where(
+		"user_name = ?", username,
+	).Order("created_at asc").Pluck("network_name", &networks).Error; err != nil {
 		return nil, err
 	}
-	return u.IPFSNetworkNames, nil
+	return networks, nil
 }
 
 // CheckIfUserHasAccessToNetwork is used to check if a user has access to a private ipfs network
 func (um *UserManager) CheckIfUserHasAccessToNetwork(username, networkName string) (bool, error) {
-	u, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return false, err
 	}
-	for _, v := range u.IPFSNetworkNames {
-		if v == networkName {
-			return true, nil
-		}
+	var count int
+	if err := um.DB.Model(&NetworkMember{}).Where(
+		"user_name = ? AND network_name = ?", username, networkName,
+	).Count(&count).Error; err != nil {
+		return false, err
 	}
-	return false, nil
+	return count > 0, nil
 }
 
 // AddIPFSNetworkForUser is used to update a users allowed private ipfs networks
 func (um *UserManager) AddIPFSNetworkForUser(username, networkName string) error {
-	u, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return err
 	}
-	for _, v := range u.IPFSNetworkNames {
-		if v == networkName {
-			return errors.New("network already configured for user")
-		}
-	}
-	u.IPFSNetworkNames = append(u.IPFSNetworkNames, networkName)
-	if check := um.DB.Model(u).Update("ipfs_network_names", u.IPFSNetworkNames); check.Error != nil {
-		return check.Error
-	}
-
-	return nil
+	_, err := addNetworkMember(um.DB, networkName, username, NetworkRoleUser)
+	return err
 }
 
 // RemoveIPFSNetworkForUser is used to remove a configured ipfs network from the users authorized networks
 func (um *UserManager) RemoveIPFSNetworkForUser(username, networkName string) error {
-	user, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return err
 	}
-	var networks []string
-	for _, v := range user.IPFSNetworkNames {
-		if v == networkName {
-			continue
-		}
-		networks = append(networks, v)
-	}
-	if len(networks) == len(user.IPFSNetworkNames) {
-		return errors.New("user was not registered for this network")
-	}
-	user.IPFSNetworkNames = networks
-	return um.DB.Model(user).Update("ipfs_network_names", networks).Error
+	return NewHostedNetworkManager(um.DB).RemoveNetworkMember(networkName, username)
 }
 
 // AddIPFSKeyForUser is used to add a key to a user
 func (um *UserManager) AddIPFSKeyForUser(username, keyName, keyID string) error {
-	u, err := um.FindByUserName(username)
-	if err != nil {
-		return err
-	}
-	for _, v := range u.IPFSKeyNames {
-		if v == keyName {
-			return errors.New("key already exists in database for user")
-		}
-	}
-	u.IPFSKeyNames = append(u.IPFSKeyNames, keyName)
-	u.IPFSKeyIDs = append(u.IPFSKeyIDs, keyID)
-	// The following only updates the specified column for the given model
-	return um.DB.Model(u).Updates(map[string]interface{}{
-		"ipfs_key_names": u.IPFSKeyNames,
-		"ipfs_key_ids":   u.IPFSKeyIDs,
-	}).Error
+	_, err := um.NewIPFSKey(username, keyName, keyID, IPFSKeyOptions{})
+	return err
 }
 
 // RemoveIPFSKeyForUser is used to remove a given key name and its id from the users
 // available keys they have created.
 func (um *UserManager) RemoveIPFSKeyForUser(username, keyName, keyID string) error {
-	user, err := um.FindByUserName(username)
+	if _, err := um.FindByUserName(username); err != nil {
+		return err
+	}
+	key, err := um.FindIPFSKeyByName(username, keyName)
 	if err != nil {
 		return err
 	}
-	var (
-		parsedKeyNames []string
-		parsedKeyIDs   []string
-	)
-	for _, name := range user.IPFSKeyNames {
-		if name != keyName {
-			parsedKeyNames = append(parsedKeyNames, name)
-		}
+	if key.PeerID != keyID {
+		return errors.New(ErrKeyNotFound)
 	}
-	for _, id := range user.IPFSKeyIDs {
-		if id != keyID {
-			parsedKeyIDs = append(parsedKeyIDs, id)
+	now := time.Now()
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(key).UpdateColumn("revoked_at", now).Error; err != nil {
+			return err
 		}
-	}
-	user.IPFSKeyNames = parsedKeyNames
-	user.IPFSKeyIDs = parsedKeyIDs
-	// update model and return
-	return um.DB.Model(user).Updates(map[string]interface{}{
-		"ipfs_key_names": user.IPFSKeyNames,
-		"ipfs_key_ids":   user.IPFSKeyIDs,
-	}).Error
+		// a removed key can no longer be used by anyone it was shared with
+		if err := tx.Model(&KeyGrant{}).Where(
+			"key_id = ? AND revoked_at IS NULL", key.ID,
+		).UpdateColumns(map[string]interface{}{
+			"revoked_at": now,
+			"revoked_by": username,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserKeyRemoved, AuditSubjectUser, username,
+			map[string]interface{}{"key_name": keyName, "key_id": keyID}, nil)
+	})
 }
 
 // GetKeysForUser is used to get a mapping of a users keys
 func (um *UserManager) GetKeysForUser(username string) (map[string][]string, error) {
-	u, err := um.FindByUserName(username)
+	if _, err := um.FindByUserName(username); err != nil {
+		return nil, err
+	}
+	ipfsKeys, err := um.FindIPFSKeysByUser(username)
 	if err != nil {
 		return nil, err
 	}
-	keys := make(map[string][]string)
-	keys["key_names"] = u.IPFSKeyNames
-	keys["key_ids"] = u.IPFSKeyIDs
+	keys := map[string][]string{
+		"key_names": {},
+		"key_ids":   {},
+	}
+	for _, key := range ipfsKeys {
+		keys["key_names"] = append(keys["key_names"], key.Name)
+		keys["key_ids"] = append(keys["key_ids"], key.PeerID)
+	}
 	return keys, nil
 }
 
-// GetKeyIDByName is used to get the ID of a key by searching for its name
+// GetKeyIDByName is used to get the ID of a key owned by the user by searching for its name
 func (um *UserManager) GetKeyIDByName(username, keyName string) (string, error) {
-	u, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return "", err
 	}
-	for k, v := range u.IPFSKeyNames {
-		if v == keyName {
-			return u.IPFSKeyIDs[k], nil
-		}
+	key, err := um.FindIPFSKeyByName(username, keyName)
+	if err != nil {
+		return "", err
 	}
-	return "", errors.New("key not found")
+	return key.PeerID, nil
 }
 
-// CheckIfKeyOwnedByUser is used to check if a key is owned by a user
+// CheckIfKeyOwnedByUser is used to check if a key is owned by a user. Use
+// CanUseKey to check whether a user may use a key that was shared with them.
 func (um *UserManager) CheckIfKeyOwnedByUser(username, keyName string) (bool, error) {
-	u, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return false, err
 	}
-	for _, v := range u.IPFSKeyNames {
-		if v == keyName {
-			return true, nil
+	if _, err := um.FindIPFSKeyByName(username, keyName); err != nil {
+		if err.Error() == ErrKeyNotFound {
+			return false, nil
 		}
+		return false, err
 	}
-	return false, nil
+	return true, nil
 }
 
-// CheckIfUserAccountEnabled is used to check if a user account is enabled
+// CheckIfUserAccountEnabled is used to check if a user account is enabled.
+// Accounts whose suspension has ended are reported as enabled, although they
+// are only reinstated by ReinstateExpiredSuspensions or when next signing in.
 func (um *UserManager) CheckIfUserAccountEnabled(username string) (bool, error) {
 	u, err := um.FindByUserName(username)
 	if err != nil {
 		return false, err
 	}
-	return u.AccountEnabled, nil
+	return accountEnabled(u, time.Now()), nil
 }
 
 // ChangePassword is used to change a users password
@@ -218,20 +256,16 @@ func (um *UserManager) ChangePassword(username, currentPassword, newPassword str
 	if err != nil {
 		return false, err
 	}
-	decodedPassword, err := hex.DecodeString(u.HashedPassword)
-	if err != nil {
+	if valid, err := comparePassword(u.HashedPassword, currentPassword); err != nil {
 		return false, err
-	}
-	if err := bcrypt.CompareHashAndPassword(decodedPassword, []byte(currentPassword)); err != nil {
+	} else if !valid {
 		return false, errors.New("invalid current password")
 	}
-	newHashedPass, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
-	if err != nil {
+	if err := um.CheckPassword(u, newPassword); err != nil {
 		return false, err
 	}
-	encodedNewHashedPass := hex.EncodeToString(newHashedPass)
-	if check := um.DB.Model(u).Update("hashed_password", encodedNewHashedPass); check.Error != nil {
-		return false, check.Error
+	if err := um.setPassword(u, newPassword, AuditUserPasswordChanged); err != nil {
+		return false, err
 	}
 	return true, nil
 }
@@ -255,55 +289,191 @@ func (um *UserManager) NewUserAccount(username, password, email string) (*User,
 	if err == nil {
 		return nil, errors.New("username is already taken")
 	}
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err := um.PasswordPolicy.Validate(password); err != nil {
+		return nil, err
+	}
+	hashedPass, err := hashPassword(um.PasswordHashing, password)
 	if err != nil {
 		return nil, err
 	}
 	user = &User{
 		UserName:           username,
-		HashedPassword:     hex.EncodeToString(hashedPass),
+		HashedPassword:     hashedPass,
 		EmailAddress:       email,
 		AccountEnabled:     true,
 		AdminAccess:        false,
 		Free:               true,
 		CustomerObjectHash: EmptyCustomerObjectHash,
 	}
-	// create user model
-	if check := um.DB.Create(user); check.Error != nil {
-		return nil, check.Error
-	}
-	usageManager := NewUsageManager(um.DB)
-	if _, err := usageManager.NewUsageEntry(username, Unverified); err != nil {
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		// create user model
+		if check := tx.Create(user); check.Error != nil {
+			return check.Error
+		}
+		if err := recordAudit(tx, AuditUserCreated, AuditSubjectUser, username, nil, map[string]interface{}{
+			"email_address": email,
+		}); err != nil {
+			return err
+		}
+		_, err := NewUsageManager(tx).NewUsageEntry(username, Unverified)
+		return err
+	}); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
 // SignIn is used to authenticate a user, and check if their account is enabled.
-// Returns bool on succesful login, or false with an error on failure
+// Returns bool on succesful login, or false with an error on failure. Sign-ins
+// to accounts with two-factor authentication enabled fail with a
+// *SecondFactorRequiredError once the password has been verified, and are
+// then completed with SignInSecondFactor using the error's challenge.
 func (um *UserManager) SignIn(usernameOrEmail, password string) (bool, error) {
+	return um.SignInWithOptions(usernameOrEmail, password, SignInOptions{})
+}
+
+// SignInOptions provides details about the client attempting to sign in
+type SignInOptions struct {
+	IPAddress string
+}
+
+// SignInWithOptions is used to authenticate a user, recording the attempt along
+// with details about the client. Accounts are locked according to the manager's
+// LockoutPolicy after repeated failures, and sign-ins to accounts with
+// two-factor authentication enabled fail with a *SecondFactorRequiredError.
+func (um *UserManager) SignInWithOptions(usernameOrEmail, password string, opts SignInOptions) (bool, error) {
 	var (
-		u   *User
-		err error
+		attempts = NewLoginAttemptManager(um.DB)
+		u        *User
+		err      error
 	)
 	if u, err = um.FindByUserName(usernameOrEmail); err != nil {
 		if u, err = um.FindByEmail(usernameOrEmail); err != nil {
+			if _, recErr := attempts.RecordAttempt("", usernameOrEmail, opts.IPAddress, LoginUnknownAccount); recErr != nil {
+				return false, recErr
+			}
+			return false, err
+		}
+	}
+	now := time.Now()
+	if u.LockedUntil != nil && now.Before(*u.LockedUntil) {
+		if _, err := attempts.RecordAttempt(u.UserName, usernameOrEmail, opts.IPAddress, LoginAccountLocked); err != nil {
 			return false, err
 		}
+		return false, errors.New(ErrAccountLocked)
 	}
-	if !u.AccountEnabled {
+	if !accountEnabled(u, now) {
+		if _, err := attempts.RecordAttempt(u.UserName, usernameOrEmail, opts.IPAddress, LoginAccountDisabled); err != nil {
+			return false, err
+		}
 		return false, errors.New("account is disabled")
 	}
-	validPassword, err := um.ComparePlaintextPasswordToHash(usernameOrEmail, password)
+	valid, err := comparePassword(u.HashedPassword, password)
 	if err != nil {
 		return false, err
 	}
-	if !validPassword {
+	if !valid {
+		if _, err := attempts.RecordAttempt(u.UserName, usernameOrEmail, opts.IPAddress, LoginInvalidPassword); err != nil {
+			return false, err
+		}
+		if err := um.lockIfNeeded(u, now); err != nil {
+			return false, err
+		}
 		return false, errors.New("invalid password supplied")
 	}
+	// transparently upgrade hashes generated with outdated options, this is
+	// the only time we have access to the plaintext password
+	if needsRehash(um.PasswordHashing, u.HashedPassword) {
+		hashedPass, err := hashPassword(um.PasswordHashing, password)
+		if err != nil {
+			return false, err
+		}
+		if err := um.DB.Model(u).UpdateColumn("hashed_password", hashedPass).Error; err != nil {
+			return false, err
+		}
+	}
+	// accounts whose suspension has ended are only reinstated once the
+	// password has been verified
+	if _, err := um.reinstateIfDue(u, now); err != nil {
+		return false, err
+	}
+	if u.TOTPEnabled {
+		if _, err := attempts.RecordAttempt(u.UserName, usernameOrEmail, opts.IPAddress, LoginSecondFactorRequired); err != nil {
+			return false, err
+		}
+		_, challenge, err := NewUserTokenManager(um.DB).NewToken(u.UserName, TokenSignInChallenge, 0)
+		if err != nil {
+			return false, err
+		}
+		return false, &SecondFactorRequiredError{Challenge: challenge}
+	}
+	if _, err := attempts.RecordAttempt(u.UserName, usernameOrEmail, opts.IPAddress, LoginSuccess); err != nil {
+		return false, err
+	}
+	// failures before a successful sign-in no longer count towards a lockout
+	if err := um.DB.Model(u).UpdateColumn("failed_logins_reset_at", now).Error; err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
+// CheckIfAccountLocked is used to check if a user account is locked due to failed sign-ins
+func (um *UserManager) CheckIfAccountLocked(username string) (bool, error) {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil), nil
+}
+
+// UnlockAccount is used by administrators to unlock an account locked due to failed sign-ins
+func (um *UserManager) UnlockAccount(username string) error {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+			"locked_until":           nil,
+			"failed_logins_reset_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserUnlocked, AuditSubjectUser, username,
+			map[string]interface{}{"locked_until": u.LockedUntil}, nil)
+	})
+}
+
+// lockIfNeeded locks the account if it has exceeded the lockout policy
+func (um *UserManager) lockIfNeeded(u *User, now time.Time) error {
+	if um.Lockout.MaxFailures <= 0 {
+		return nil
+	}
+	since := now.Add(-um.Lockout.Window)
+	if u.FailedLoginsResetAt != nil && u.FailedLoginsResetAt.After(since) {
+		since = *u.FailedLoginsResetAt
+	}
+	count, err := NewLoginAttemptManager(um.DB).CountFailedCredentialAttempts(u.UserName, since)
+	if err != nil {
+		return err
+	}
+	if count < um.Lockout.MaxFailures {
+		return nil
+	}
+	// failures leading up to this lockout are not counted once it expires
+	lockedUntil := now.Add(um.Lockout.Cooldown)
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(u).UpdateColumns(map[string]interface{}{
+			"locked_until":           lockedUntil,
+			"failed_logins_reset_at": now,
+		}).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserLocked, AuditSubjectUser, u.UserName,
+			nil, map[string]interface{}{"locked_until": lockedUntil, "failed_attempts": count})
+	})
+}
+
 // ComparePlaintextPasswordToHash is a helper method used to validate a users password
 func (um *UserManager) ComparePlaintextPasswordToHash(usernameOrEmail, password string) (bool, error) {
 	var (
@@ -315,13 +485,12 @@ func (um *UserManager) ComparePlaintextPasswordToHash(usernameOrEmail, password
 			return false, err
 		}
 	}
-	passwordBytes, err := hex.DecodeString(u.HashedPassword)
+	valid, err := comparePassword(u.HashedPassword, password)
 	if err != nil {
 		return false, err
 	}
-	err = bcrypt.CompareHashAndPassword(passwordBytes, []byte(password))
-	if err != nil {
-		return false, err
+	if !valid {
+		return false, errors.New("invalid password supplied")
 	}
 	return true, nil
 
@@ -342,11 +511,12 @@ func (um *UserManager) AddCredits(username string, credits float64) (*User, erro
 	if err != nil {
 		return nil, err
 	}
+	before := u.Credits
 	// update new credit balance in memory
 	u.Credits = u.Credits + credits
 	// save updated credit balance to database
-	if check := um.DB.Model(u).Update("credits", u.Credits); check.Error != nil {
-		return nil, check.Error
+	if err := um.saveCredits(u, before); err != nil {
+		return nil, err
 	}
 	return u, nil
 }
@@ -377,24 +547,48 @@ func (um *UserManager) RemoveCredits(username string, credits float64) (*User, e
 	if user.Credits < credits {
 		return nil, errors.New("unable to remove credits, would result in negative balance")
 	}
+	before := user.Credits
 	user.Credits = user.Credits - credits
-	if check := um.DB.Model(user).Update("credits", user.Credits); check.Error != nil {
-		return nil, check.Error
+	if err := um.saveCredits(user, before); err != nil {
+		return nil, err
 	}
 	return user, nil
 }
 
-// CheckIfAdmin is used to check if an account is an administrator
+// saveCredits stores the user's credit balance, recording the change from before
+func (um *UserManager) saveCredits(u *User, before float64) error {
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if check := tx.Model(u).Update("credits", u.Credits); check.Error != nil {
+			return check.Error
+		}
+		return recordAudit(tx, AuditUserCreditsChanged, AuditSubjectUser, u.UserName,
+			map[string]interface{}{"credits": before},
+			map[string]interface{}{"credits": u.Credits},
+		)
+	})
+}
+
+// CheckIfAdmin is used to check if an account is an administrator,
+// that is whether or not it has been assigned the admin role
 func (um *UserManager) CheckIfAdmin(username string) (bool, error) {
-	user, err := um.FindByUserName(username)
-	if err != nil {
+	if _, err := um.FindByUserName(username); err != nil {
 		return false, err
 	}
-	return user.AdminAccess, nil
+	return NewRoleManager(um.DB).HasRole(username, AdminRole)
+}
+
+// HasPermission is used to check if any of a user's roles grant the given permission
+func (um *UserManager) HasPermission(username string, perm Permission) (bool, error) {
+	if _, err := um.FindByUserName(username); err != nil {
+		return false, err
+	}
+	return NewRoleManager(um.DB).HasPermission(username, perm)
 }
 
 // GenerateEmailVerificationToken is used to generate a token we use to validate that the user
-// actually owns the email they are signing up with
+// actually owns the email they are signing up with. Any previously issued verification token
+// is invalidated. Only a hash of the token is stored, the plaintext token is returned through
+// the EmailVerificationToken field of the returned user so that it can be sent to the user.
 func (um *UserManager) GenerateEmailVerificationToken(username string) (*User, error) {
 	user, err := um.FindByUserName(username)
 	if err != nil {
@@ -404,61 +598,194 @@ func (um *UserManager) GenerateEmailVerificationToken(username string) (*User, e
 	if user.EmailAddress == "" {
 		return nil, errors.New("user has no email address associated with their account")
 	}
-	if user.EmailVerificationToken != "" {
-		return nil, errors.New("user already has pending verification token")
+	if user.EmailEnabled {
+		return nil, errors.New("email address is already verified")
 	}
-	randUtils := utils.GenerateRandomUtils()
-	token := randUtils.GenerateString(32, utils.LetterBytes)
-	user.EmailVerificationToken = token
-	if err := um.DB.Model(user).Update("email_verification_token", user.EmailVerificationToken).Error; err != nil {
+	_, token, err := NewUserTokenManager(um.DB).NewToken(username, TokenVerifyEmail, 0)
+	if err != nil {
 		return nil, err
 	}
+	// clear out any plaintext token stored by older versions
+	if user.EmailVerificationToken != "" {
+		if err := um.DB.Model(user).Update("email_verification_token", "").Error; err != nil {
+			return nil, err
+		}
+	}
+	user.EmailVerificationToken = token
 	return user, nil
 }
 
-// ValidateEmailVerificationToken is used to validate an email token to enable email access
+// ValidateEmailVerificationToken is used to validate an email token to enable email access.
+// Tokens are single use, and expire after TokenVerifyEmail.DefaultLifetime()
 func (um *UserManager) ValidateEmailVerificationToken(username, token string) (*User, error) {
 	user, err := um.FindByUserName(username)
 	if err != nil {
 		return nil, err
 	}
-	if user.EmailVerificationToken != token {
-		return nil, errors.New("invalid token provided")
+	if _, err := NewUserTokenManager(um.DB).ConsumeToken(username, TokenVerifyEmail, token); err != nil {
+		return nil, err
 	}
 	user.EmailEnabled = true
-	if err := um.DB.Model(user).Update("email_enabled", user.EmailEnabled).Error; err != nil {
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("email_enabled", user.EmailEnabled).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserEmailVerified, AuditSubjectUser, username,
+			nil, map[string]interface{}{"email_address": user.EmailAddress},
+		)
+	}); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-// ResetPassword is used to reset a user's password if they forgot it
+// ResetPassword is used to reset a user's password to a randomly generated
+// one if they forgot it. The password is checked against the manager's
+// PasswordPolicy and recorded in the user's password history.
+//
+// Deprecated: use GeneratePasswordResetToken and ResetPasswordWithToken
+// so that the user chooses their own password
 func (um *UserManager) ResetPassword(username string) (string, error) {
 	u, err := um.FindByUserName(username)
 	if err != nil {
 		return "", err
 	}
-	randUtils := utils.GenerateRandomUtils()
-	newPassword := randUtils.GenerateString(32, utils.LetterBytes)
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	newPassword, err := utils.GenerateSecureToken(16)
 	if err != nil {
 		return "", err
 	}
-	if check := um.DB.Model(u).Update("hashed_password", hex.EncodeToString(hashedPass)); check.Error != nil {
-		return "", check.Error
+	if err := um.CheckPassword(u, newPassword); err != nil {
+		return "", err
+	}
+	if err := um.setPassword(u, newPassword, AuditUserPasswordReset); err != nil {
+		return "", err
 	}
 	return newPassword, nil
 }
 
-// ToggleAdmin toggles the admin permissions of given user
+// GeneratePasswordResetToken is used to issue a single use token that lets
+// a user who forgot their password choose a new one
+func (um *UserManager) GeneratePasswordResetToken(username string) (string, error) {
+	if _, err := um.FindByUserName(username); err != nil {
+		return "", err
+	}
+	_, token, err := NewUserTokenManager(um.DB).NewToken(username, TokenResetPassword, 0)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ResetPasswordWithToken is used to set a new password for a user using a
+// token issued by GeneratePasswordResetToken. All of the user's sessions
+// are revoked once the password has been changed.
+func (um *UserManager) ResetPasswordWithToken(username, token, newPassword string) error {
+	u, err := um.FindByUserName(username)
+	if err != nil {
+		return err
+	}
+	// check the password before consuming the token so the user can try again
+	if err := um.CheckPassword(u, newPassword); err != nil {
+		return err
+	}
+	if _, err := NewUserTokenManager(um.DB).ConsumeToken(username, TokenResetPassword, token); err != nil {
+		return err
+	}
+	if err := um.setPassword(u, newPassword, AuditUserPasswordReset); err != nil {
+		return err
+	}
+	_, err = NewSessionManager(um.DB).RevokeAllSessionsForUser(username)
+	return err
+}
+
+// CheckPassword is used to check whether a user may change their password to the
+// given password according to the manager's PasswordPolicy, including reuse of
+// the current password or any of the previous PasswordPolicy.HistorySize passwords
+func (um *UserManager) CheckPassword(u *User, password string) error {
+	if err := um.PasswordPolicy.Validate(password); err != nil {
+		return err
+	}
+	if um.PasswordPolicy.HistorySize <= 0 {
+		return nil
+	}
+	var history []PasswordHistory
+	if err := um.DB.Where("user_name = ?", u.UserName).Order(
+		"created_at desc",
+	).Limit(um.PasswordPolicy.HistorySize).Find(&history).Error; err != nil {
+		return err
+	}
+	hashes := []string{u.HashedPassword}
+	for _, h := range history {
+		hashes = append(hashes, h.HashedPassword)
+	}
+	for _, hashed := range hashes {
+		if reused, err := comparePassword(hashed, password); err != nil {
+			return err
+		} else if reused {
+			return errors.New("password has been used recently, please choose another")
+		}
+	}
+	return nil
+}
+
+// setPassword hashes and stores a new password for the user, recording the
+// old one in their history and the change as the given audit action
+func (um *UserManager) setPassword(u *User, password, action string) error {
+	hashedPass, err := hashPassword(um.PasswordHashing, password)
+	if err != nil {
+		return err
+	}
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Create(&PasswordHistory{
+			UserName:       u.UserName,
+			HashedPassword: u.HashedPassword,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(u).Update("hashed_password", hashedPass).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, action, AuditSubjectUser, u.UserName, nil, nil)
+	})
+}
+
+// ToggleAdmin toggles the admin permissions of given user by assigning or
+// revoking the admin role. Users who are only administrators through the
+// legacy AdminAccess flag have the flag cleared.
 func (um *UserManager) ToggleAdmin(username string) (bool, error) {
-	var user User
-	um.DB.Where("user_name = ?", username).First(&user)
-	if user.CreatedAt == nilTime {
-		return false, errors.New("user account does not exist")
+	user, err := um.FindByUserName(username)
+	if err != nil {
+		return false, err
+	}
+	rm := NewRoleManager(um.DB)
+	if err := rm.ensureAdminRole(); err != nil {
+		return false, err
+	}
+	hasRole, err := rm.HasRole(username, AdminRole)
+	if err != nil {
+		return false, err
 	}
-	if check := um.DB.Model(&user).Update("admin_access", !user.AdminAccess); check.Error != nil {
-		return false, check.Error
+	// users with only the legacy flag set are considered administrators
+	isAdmin := hasRole || user.AdminAccess
+	if err := withTransaction(um.DB, func(tx *gorm.DB) error {
+		var err error
+		switch {
+		case hasRole:
+			err = NewRoleManager(tx).RevokeRole(username, AdminRole, ActorFrom(um.DB))
+		case isAdmin:
+			err = clearAdminAccess(tx, []string{username})
+		default:
+			_, err = NewRoleManager(tx).AssignRole(username, AdminRole, ActorFrom(um.DB))
+		}
+		if err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserAdminToggled, AuditSubjectUser, username,
+			map[string]interface{}{"admin": isAdmin},
+			map[string]interface{}{"admin": !isAdmin},
+		)
+	}); err != nil {
+		return false, err
 	}
 	return true, nil
 }
@@ -478,6 +805,15 @@ func (um *UserManager) UpdateCustomerObjectHash(username, newHash string) error
 	if err != nil {
 		return err
 	}
+	before := user.CustomerObjectHash
 	user.CustomerObjectHash = newHash
-	return um.DB.Model(user).Update("customer_object_hash", newHash).Error
+	return withTransaction(um.DB, func(tx *gorm.DB) error {
+		if err := tx.Model(user).Update("customer_object_hash", newHash).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, AuditUserCustomerObjectChanged, AuditSubjectUser, username,
+			map[string]interface{}{"customer_object_hash": before},
+			map[string]interface{}{"customer_object_hash": newHash},
+		)
+	})
 }
@@ -2,6 +2,7 @@ package models
 
 import (
 	"testing"
+	"time"
 )
 
 var (
@@ -61,6 +62,8 @@ func TestUserManager_NewAccount(t *testing.T) {
 func TestUserManager_GetPrivateIPFSNetworksForUSer(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(NetworkMember{})
+	defer db.Unscoped().Where("network_name = ?", "thisisdefinitelynotgoingtobarealnamedude").Delete(&NetworkMember{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -89,6 +92,7 @@ func TestUserManager_GetPrivateIPFSNetworksForUSer(t *testing.T) {
 func TestUserManager_CheckIfUserHasAccessToNetwork(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(NetworkMember{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -111,6 +115,7 @@ func TestUserManager_CheckIfUserHasAccessToNetwork(t *testing.T) {
 func TestUserManager_AddandRemoveIPFSNetworkForUSer(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(NetworkMember{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -148,6 +153,8 @@ func TestUserManager_AddandRemoveIPFSNetworkForUSer(t *testing.T) {
 func TestUserManager_AddIPFSKeyForUser(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(KeyGrant{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -174,6 +181,8 @@ func TestUserManager_AddIPFSKeyForUser(t *testing.T) {
 func TestUserManager_GetKeysForUser(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(KeyGrant{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -196,6 +205,8 @@ func TestUserManager_GetKeysForUser(t *testing.T) {
 func TestUserManager_GetKeyIDByName(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(KeyGrant{})
 	var um = NewUserManager(db)
 	type args struct {
 		userName string
@@ -235,6 +246,8 @@ func TestUserManager_GetKeyIDByName(t *testing.T) {
 func TestUserManager_CheckIfKeyOwnedByUser(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(KeyGrant{})
 	var um = NewUserManager(db)
 	type args struct {
 		userName string
@@ -304,6 +317,7 @@ func TestUserManager_CheckIfAccountEnabled(t *testing.T) {
 func TestUserManager_ChangePassword(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(PasswordHistory{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name        string
@@ -327,9 +341,56 @@ func TestUserManager_ChangePassword(t *testing.T) {
 	}
 }
 
+func TestUserManager_PasswordPolicy(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(PasswordHistory{})
+	db.AutoMigrate(LoginAttempt{})
+	var um = NewUserManager(db)
+	um.PasswordPolicy.HistorySize = 2
+	if _, err := um.NewUserAccount("policyuser", "short", "policyuser@example.org"); err == nil {
+		t.Fatal("error expected")
+	}
+	user, err := um.NewUserAccount("policyuser", "password123", "policyuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "policyuser").Delete(&PasswordHistory{})
+	if _, err := um.ChangePassword("policyuser", "password123", "password123"); err == nil {
+		t.Fatal("current password should not be reusable")
+	}
+	if _, err := um.ChangePassword("policyuser", "password123", "password456"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.ChangePassword("policyuser", "password456", "password123"); err == nil {
+		t.Fatal("previous password should not be reusable")
+	}
+	// signing in with upgraded hashing options should rehash the password
+	um.PasswordHashing = PasswordHashOptions{Algorithm: PasswordArgon2id, Argon2Time: 1, Argon2Memory: 1024, Argon2Threads: 1}
+	if valid, err := um.SignIn("policyuser", "password456"); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("sign in should succeed")
+	}
+	user, err = um.FindByUserName("policyuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if needsRehash(um.PasswordHashing, user.HashedPassword) {
+		t.Fatal("failed to upgrade password hash")
+	}
+	if valid, err := um.SignIn("policyuser", "password456"); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("sign in should succeed")
+	}
+}
+
 func TestUserManager_SignIn(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(LoginAttempt{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name      string
@@ -364,6 +425,52 @@ func TestUserManager_SignIn(t *testing.T) {
 	}
 }
 
+func TestUserManager_Lockout(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(LoginAttempt{})
+	var um = NewUserManager(db)
+	um.Lockout = LockoutPolicy{MaxFailures: 3, Window: time.Minute, Cooldown: time.Minute}
+	user, err := um.NewUserAccount("lockoutuser", "password123", "lockoutuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	defer um.DB.Unscoped().Where("user_name = ?", "lockoutuser").Delete(&LoginAttempt{})
+	opts := SignInOptions{IPAddress: "127.0.0.1"}
+	for i := 0; i < 3; i++ {
+		if valid, err := um.SignInWithOptions("lockoutuser", "badpassword", opts); err == nil || valid {
+			t.Fatal("error expected")
+		}
+	}
+	if locked, err := um.CheckIfAccountLocked("lockoutuser"); err != nil {
+		t.Fatal(err)
+	} else if !locked {
+		t.Fatal("account should be locked")
+	}
+	// correct password should be rejected while locked
+	if _, err := um.SignInWithOptions("lockoutuser", "password123", opts); err == nil {
+		t.Fatal("error expected")
+	} else if err.Error() != ErrAccountLocked {
+		t.Fatalf("unexpected error %v", err)
+	}
+	failed, err := NewLoginAttemptManager(db).FindFailedAttempts("lockoutuser", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 4 {
+		t.Fatalf("expected 4 failed attempts, got %v", len(failed))
+	}
+	if err := um.UnlockAccount("lockoutuser"); err != nil {
+		t.Fatal(err)
+	}
+	if valid, err := um.SignInWithOptions("lockoutuser", "password123", opts); err != nil {
+		t.Fatal(err)
+	} else if !valid {
+		t.Fatal("sign in should succeed")
+	}
+}
+
 func TestUserManager_ComparePlaintextPasswordToHash(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
@@ -469,6 +576,7 @@ func TestUserManager_Credits(t *testing.T) {
 func TestUserManager_ResetPassword(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(PasswordHistory{})
 	var um = NewUserManager(db)
 	tests := []struct {
 		name    string
@@ -491,6 +599,79 @@ func TestUserManager_ResetPassword(t *testing.T) {
 	}
 }
 
+func TestUserManager_PasswordResetToken(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(UserToken{})
+	db.AutoMigrate(Session{})
+	db.AutoMigrate(PasswordHistory{})
+	var um = NewUserManager(db)
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"Success", args{username, email, "password123"}, false},
+		{"Failure", args{"notarealuser", "notarealemail", "password123"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := um.GeneratePasswordResetToken(tt.args.userName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GeneratePasswordResetToken err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err := um.ResetPasswordWithToken(tt.args.userName, token, tt.args.password); (err != nil) != tt.wantErr {
+				t.Fatalf("ResetPasswordWithToken err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if err := um.ResetPasswordWithToken(tt.args.userName, token, "newpassword123"); err == nil {
+				t.Fatal("token should only be usable once")
+			}
+			if valid, err := um.ComparePlaintextPasswordToHash(tt.args.userName, tt.args.password); err != nil {
+				t.Fatal(err)
+			} else if !valid {
+				t.Fatal("failed to reset password")
+			}
+		})
+	}
+}
+
+func TestUserManager_EmailVerificationToken(t *testing.T) {
+	db := newTestDB(t, &User{})
+	defer db.Close()
+	db.AutoMigrate(UserToken{})
+	var um = NewUserManager(db)
+	user, err := um.NewUserAccount("emailverifyuser", "password123", "emailverifyuser@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer um.DB.Unscoped().Delete(user)
+	user, err = um.GenerateEmailVerificationToken("emailverifyuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := user.EmailVerificationToken
+	// regenerating invalidates the previous token
+	user, err = um.GenerateEmailVerificationToken("emailverifyuser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := um.ValidateEmailVerificationToken("emailverifyuser", token); err == nil {
+		t.Fatal("error expected")
+	}
+	if user, err = um.ValidateEmailVerificationToken("emailverifyuser", user.EmailVerificationToken); err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailEnabled {
+		t.Fatal("email should be enabled")
+	}
+	if _, err := um.GenerateEmailVerificationToken("emailverifyuser"); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
 func TestUserManager_Customer_Hash(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
@@ -542,6 +723,8 @@ func TestUserManager_Customer_Hash(t *testing.T) {
 func TestUserManager_RemoveIPFSKeys(t *testing.T) {
 	db := newTestDB(t, &User{})
 	defer db.Close()
+	db.AutoMigrate(IPFSKey{})
+	db.AutoMigrate(KeyGrant{})
 	var um = NewUserManager(db)
 	type args struct {
 		userName string
@@ -593,6 +776,11 @@ func TestUserManager_RemoveIPFSKeys(t *testing.T) {
 					t.Fatal("failed to correctly delete key id")
 				}
 			}
+			if owned, err := um.CheckIfKeyOwnedByUser(tt.args.userName, tt.args.keyName); err != nil {
+				t.Fatal(err)
+			} else if owned {
+				t.Fatal("failed to correctly delete key")
+			}
 		})
 	}
 }
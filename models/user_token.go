@@ -0,0 +1,145 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+	"github.com/jinzhu/gorm"
+)
+
+// TokenPurpose is the action a user token authorizes
+type TokenPurpose string
+
+// String returns the value of TokenPurpose as a string
+func (p TokenPurpose) String() string {
+	return string(p)
+}
+
+// DefaultLifetime returns how long tokens of this purpose remain valid
+func (p TokenPurpose) DefaultLifetime() time.Duration {
+	switch p {
+	case TokenSignInChallenge:
+		return 5 * time.Minute
+	case TokenResetPassword:
+		return time.Hour
+	default:
+		return time.Hour * 24
+	}
+}
+
+const (
+	// TokenVerifyEmail is used to confirm ownership of an email address
+	TokenVerifyEmail TokenPurpose = "verify-email"
+	// TokenResetPassword is used to let a user set a new password if they forgot it
+	TokenResetPassword TokenPurpose = "reset-password"
+	// TokenChangeEmail is used to confirm a change of email address
+	TokenChangeEmail TokenPurpose = "change-email"
+	// TokenSignInChallenge is used to prove a password was verified when
+	// completing a sign-in with a second factor
+	TokenSignInChallenge TokenPurpose = "sign-in-challenge"
+)
+
+const (
+	// ErrInvalidToken is an error triggered when a token is unknown, expired or already used
+	ErrInvalidToken = "invalid or expired token provided"
+)
+
+// UserToken is a single-use, time-limited secret issued to a user.
+// Only the hash of the token is stored.
+type UserToken struct {
+	gorm.Model
+	UserName  string       `gorm:"type:varchar(255);index"`
+	Purpose   TokenPurpose `gorm:"type:varchar(255)"`
+	TokenHash string       `gorm:"type:varchar(255);unique"`
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
+
+// UserTokenManager is used to manipulate user tokens
+type UserTokenManager struct {
+	DB *gorm.DB
+}
+
+// NewUserTokenManager is used to generate our user token manager helper
+func NewUserTokenManager(db *gorm.DB) *UserTokenManager {
+	return &UserTokenManager{DB: db}
+}
+
+// NewToken is used to issue a token for the given purpose, returning the
+// plaintext token to send to the user. Any outstanding tokens the user has
+// for the same purpose are invalidated. If lifetime is 0 the purpose's
+// default lifetime is used.
+func (tm *UserTokenManager) NewToken(username string, purpose TokenPurpose, lifetime time.Duration) (*UserToken, string, error) {
+	token, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	if lifetime == 0 {
+		lifetime = purpose.DefaultLifetime()
+	}
+	ut := &UserToken{
+		UserName:  username,
+		Purpose:   purpose,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: time.Now().Add(lifetime),
+	}
+	if err := withTransaction(tm.DB, func(tx *gorm.DB) error {
+		if err := tm.invalidate(tx, username, purpose); err != nil {
+			return err
+		}
+		return tx.Create(ut).Error
+	}); err != nil {
+		return nil, "", err
+	}
+	return ut, token, nil
+}
+
+// ConsumeToken is used to validate a token for the given user and purpose,
+// marking it as used so that it can not be used again
+func (tm *UserTokenManager) ConsumeToken(username string, purpose TokenPurpose, token string) (*UserToken, error) {
+	var candidates []UserToken
+	if err := tm.DB.Where(
+		"user_name = ? AND purpose = ? AND used_at IS NULL AND expires_at > ?",
+		username, purpose, time.Now(),
+	).Find(&candidates).Error; err != nil {
+		return nil, err
+	}
+	for _, ut := range candidates {
+		if !utils.CompareTokenHash(token, ut.TokenHash) {
+			continue
+		}
+		now := time.Now()
+		// guard against the same token being consumed concurrently
+		check := tm.DB.Model(&UserToken{}).Where(
+			"id = ? AND used_at IS NULL", ut.ID,
+		).UpdateColumn("used_at", now)
+		if check.Error != nil {
+			return nil, check.Error
+		}
+		if check.RowsAffected == 0 {
+			break
+		}
+		ut.UsedAt = &now
+		return &ut, nil
+	}
+	return nil, errors.New(ErrInvalidToken)
+}
+
+// InvalidateTokens is used to invalidate all outstanding tokens a user has for a purpose
+func (tm *UserTokenManager) InvalidateTokens(username string, purpose TokenPurpose) error {
+	return tm.invalidate(tm.DB, username, purpose)
+}
+
+// PurgeExpiredTokens is used to permanently remove tokens that expired
+// before the given time, returning the number of tokens removed
+func (tm *UserTokenManager) PurgeExpiredTokens(before time.Time) (int64, error) {
+	check := tm.DB.Unscoped().Where("expires_at < ?", before).Delete(&UserToken{})
+	return check.RowsAffected, check.Error
+}
+
+func (tm *UserTokenManager) invalidate(db *gorm.DB, username string, purpose TokenPurpose) error {
+	return db.Model(&UserToken{}).Where(
+		"user_name = ? AND purpose = ? AND used_at IS NULL", username, purpose,
+	).UpdateColumn("expires_at", time.Now()).Error
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUserTokenManager(t *testing.T) {
+	db := newTestDB(t, &UserToken{})
+	defer db.Close()
+	var tm = NewUserTokenManager(db)
+	defer tm.DB.Unscoped().Where("user_name = ?", "tokenuser").Delete(&UserToken{})
+	type args struct {
+		purpose  TokenPurpose
+		lifetime time.Duration
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{"VerifyEmail", args{TokenVerifyEmail, 0}, false},
+		{"ResetPassword", args{TokenResetPassword, 0}, false},
+		{"ChangeEmail", args{TokenChangeEmail, time.Minute}, false},
+		{"Expired", args{TokenVerifyEmail, -time.Minute}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ut, token, err := tm.NewToken("tokenuser", tt.args.purpose, tt.args.lifetime)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ut.TokenHash == token {
+				t.Fatal("token should not be stored in plaintext")
+			}
+			// a token for a different purpose should never validate
+			if _, err := tm.ConsumeToken("tokenuser", TokenPurpose("bad-purpose"), token); err == nil {
+				t.Fatal("error expected")
+			}
+			if _, err := tm.ConsumeToken("tokenuser", tt.args.purpose, token); (err != nil) != tt.wantErr {
+				t.Fatalf("ConsumeToken() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			// tokens are single use
+			if _, err := tm.ConsumeToken("tokenuser", tt.args.purpose, token); err == nil {
+				t.Fatal("error expected")
+			}
+		})
+	}
+	// issuing a new token invalidates the previous one
+	_, token1, err := tm.NewToken("tokenuser", TokenVerifyEmail, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token2, err := tm.NewToken("tokenuser", TokenVerifyEmail, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tm.ConsumeToken("tokenuser", TokenVerifyEmail, token1); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := tm.ConsumeToken("tokenuser", TokenVerifyEmail, token2); err != nil {
+		t.Fatal(err)
+	}
+}
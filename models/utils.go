@@ -5,4 +5,6 @@ import "time"
 var nilTime time.Time
 
 // AdminAddress is the eth address of the admin account
+//
+// Deprecated: administrators are identified by the admin role, see RoleManager
 var AdminAddress = "0xC6C35f43fDD71f86a2D8D4e3cA1Ce32564c38bd9"
@@ -0,0 +1,31 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+func TestEncryptSecret(t *testing.T) {
+	key := []byte("abcdefghijklmnopqrstuvwxyz012345")
+	encrypted, err := utils.EncryptSecret(key, "such secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted == "such secret" {
+		t.Fatal("secret was not encrypted")
+	}
+	decrypted, err := utils.DecryptSecret(key, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "such secret" {
+		t.Fatal("failed to decrypt secret")
+	}
+	if _, err := utils.DecryptSecret([]byte("zyxwvutsrqponmlkjihgfedcba543210"), encrypted); err == nil {
+		t.Fatal("error expected")
+	}
+	if _, err := utils.EncryptSecret([]byte("short"), "such secret"); err == nil {
+		t.Fatal("error expected")
+	}
+}
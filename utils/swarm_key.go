@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+/*
+Utilities for IPFS private network pre-shared keys, as read by go-ipfs from
+a swarm.key file
+*/
+
+const (
+	// SwarmKeyHeader is the first line of a swarm key file
+	SwarmKeyHeader = "/key/swarm/psk/1.0.0/"
+	// SwarmKeySize is the number of bytes in a swarm key
+	SwarmKeySize = 32
+)
+
+// GenerateSwarmKey is used to generate a random swarm key, formatted as
+// the contents of a base16 encoded swarm.key file
+func GenerateSwarmKey() (string, error) {
+	b := make([]byte, SwarmKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return FormatSwarmKey(b), nil
+}
+
+// FormatSwarmKey is used to format a key as the contents of a base16
+// encoded swarm.key file
+func FormatSwarmKey(key []byte) string {
+	return SwarmKeyHeader + "\n/base16/\n" + hex.EncodeToString(key)
+}
+
+// ParseSwarmKey is used to parse the contents of a swarm.key file,
+// returning the key. The base16 and base64 encodings are supported.
+func ParseSwarmKey(contents string) ([]byte, error) {
+	lines := strings.Split(strings.TrimSpace(contents), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	if len(lines) != 3 || lines[0] != SwarmKeyHeader {
+		return nil, errors.New("swarm key must have a header, encoding and key on separate lines")
+	}
+	var (
+		key []byte
+		err error
+	)
+	switch lines[1] {
+	case "/base16/":
+		key, err = hex.DecodeString(lines[2])
+	case "/base64/":
+		key, err = base64.StdEncoding.DecodeString(lines[2])
+	default:
+		return nil, fmt.Errorf("unsupported swarm key encoding '%s'", lines[1])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != SwarmKeySize {
+		return nil, fmt.Errorf("swarm key must be %v bytes", SwarmKeySize)
+	}
+	return key, nil
+}
+
+// SwarmKeyFingerprint returns a short identifier for a swarm key, so that
+// keys can be told apart without storing them
+func SwarmKeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
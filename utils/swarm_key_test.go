@@ -0,0 +1,67 @@
+package utils_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+func TestGenerateSwarmKey(t *testing.T) {
+	contents, err := utils.GenerateSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(contents, utils.SwarmKeyHeader+"\n/base16/\n") {
+		t.Fatalf("unexpected swarm key %s", contents)
+	}
+	key, err := utils.ParseSwarmKey(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := utils.GenerateSwarmKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == contents {
+		t.Fatal("swarm keys should be random")
+	}
+	if utils.FormatSwarmKey(key) != contents {
+		t.Fatal("formatting a parsed key should give the original contents")
+	}
+}
+
+func TestParseSwarmKey(t *testing.T) {
+	key := bytes.Repeat([]byte{0xab}, utils.SwarmKeySize)
+	tests := []struct {
+		name     string
+		contents string
+		wantErr  bool
+	}{
+		{"base16", utils.FormatSwarmKey(key), false},
+		{"base64", utils.SwarmKeyHeader + "\n/base64/\n" + base64.StdEncoding.EncodeToString(key), false},
+		{"trailing newline", utils.FormatSwarmKey(key) + "\n", false},
+		{"windows line endings", strings.Replace(utils.FormatSwarmKey(key), "\n", "\r\n", -1), false},
+		{"opaque string", "such swarm much protec", true},
+		{"bad header", strings.Replace(utils.FormatSwarmKey(key), "1.0.0", "2.0.0", 1), true},
+		{"bad encoding", utils.SwarmKeyHeader + "\n/bin/\n" + string(key), true},
+		{"bad hex", utils.SwarmKeyHeader + "\n/base16/\nzz", true},
+		{"short key", utils.FormatSwarmKey(key[:16]), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := utils.ParseSwarmKey(tt.contents)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSwarmKey() err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(got, key) {
+				t.Fatal("parsed key does not match")
+			}
+		})
+	}
+	if utils.SwarmKeyFingerprint(key) == utils.SwarmKeyFingerprint(key[1:]) {
+		t.Fatal("different keys should have different fingerprints")
+	}
+}
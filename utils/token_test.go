@@ -0,0 +1,34 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+func TestSecureToken(t *testing.T) {
+	token1, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token2, err := utils.GenerateSecureToken(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token1) != 64 {
+		t.Fatal("bad token length")
+	}
+	if token1 == token2 {
+		t.Fatal("generated two tokens that were the same")
+	}
+	hash := utils.HashToken(token1)
+	if hash == token1 {
+		t.Fatal("hash should not equal token")
+	}
+	if !utils.CompareTokenHash(token1, hash) {
+		t.Fatal("token should match its hash")
+	}
+	if utils.CompareTokenHash(token2, hash) {
+		t.Fatal("token should not match another tokens hash")
+	}
+}
@@ -0,0 +1,64 @@
+package utils_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RTradeLtd/database/v2/utils"
+)
+
+// base32 encoding of the RFC 6238 test secret "12345678901234567890"
+const rfcTestSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestGenerateTOTPCode(t *testing.T) {
+	tests := []struct {
+		name string
+		unix int64
+		want string
+	}{
+		// RFC 6238 appendix B vectors truncated to 6 digits
+		{"59", 59, "287082"},
+		{"1111111109", 1111111109, "081804"},
+		{"1234567890", 1234567890, "005924"},
+		{"2000000000", 2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := utils.GenerateTOTPCode(rfcTestSecret, utils.TOTPStep(time.Unix(tt.unix, 0)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if code != tt.want {
+				t.Fatalf("GenerateTOTPCode() = %s, want %s", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPCode(t *testing.T) {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utils.IsTOTPSecret(secret) || utils.IsTOTPSecret("bm90IGEgc2VjcmV0") {
+		t.Fatal("failed to recognise totp secret")
+	}
+	now := time.Now()
+	code, err := utils.GenerateTOTPCode(secret, utils.TOTPStep(now.Add(-utils.TOTPPeriod*time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok := utils.ValidateTOTPCode(secret, code, now, 1); !ok {
+		t.Fatal("code within skew should be valid")
+	} else if step != utils.TOTPStep(now)-1 {
+		t.Fatal("bad step returned")
+	}
+	if _, ok := utils.ValidateTOTPCode(secret, code, now, 0); ok {
+		t.Fatal("code outside of skew should be invalid")
+	}
+	uri := utils.TOTPProvisioningURI("Temporal", "user@example.org", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/") || !strings.Contains(uri, secret) {
+		t.Fatalf("bad provisioning uri %s", uri)
+	}
+}